@@ -0,0 +1,123 @@
+// Command breachindex builds the breached password index used to reject
+// passwords on registration, password change and reset.
+//
+// It reads one password per line from stdin, or with -sha1 the uppercase
+// SHA-1 hashes of the Have I Been Pwned downloads ("HASH:count" lines).
+// Hashes are streamed into the index and have to be sorted, as in the
+// download ordered by hash. Passwords are sorted in memory, so their list
+// has to fit in it.
+//
+//	breachindex -sha1 -o breached.idx < pwned-passwords-sha1-ordered-by-hash.txt
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/SawitProRecruitment/UserService/strength"
+)
+
+func main() {
+	output := flag.String("o", "breached.idx", "index file to write")
+	hashed := flag.Bool("sha1", false, "read SHA-1 hashes sorted in ascending order instead of passwords")
+	flag.Parse()
+
+	f, err := os.Create(*output)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var count int64
+	if *hashed {
+		count, err = writeHashes(f)
+	} else {
+		count, err = writePasswords(f)
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(*output)
+		log.Fatal(err)
+	}
+
+	log.Printf("wrote %d breached passwords to %s", count, *output)
+}
+
+// writeHashes streams sorted "HASH:count" lines into the index.
+func writeHashes(f *os.File) (int64, error) {
+	writer, err := strength.NewIndexWriter(f)
+	if err != nil {
+		return 0, err
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		hexHash, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if hexHash == "" {
+			continue
+		}
+
+		// Checked first, longer input would not fit the hash
+		if len(hexHash) != hex.EncodedLen(sha1.Size) {
+			return 0, fmt.Errorf("invalid SHA-1 hash %q", hexHash)
+		}
+
+		var hash [sha1.Size]byte
+		_, err := hex.Decode(hash[:], []byte(hexHash))
+		if err != nil {
+			return 0, fmt.Errorf("invalid SHA-1 hash %q", hexHash)
+		}
+
+		err = writer.Add(hash)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return writer.Len(), writer.Close()
+}
+
+// writePasswords hashes and sorts a list of passwords in memory, then writes
+// them like sorted hashes so duplicates are not counted.
+func writePasswords(f *os.File) (int64, error) {
+	var hashes [][sha1.Size]byte
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		hashes = append(hashes, sha1.Sum([]byte(scanner.Text())))
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+
+	writer, err := strength.NewIndexWriter(f)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, hash := range hashes {
+		err = writer.Add(hash)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return writer.Len(), writer.Close()
+}
@@ -1,18 +1,48 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/SawitProRecruitment/UserService/handler"
+	"github.com/SawitProRecruitment/UserService/policy"
 	"github.com/SawitProRecruitment/UserService/repository"
+	"github.com/SawitProRecruitment/UserService/strength"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/labstack/echo/v4"
 )
 
 func main() {
 	e := echo.New()
 
+	// Client IP addresses key the lockouts and rate limits, so they are only
+	// taken from X-Forwarded-For when the request comes through one of the
+	// proxies in TRUSTED_PROXIES (comma separated CIDRs). Otherwise the
+	// address of the connection is used, since clients can send any header.
+	e.IPExtractor = echo.ExtractIPDirect()
+	if value := os.Getenv("TRUSTED_PROXIES"); value != "" {
+		trustOptions := []echo.TrustOption{
+			echo.TrustLoopback(false),
+			echo.TrustLinkLocal(false),
+			echo.TrustPrivateNet(false),
+		}
+		for _, cidr := range strings.Split(value, ",") {
+			_, ipRange, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				e.Logger.Fatalf("invalid TRUSTED_PROXIES: %v", err)
+			}
+			trustOptions = append(trustOptions, echo.TrustIPRange(ipRange))
+		}
+		e.IPExtractor = echo.ExtractIPFromXFFHeader(trustOptions...)
+	}
+
 	dbDsn := os.Getenv("DATABASE_URL")
-	var repo repository.RepositoryInterface = repository.NewRepository(repository.NewRepositoryOptions{
+	repo := repository.NewRepository(repository.NewRepositoryOptions{
 		Dsn: dbDsn,
 	})
 
@@ -20,17 +50,201 @@ func main() {
 	if err != nil {
 		e.Logger.Fatal(err)
 	}
-	pubKey, err := os.ReadFile("id_rsa.pub")
+
+	// Public keys of previous signing keys, comma separated, so tokens issued
+	// before a key rotation can still be verified
+	var retiredPubKeys [][]byte
+	for _, path := range strings.Split(os.Getenv("JWT_RETIRED_PUBLIC_KEYS"), ",") {
+		if path == "" {
+			continue
+		}
+
+		pubKey, err := os.ReadFile(path)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		retiredPubKeys = append(retiredPubKeys, pubKey)
+	}
+
+	// How far clocks may be apart when checking token times, such as 30s
+	var clockSkew time.Duration
+	if value := os.Getenv("JWT_CLOCK_SKEW"); value != "" {
+		clockSkew, err = time.ParseDuration(value)
+		if err != nil {
+			e.Logger.Fatalf("invalid JWT_CLOCK_SKEW: %v", err)
+		}
+	}
+
+	// Failed logins lock an account or IP address once they reach the
+	// threshold within the window, a threshold of 0 never locks
+	accountLockout := handler.DefaultAccountLockout
+	ipLockout := handler.DefaultIPLockout
+	for prefix, lockout := range map[string]*handler.LockoutPolicy{
+		"LOCKOUT_ACCOUNT": &accountLockout,
+		"LOCKOUT_IP":      &ipLockout,
+	} {
+		if value := os.Getenv(prefix + "_THRESHOLD"); value != "" {
+			lockout.Threshold, err = strconv.Atoi(value)
+			if err != nil || lockout.Threshold < 0 {
+				e.Logger.Fatalf("invalid %s_THRESHOLD: %q", prefix, value)
+			}
+		}
+		if value := os.Getenv(prefix + "_WINDOW"); value != "" {
+			lockout.Window, err = time.ParseDuration(value)
+			if err != nil || lockout.Window <= 0 {
+				e.Logger.Fatalf("invalid %s_WINDOW: %q", prefix, value)
+			}
+		}
+	}
+
+	revocations := repository.NewRevocationStore(repo.Db)
+	rateLimits := repository.NewRateLimitStore(repo.Db)
+
+	jwt, err := handler.NewJWT(handler.NewJWTOptions{
+		Issuer:            os.Getenv("JWT_ISSUER"),
+		Audience:          os.Getenv("JWT_AUDIENCE"),
+		TokenAudience:     os.Getenv("JWT_TOKEN_AUDIENCE"),
+		ClockSkew:         clockSkew,
+		PrivateKey:        prvKey,
+		RetiredPublicKeys: retiredPubKeys,
+		Revocations:       revocations,
+	})
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+
+	policyFile := os.Getenv("POLICY_FILE")
+	if policyFile == "" {
+		policyFile = "policy.yml"
+	}
+	accessPolicy, err := policy.Load(policyFile)
 	if err != nil {
 		e.Logger.Fatal(err)
 	}
 
+	// Passkeys are only offered when the relying party is configured, since
+	// browsers bind them to the domain of the site
+	var webAuthn *webauthn.WebAuthn
+	if rpID := os.Getenv("WEBAUTHN_RP_ID"); rpID != "" {
+		webAuthn, err = webauthn.New(&webauthn.Config{
+			RPID:          rpID,
+			RPDisplayName: handler.ServiceName,
+			RPOrigins:     strings.Split(os.Getenv("WEBAUTHN_RP_ORIGINS"), ","),
+		})
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+	}
+
+	// The argon2id cost can be raised as hardware gets faster, hashes made with
+	// older parameters are upgraded when users log in
+	argon2Params := handler.DefaultArgon2Params
+	for name, param := range map[string]*uint32{
+		"ARGON2_MEMORY_KIB": &argon2Params.Memory,
+		"ARGON2_ITERATIONS": &argon2Params.Iterations,
+	} {
+		if value := os.Getenv(name); value != "" {
+			// argon2 panics on hashing with any of them at 0
+			parsed, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || parsed < 1 {
+				e.Logger.Fatalf("invalid %s: %q", name, value)
+			}
+			*param = uint32(parsed)
+		}
+	}
+	if value := os.Getenv("ARGON2_PARALLELISM"); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 8)
+		if err != nil || parsed < 1 {
+			e.Logger.Fatalf("invalid ARGON2_PARALLELISM: %q", value)
+		}
+		argon2Params.Parallelism = uint8(parsed)
+	}
+
+	// Password peppers as comma separated version:base64 pairs. They live
+	// outside the database so a dump alone is not enough to crack passwords.
+	peppers := map[int][]byte{}
+	for _, entry := range strings.Split(os.Getenv("PASSWORD_PEPPERS"), ",") {
+		if entry == "" {
+			continue
+		}
+
+		version, encoded, found := strings.Cut(entry, ":")
+		if !found {
+			e.Logger.Fatal("invalid PASSWORD_PEPPERS entry, expected version:base64")
+		}
+
+		parsedVersion, err := strconv.Atoi(version)
+		if err != nil || parsedVersion <= 0 {
+			e.Logger.Fatalf("invalid PASSWORD_PEPPERS version %q", version)
+		}
+
+		pepper, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			e.Logger.Fatalf("invalid PASSWORD_PEPPERS secret for version %d: %v", parsedVersion, err)
+		}
+		peppers[parsedVersion] = pepper
+	}
+
+	// New passwords are checked against a local list of breached passwords
+	// when an index built with cmd/breachindex is configured
+	var breached *strength.Index
+	if indexFile := os.Getenv("BREACHED_PASSWORDS_INDEX"); indexFile != "" {
+		breached, err = strength.LoadIndex(indexFile)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+	}
+
 	opts := handler.NewServerOptions{
 		Repository: repo,
-		JWT:        handler.NewJWT(prvKey, pubKey),
+		JWT:        jwt,
+		Policy:     accessPolicy,
+		WebAuthn:   webAuthn,
+		// Messages are only logged until an SMS provider is integrated
+		SMS: handler.NewLogSMSSender(),
+		Passwords: handler.NewPasswordHasher(handler.NewPasswordHasherOptions{
+			Params:  argon2Params,
+			Peppers: peppers,
+		}),
+		PasswordStrength: strength.NewChecker(strength.NewCheckerOptions{
+			Index: breached,
+		}),
+		// Rate limits are shared through the database by every instance
+		RateLimits:     rateLimits,
+		AccountLockout: accountLockout,
+		IPLockout:      ipLockout,
 	}
 
 	handler.NewServer(opts).RegisterHandlers(e)
 
+	// Failures older than the longest window no longer count towards a lock
+	failureWindow := handler.MFATokenTTL
+	for _, window := range []time.Duration{accountLockout.Window, ipLockout.Window} {
+		if window > failureWindow {
+			failureWindow = window
+		}
+	}
+	pruneLoginFailures := func(ctx context.Context) error {
+		return repo.PruneLoginFailures(ctx, time.Now().Add(-failureWindow))
+	}
+
+	// Expired revocations, refilled rate limit buckets and stale login
+	// failures are deleted in the background rather than by the requests
+	// that create them
+	go prune(e.Logger, time.Minute, revocations.Prune, rateLimits.Prune, pruneLoginFailures)
+
 	e.Logger.Fatal(e.Start(":1323"))
 }
+
+// prune runs the pruners every interval for as long as the service runs. A
+// failed round is only logged, the next one catches up.
+func prune(logger echo.Logger, interval time.Duration, pruners ...func(context.Context) error) {
+	for range time.Tick(interval) {
+		for _, pruner := range pruners {
+			err := pruner(context.Background())
+			if err != nil {
+				logger.Error(err)
+			}
+		}
+	}
+}
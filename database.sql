@@ -1,7 +1,151 @@
+CREATE TABLE estates (
+    id serial PRIMARY KEY,
+    name VARCHAR (60) UNIQUE NOT NULL
+);
+
 CREATE TABLE users (
     id serial PRIMARY KEY ,
     phone_number VARCHAR (13) UNIQUE NOT NULL,
+    phone_verified BOOLEAN NOT NULL DEFAULT FALSE,
     full_name VARCHAR (60) NOT NULL,
-    password VARCHAR (64) NOT NULL,
-    successful_login INT DEFAULT 0
-)
\ No newline at end of file
+    password VARCHAR (255) NOT NULL,
+    -- Phone number that hashes made before salts were random are salted with
+    legacy_password_salt VARCHAR (13),
+    successful_login INT DEFAULT 0,
+    estate_id INT REFERENCES estates (id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    disabled_at TIMESTAMPTZ
+);
+
+CREATE TABLE refresh_tokens (
+    id serial PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    family_id VARCHAR (64) NOT NULL,
+    token_hash VARCHAR (64) UNIQUE NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+
+-- Every login, kept as the login history. A session is active while the
+-- refresh token family with its ID has a token left.
+CREATE TABLE sessions (
+    id VARCHAR (64) PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    method VARCHAR (32) NOT NULL,
+    ip_address VARCHAR (45) NOT NULL,
+    user_agent VARCHAR (512) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX sessions_user_id_idx ON sessions (user_id, created_at);
+
+CREATE TABLE revoked_tokens (
+    jti VARCHAR (64) PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- Token buckets of rate limits shared by every instance, rows of full
+-- buckets are deleted
+CREATE TABLE rate_limits (
+    key VARCHAR (128) PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    full_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX rate_limits_full_at_idx ON rate_limits (full_at);
+
+CREATE TABLE oauth_clients (
+    id serial PRIMARY KEY,
+    client_id VARCHAR (64) UNIQUE NOT NULL,
+    name VARCHAR (60) NOT NULL,
+    redirect_uris TEXT[] NOT NULL,
+    client_secret_hash VARCHAR (60),
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    created_by INT REFERENCES users (id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE oauth_authorization_codes (
+    code_hash VARCHAR (64) PRIMARY KEY,
+    client_id VARCHAR (64) NOT NULL REFERENCES oauth_clients (client_id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    redirect_uri TEXT NOT NULL,
+    scope TEXT NOT NULL,
+    code_challenge VARCHAR (128) NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ
+);
+
+CREATE TABLE roles (
+    id serial PRIMARY KEY,
+    name VARCHAR (32) UNIQUE NOT NULL
+);
+
+INSERT INTO roles (name) VALUES ('admin'), ('estate_manager'), ('farmer');
+
+CREATE TABLE user_roles (
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role_id INT NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+CREATE TABLE user_totp (
+    user_id INT PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    secret VARCHAR (64) NOT NULL,
+    confirmed_at TIMESTAMPTZ,
+    last_used_step BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE recovery_codes (
+    id serial PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    code_hash VARCHAR (64) NOT NULL,
+    used_at TIMESTAMPTZ,
+    UNIQUE (user_id, code_hash)
+);
+
+CREATE TABLE webauthn_credentials (
+    id serial PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    credential_id BYTEA UNIQUE NOT NULL,
+    public_key BYTEA NOT NULL,
+    attestation_type VARCHAR (32) NOT NULL,
+    aaguid BYTEA,
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    transports TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMPTZ
+);
+
+CREATE INDEX webauthn_credentials_user_id_idx ON webauthn_credentials (user_id);
+
+CREATE TABLE phone_otps (
+    id serial PRIMARY KEY,
+    phone_number VARCHAR (13) NOT NULL,
+    purpose VARCHAR (32) NOT NULL,
+    code_hash VARCHAR (60) NOT NULL,
+    ip_address VARCHAR (45) NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX phone_otps_phone_number_purpose_idx ON phone_otps (phone_number, purpose, created_at);
+CREATE INDEX phone_otps_ip_address_purpose_idx ON phone_otps (ip_address, purpose, created_at);
+
+-- Failed logins by account or IP address, kept in the database so lockouts
+-- survive restarts and apply across instances
+CREATE TABLE login_failures (
+    scope VARCHAR (16) NOT NULL,
+    key VARCHAR (64) NOT NULL,
+    failed_attempts INT NOT NULL DEFAULT 0,
+    last_failed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    locked_until TIMESTAMPTZ,
+    PRIMARY KEY (scope, key)
+);
@@ -0,0 +1,204 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SawitProRecruitment/UserService/handler/models"
+	"github.com/SawitProRecruitment/UserService/policy"
+	"github.com/SawitProRecruitment/UserService/repository/entity"
+	"github.com/labstack/echo/v4"
+)
+
+func (server *Server) ListUsers(c echo.Context) error {
+	ctx := c.Request().Context()
+	listRequest := &models.ListUsersRequest{}
+
+	err := c.Bind(listRequest)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to read request",
+			Error:   err.Error(),
+		})
+	}
+
+	errs := listRequest.Validate()
+	if len(errs) > 0 {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Invalid request",
+			Error:   errs,
+		})
+	}
+
+	filter := &entity.UserFilter{}
+
+	if listRequest.PhonePrefix != "" {
+		filter.PhoneNumberPrefix = &listRequest.PhonePrefix
+	}
+
+	if listRequest.Name != "" {
+		filter.FullNameContains = &listRequest.Name
+	}
+
+	if listRequest.CreatedFrom != "" {
+		createdFrom, _ := time.Parse(models.DateLayout, listRequest.CreatedFrom)
+		filter.CreatedFrom = &createdFrom
+	}
+
+	// The whole day of created_to is included
+	if listRequest.CreatedTo != "" {
+		createdTo, _ := time.Parse(models.DateLayout, listRequest.CreatedTo)
+		createdTo = createdTo.AddDate(0, 0, 1)
+		filter.CreatedTo = &createdTo
+	}
+
+	subject, ok, err := server.policySubject(c)
+	if !ok {
+		return err
+	}
+
+	if !server.Policy.Allowed(subject, "list", policy.Resource{Type: "user"}) {
+		return c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: "Action not allowed",
+		})
+	}
+
+	page := listRequest.Page
+	if page == 0 {
+		page = 1
+	}
+
+	perPage := listRequest.PerPage
+	if perPage == 0 {
+		perPage = models.DefaultPerPage
+	}
+
+	users, total, err := server.Repository.ListUsers(ctx, filter, perPage, (page-1)*perPage)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to list users",
+			Error:   err.Error(),
+		})
+	}
+
+	listResponse := models.ListUsersResponse{
+		Users:   make([]models.AdminUserResponse, 0, len(users)),
+		Page:    page,
+		PerPage: perPage,
+		Total:   total,
+	}
+	for _, user := range users {
+		listResponse.Users = append(listResponse.Users, adminUserResponse(user, nil))
+	}
+
+	return c.JSON(http.StatusOK, listResponse)
+}
+
+func (server *Server) GetAdminUser(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Invalid user ID",
+			Error:   err.Error(),
+		})
+	}
+
+	user, ok, err := server.authorizeOnUser(c, userID, "user", "read", nil)
+	if !ok {
+		return err
+	}
+
+	roles, err := server.Repository.GetUserRoles(c.Request().Context(), user.ID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get user roles",
+			Error:   err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, adminUserResponse(user, roles))
+}
+
+func (server *Server) DisableUser(c echo.Context) error {
+	return server.setUserDisabled(c, true)
+}
+
+func (server *Server) EnableUser(c echo.Context) error {
+	return server.setUserDisabled(c, false)
+}
+
+func (server *Server) setUserDisabled(c echo.Context, disabled bool) error {
+	ctx := c.Request().Context()
+
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Invalid user ID",
+			Error:   err.Error(),
+		})
+	}
+
+	action := "enable"
+	if disabled {
+		action = "disable"
+	}
+
+	user, ok, err := server.authorizeOnUser(c, userID, "user", action, nil)
+	if !ok {
+		return err
+	}
+
+	// Nobody should be able to lock themselves out
+	if disabled && CurrentPrincipal(c).UserID == userID {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Cannot disable yourself",
+		})
+	}
+
+	err = server.Repository.SetUserDisabled(ctx, userID, disabled)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to update user",
+			Error:   err.Error(),
+		})
+	}
+
+	user.DisabledAt = nil
+	if disabled {
+		// Access tokens the user already has stop working
+		err = server.revokeUserSessions(ctx, userID)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Message: "Failed to revoke sessions",
+				Error:   err.Error(),
+			})
+		}
+
+		// A disabled user must not be able to get new access tokens
+		err = server.Repository.RevokeUserRefreshTokens(ctx, userID)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Message: "Failed to revoke refresh tokens",
+				Error:   err.Error(),
+			})
+		}
+
+		now := time.Now()
+		user.DisabledAt = &now
+	}
+
+	return c.JSON(http.StatusOK, adminUserResponse(user, nil))
+}
+
+func adminUserResponse(user *entity.UserData, roles []string) models.AdminUserResponse {
+	return models.AdminUserResponse{
+		ID:          user.ID,
+		PhoneNumber: user.PhoneNumber,
+		FullName:    user.FullName,
+		EstateID:    user.EstateID,
+		Roles:       roles,
+		CreatedAt:   user.CreatedAt,
+		Disabled:    user.DisabledAt != nil,
+	}
+}
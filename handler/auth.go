@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/SawitProRecruitment/UserService/handler/models"
+	"github.com/SawitProRecruitment/UserService/repository/entity"
+	"github.com/labstack/echo/v4"
+)
+
+// principalContextKey is where Authenticate stores the Principal
+const principalContextKey = "principal"
+
+// Principal is the user a request is authenticated as by its access token.
+type Principal struct {
+	UserID int64
+	Roles  []string
+	// Scopes limit tokens issued to OAuth2 clients, tokens issued on login
+	// have none and are not limited
+	Scopes []string
+	// SessionID is empty for tokens issued to OAuth2 clients and before
+	// sessions were recorded
+	SessionID string
+	// ClientID is set on tokens issued to an OAuth2 client
+	ClientID string
+	// Claims of the access token, to revoke it
+	Claims *Claims
+}
+
+// Authenticate is a middleware that only lets requests with a valid access
+// token the user got on login through, answering 401 otherwise. Tokens issued
+// to OAuth2 clients are answered 403, the routes behind it manage the account
+// and are not delegated. Handlers behind it get the user with
+// CurrentPrincipal.
+func (server *Server) Authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		principal, ok, err := server.authenticate(c)
+		if !ok {
+			return err
+		}
+
+		if principal.ClientID != "" {
+			return c.JSON(http.StatusForbidden, models.ErrorResponse{
+				Message: "Tokens issued to OAuth2 clients are not accepted",
+			})
+		}
+
+		return next(c)
+	}
+}
+
+// RequireScope returns a middleware for routes OAuth2 clients may call on
+// behalf of the user. Tokens issued to a client need every one of the scopes,
+// and are answered 403 with an insufficient_scope challenge otherwise.
+// Tokens the user got on login are not limited by scopes.
+func (server *Server) RequireScope(scopes ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			principal, ok, err := server.authenticate(c)
+			if !ok {
+				return err
+			}
+
+			if principal.ClientID != "" {
+				for _, scope := range scopes {
+					if !containsString(principal.Scopes, scope) {
+						c.Response().Header().Set("WWW-Authenticate",
+							`Bearer error="insufficient_scope", scope="`+strings.Join(scopes, " ")+`"`)
+
+						return c.JSON(http.StatusForbidden, models.ErrorResponse{
+							Message: "Insufficient scope",
+						})
+					}
+				}
+
+				// Disabling a user does not revoke the tokens of their clients,
+				// since those are not bound to a session
+				active, err := server.userActive(c.Request().Context(), principal.UserID)
+				if err != nil {
+					return c.JSON(http.StatusForbidden, models.ErrorResponse{
+						Message: "Failed to get user",
+						Error:   err.Error(),
+					})
+				}
+				if !active {
+					return c.JSON(http.StatusForbidden, models.ErrorResponse{
+						Message: "User is disabled",
+					})
+				}
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// userActive tells whether the user still exists and is not disabled.
+func (server *Server) userActive(ctx context.Context, userID int64) (bool, error) {
+	user, err := server.Repository.GetUser(ctx, &entity.UserFilter{
+		ID: &userID,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return user != nil && user.DisabledAt == nil, nil
+}
+
+// CurrentPrincipal returns the user authenticated by Authenticate or
+// RequireRole, or nil on routes without either.
+func CurrentPrincipal(c echo.Context) *Principal {
+	principal, _ := c.Get(principalContextKey).(*Principal)
+
+	return principal
+}
+
+// authenticate validates the access token of the request once and stores the
+// Principal. When there is no valid token the response has already been
+// written and ok is false.
+func (server *Server) authenticate(c echo.Context) (principal *Principal, ok bool, err error) {
+	if principal := CurrentPrincipal(c); principal != nil {
+		return principal, true, nil
+	}
+
+	headerAuthorization := c.Request().Header.Get("Authorization")
+	if headerAuthorization == "" {
+		return nil, false, unauthorized(c, "", models.ErrorResponse{
+			Message: "Missing authorization token",
+		})
+	}
+
+	claims, err := server.JWT.ValidateToken(c.Request().Context(), headerAuthorization)
+	if err != nil {
+		return nil, false, unauthorized(c, "invalid_token", models.ErrorResponse{
+			Message: "Failed to validate token",
+			Error:   err.Error(),
+		})
+	}
+
+	// Tokens of OAuth2 clients acting on their own behalf have no user
+	userID, err := claims.UserID()
+	if err != nil {
+		return nil, false, unauthorized(c, "invalid_token", models.ErrorResponse{
+			Message: "Invalid user ID in token claims",
+			Error:   err.Error(),
+		})
+	}
+
+	principal = &Principal{
+		UserID:    userID,
+		Roles:     claims.Roles,
+		Scopes:    claims.Scopes(),
+		SessionID: claims.SessionID,
+		ClientID:  claims.ClientID,
+		Claims:    claims,
+	}
+	c.Set(principalContextKey, principal)
+
+	return principal, true, nil
+}
+
+// unauthorized answers 401 with the Bearer challenge of RFC 6750, and the
+// error code when a token was presented.
+func unauthorized(c echo.Context, errorCode string, response models.ErrorResponse) error {
+	challenge := "Bearer"
+	if errorCode != "" {
+		challenge += ` error="` + errorCode + `"`
+	}
+	c.Response().Header().Set("WWW-Authenticate", challenge)
+
+	return c.JSON(http.StatusUnauthorized, response)
+}
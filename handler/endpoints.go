@@ -1,9 +1,13 @@
 package handler
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/SawitProRecruitment/UserService/handler/models"
+	"github.com/SawitProRecruitment/UserService/repository"
 	"github.com/SawitProRecruitment/UserService/repository/entity"
 	"github.com/labstack/echo/v4"
 )
@@ -28,7 +32,12 @@ func (server *Server) RegisterUser(c echo.Context) error {
 		})
 	}
 
-	hashedPassword, err := HashPassword(registerRequest.Password, registerRequest.PhoneNumber)
+	ok, err := server.checkPasswordStrength(c, "password", registerRequest.Password)
+	if !ok {
+		return err
+	}
+
+	hashedPassword, err := server.Passwords.HashPassword(registerRequest.Password)
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
 			Message: "Failed to generate hashed password",
@@ -45,6 +54,15 @@ func (server *Server) RegisterUser(c echo.Context) error {
 		})
 	}
 
+	// Every user starts as a farmer, other roles are granted by an admin
+	err = server.Repository.AssignRole(ctx, id, RoleFarmer)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to assign role",
+			Error:   err.Error(),
+		})
+	}
+
 	return c.JSON(http.StatusOK, models.RegisterUserResponse{
 		ID: id,
 	})
@@ -62,6 +80,11 @@ func (server *Server) LoginUser(c echo.Context) error {
 		})
 	}
 
+	ok, err := server.checkLoginLockout(c, LockoutScopeIP, clientIP(c))
+	if !ok {
+		return err
+	}
+
 	user, err := server.Repository.GetUser(ctx, &entity.UserFilter{
 		PhoneNumber: &loginRequest.PhoneNumber,
 	})
@@ -72,22 +95,122 @@ func (server *Server) LoginUser(c echo.Context) error {
 		})
 	}
 	if user == nil {
+		err = server.recordFailedLogin(c, nil)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Message: "Failed to record failed login",
+				Error:   err.Error(),
+			})
+		}
+
 		return c.JSON(http.StatusNotFound, models.ErrorResponse{
 			Message: "User not found",
 		})
 	}
 
+	ok, err = server.checkLoginLockout(c, LockoutScopeAccount, strconv.FormatInt(user.ID, 10))
+	if !ok {
+		return err
+	}
+
 	// Compare password from request and db
-	err = ValidatePassword(loginRequest.Password, user.PhoneNumber, user.Password)
+	err = server.Passwords.ValidatePassword(loginRequest.Password, user.LegacyPasswordSalt, user.Password)
 	if err != nil {
+		recordErr := server.recordFailedLogin(c, user)
+		if recordErr != nil {
+			return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Message: "Failed to record failed login",
+				Error:   recordErr.Error(),
+			})
+		}
+
 		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
 			Message: "Authentication failed",
 			Error:   err.Error(),
 		})
 	}
 
+	err = server.clearLoginFailures(c, user.ID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to clear failed logins",
+			Error:   err.Error(),
+		})
+	}
+
+	if user.DisabledAt != nil {
+		return c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: "User is disabled",
+		})
+	}
+
+	err = server.upgradePasswordHash(ctx, user, loginRequest.Password)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to upgrade password hash",
+			Error:   err.Error(),
+		})
+	}
+
+	return server.loginWithSecondFactor(c, user, LoginMethodPassword)
+}
+
+// loginWithSecondFactor completes the login of a user who proved their first
+// factor with the method, or returns an MFA challenge when they have a second
+// factor.
+func (server *Server) loginWithSecondFactor(c echo.Context, user *entity.UserData, method string) error {
+	ctx := c.Request().Context()
+
+	// Users with a second factor get a challenge instead of tokens
+	totp, err := server.Repository.GetTOTP(ctx, user.ID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get TOTP",
+			Error:   err.Error(),
+		})
+	}
+	if totp != nil && totp.ConfirmedAt != nil {
+		mfaToken, err := server.JWT.GenerateMFAToken(user.ID)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Message: "Failed to generate MFA token",
+				Error:   err.Error(),
+			})
+		}
+
+		return c.JSON(http.StatusOK, models.LoginUserResponse{
+			ID:          user.ID,
+			MFARequired: true,
+			MFAToken:    mfaToken,
+		})
+	}
+
+	return server.completeLogin(c, user, method)
+}
+
+// completeLogin starts a session for a user authenticated with the method and
+// issues their tokens.
+func (server *Server) completeLogin(c echo.Context, user *entity.UserData, method string) error {
+	ctx := c.Request().Context()
+
+	roles, err := server.Repository.GetUserRoles(ctx, user.ID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get user roles",
+			Error:   err.Error(),
+		})
+	}
+
+	session, err := server.startSession(c, user.ID, method)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to start session",
+			Error:   err.Error(),
+		})
+	}
+
 	// Generate JWT token
-	token, err := server.JWT.GenerateToken(user.ID)
+	token, err := server.JWT.GenerateToken(user.ID, roles, session.ID)
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
 			Message: "Failed to generate token",
@@ -104,94 +227,259 @@ func (server *Server) LoginUser(c echo.Context) error {
 		})
 	}
 
+	// The session is the refresh token family of this login
+	refreshToken, err := server.issueRefreshToken(ctx, user.ID, session.ID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to generate refresh token",
+			Error:   err.Error(),
+		})
+	}
+
+	idToken, err := server.JWT.GenerateIDToken(user)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to generate ID token",
+			Error:   err.Error(),
+		})
+	}
+
 	return c.JSON(http.StatusOK, models.LoginUserResponse{
-		ID:    user.ID,
-		Token: token,
+		ID:           user.ID,
+		Token:        token,
+		RefreshToken: refreshToken,
+		IDToken:      idToken,
 	})
 }
 
-func (server *Server) GetUserProfile(c echo.Context) error {
+func (server *Server) RefreshToken(c echo.Context) error {
 	ctx := c.Request().Context()
+	refreshRequest := &models.RefreshTokenRequest{}
 
-	// Extract JWT token from Authorization header
-	headerAuthorization := c.Request().Header.Get("Authorization")
-	if headerAuthorization == "" {
-		return c.JSON(http.StatusForbidden, models.ErrorResponse{
-			Message: "Missing authorization token",
+	err := c.Bind(refreshRequest)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to read request",
+			Error:   err.Error(),
+		})
+	}
+
+	if refreshRequest.RefreshToken == "" {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Missing refresh token",
 		})
 	}
 
-	// Parse JWT to get token claims
-	claims, err := server.JWT.ValidateToken(headerAuthorization)
+	storedToken, err := server.Repository.GetRefreshToken(ctx, HashToken(refreshRequest.RefreshToken))
 	if err != nil {
-		return c.JSON(http.StatusForbidden, models.ErrorResponse{
-			Message: "Failed to validate token",
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get refresh token",
 			Error:   err.Error(),
 		})
 	}
+	if storedToken == nil {
+		return c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: "Invalid refresh token",
+		})
+	}
 
-	// Extract user ID from the token claims
-	userID, ok := claims["user_id"].(float64)
-	if !ok {
+	// A revoked token being presented again means it was leaked, so the whole
+	// family is revoked and the legitimate client has to log in again
+	if storedToken.RevokedAt != nil {
+		return server.revokeReusedRefreshToken(c, storedToken.FamilyID)
+	}
+
+	if time.Now().After(storedToken.ExpiresAt) {
 		return c.JSON(http.StatusForbidden, models.ErrorResponse{
-			Message: "Invalid user ID in token claims",
+			Message: "Refresh token expired",
 		})
 	}
-	id := int64(userID)
 
+	// Refresh tokens issued before the user was disabled are revoked with it,
+	// this also covers the ones issued while it happened
 	user, err := server.Repository.GetUser(ctx, &entity.UserFilter{
-		ID: &id,
+		ID: &storedToken.UserID,
 	})
 	if err != nil {
-		return c.JSON(http.StatusForbidden, models.ErrorResponse{
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
 			Message: "Failed to get user",
 			Error:   err.Error(),
 		})
 	}
-	if user == nil {
-		return c.JSON(http.StatusNotFound, models.ErrorResponse{
-			Message: "User not found",
+	if user == nil || user.DisabledAt != nil {
+		return c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: "User is disabled",
 		})
 	}
 
-	return c.JSON(http.StatusOK, models.GetUserProfileResponse{
-		PhoneNumber: user.PhoneNumber,
-		FullName:    user.FullName,
+	// Rotate the refresh token within the same family
+	newToken, newTokenHash, err := GenerateRefreshToken()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to generate refresh token",
+			Error:   err.Error(),
+		})
+	}
+
+	err = server.Repository.RotateRefreshToken(ctx, storedToken.ID, &entity.RefreshToken{
+		UserID:    storedToken.UserID,
+		FamilyID:  storedToken.FamilyID,
+		TokenHash: newTokenHash,
+		ExpiresAt: time.Now().Add(RefreshTokenTTL),
+	})
+	if errors.Is(err, repository.ErrRefreshTokenRevoked) {
+		return server.revokeReusedRefreshToken(c, storedToken.FamilyID)
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to rotate refresh token",
+			Error:   err.Error(),
+		})
+	}
+
+	// Roles are read again so role changes apply on the next refresh
+	roles, err := server.Repository.GetUserRoles(ctx, storedToken.UserID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get user roles",
+			Error:   err.Error(),
+		})
+	}
+
+	// Sessions are refresh token families, tokens of families started before
+	// sessions were recorded get a session ID that is never listed
+	err = server.Repository.TouchSession(ctx, storedToken.FamilyID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to update session",
+			Error:   err.Error(),
+		})
+	}
+
+	token, err := server.JWT.GenerateToken(storedToken.UserID, roles, storedToken.FamilyID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to generate token",
+			Error:   err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, models.RefreshTokenResponse{
+		Token:        token,
+		RefreshToken: newToken,
 	})
 }
 
-func (server *Server) UpdateUserProfile(c echo.Context) error {
+func (server *Server) revokeReusedRefreshToken(c echo.Context, familyID string) error {
+	err := server.Repository.RevokeRefreshTokenFamily(c.Request().Context(), familyID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to revoke refresh token",
+			Error:   err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusForbidden, models.ErrorResponse{
+		Message: "Refresh token reuse detected",
+	})
+}
+
+func (server *Server) LogoutUser(c echo.Context) error {
 	ctx := c.Request().Context()
+	principal := CurrentPrincipal(c)
 
-	// Extract JWT token from Authorization header
-	headerAuthorization := c.Request().Header.Get("Authorization")
-	if headerAuthorization == "" {
-		return c.JSON(http.StatusForbidden, models.ErrorResponse{
-			Message: "Missing authorization token",
+	logoutRequest := &models.LogoutRequest{}
+
+	err := c.Bind(logoutRequest)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to read request",
+			Error:   err.Error(),
 		})
 	}
 
-	// Parse JWT to get token claims
-	claims, err := server.JWT.ValidateToken(headerAuthorization)
+	// The session ends with the logout, so neither its refresh tokens nor
+	// other access tokens issued for it stay usable
+	if principal.SessionID != "" {
+		err = server.Repository.RevokeRefreshTokenFamily(ctx, principal.SessionID)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Message: "Failed to revoke refresh token",
+				Error:   err.Error(),
+			})
+		}
+
+		err = server.JWT.RevokeSession(ctx, principal.SessionID)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Message: "Failed to revoke session",
+				Error:   err.Error(),
+			})
+		}
+	}
+
+	// Revoke the refresh token family as well when the client sends it, for
+	// tokens issued without a session
+	if logoutRequest.RefreshToken != "" {
+		storedToken, err := server.Repository.GetRefreshToken(ctx, HashToken(logoutRequest.RefreshToken))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Message: "Failed to get refresh token",
+				Error:   err.Error(),
+			})
+		}
+
+		if storedToken != nil && storedToken.UserID == principal.UserID && storedToken.FamilyID != principal.SessionID {
+			err = server.Repository.RevokeRefreshTokenFamily(ctx, storedToken.FamilyID)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+					Message: "Failed to revoke refresh token",
+					Error:   err.Error(),
+				})
+			}
+		}
+	}
+
+	err = server.JWT.RevokeToken(ctx, principal.Claims)
 	if err != nil {
-		return c.JSON(http.StatusForbidden, models.ErrorResponse{
-			Message: "Failed to validate token",
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to revoke token",
 			Error:   err.Error(),
 		})
 	}
 
-	// Extract user ID from the token claims
-	userID, ok := claims["user_id"].(float64)
-	if !ok {
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (server *Server) GetUserProfile(c echo.Context) error {
+	user, err := server.Repository.GetUser(c.Request().Context(), &entity.UserFilter{
+		ID: &CurrentPrincipal(c).UserID,
+	})
+	if err != nil {
 		return c.JSON(http.StatusForbidden, models.ErrorResponse{
-			Message: "Invalid user ID in token claims",
+			Message: "Failed to get user",
+			Error:   err.Error(),
 		})
 	}
-	id := int64(userID)
+	if user == nil {
+		return c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Message: "User not found",
+		})
+	}
+
+	return c.JSON(http.StatusOK, models.GetUserProfileResponse{
+		PhoneNumber:   user.PhoneNumber,
+		PhoneVerified: user.PhoneVerified,
+		FullName:      user.FullName,
+	})
+}
+
+func (server *Server) UpdateUserProfile(c echo.Context) error {
+	ctx := c.Request().Context()
 
 	updateRequest := &models.UpdateUserProfileRequest{}
 
-	err = c.Bind(updateRequest)
+	err := c.Bind(updateRequest)
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
 			Message: "Failed to read request",
@@ -226,7 +514,7 @@ func (server *Server) UpdateUserProfile(c echo.Context) error {
 		}
 	}
 
-	err = server.Repository.UpdateProfile(ctx, id, updateRequest)
+	err = server.Repository.UpdateProfile(ctx, CurrentPrincipal(c).UserID, updateRequest)
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
 			Message: "Failed to update user",
@@ -239,3 +527,67 @@ func (server *Server) UpdateUserProfile(c echo.Context) error {
 		FullName:    updateRequest.FullName,
 	})
 }
+
+// ChangePassword replaces the password of the authenticated user, who has to
+// confirm their current one.
+func (server *Server) ChangePassword(c echo.Context) error {
+	user, ok, err := server.tokenUser(c)
+	if !ok {
+		return err
+	}
+
+	changeRequest := &models.ChangePasswordRequest{}
+
+	err = c.Bind(changeRequest)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to read request",
+			Error:   err.Error(),
+		})
+	}
+
+	errs := changeRequest.Validate()
+	if len(errs) > 0 {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Invalid request",
+			Error:   errs,
+		})
+	}
+
+	ok, err = server.checkPasswordStrength(c, "new_password", changeRequest.NewPassword)
+	if !ok {
+		return err
+	}
+
+	err = server.Passwords.ValidatePassword(changeRequest.CurrentPassword, user.LegacyPasswordSalt, user.Password)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: "Current password is incorrect",
+		})
+	}
+
+	hashedPassword, err := server.Passwords.HashPassword(changeRequest.NewPassword)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to hash password",
+			Error:   err.Error(),
+		})
+	}
+
+	err = server.Repository.UpdatePassword(c.Request().Context(), user.ID, hashedPassword)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to update password",
+			Error:   err.Error(),
+		})
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (server *Server) GetJWKS(c echo.Context) error {
+	// Let verifiers cache the key set, they refetch it when they see an unknown kid
+	c.Response().Header().Set("Cache-Control", "public, max-age=3600")
+
+	return c.JSON(http.StatusOK, server.JWT.JWKS())
+}
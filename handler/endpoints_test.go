@@ -2,26 +2,123 @@ package handler_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/SawitProRecruitment/UserService/handler"
 	"github.com/SawitProRecruitment/UserService/handler/models"
+	"github.com/SawitProRecruitment/UserService/policy"
 	"github.com/SawitProRecruitment/UserService/repository"
+	"github.com/SawitProRecruitment/UserService/repository/entity"
+	"github.com/SawitProRecruitment/UserService/strength"
+	"github.com/SawitProRecruitment/UserService/totp"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	gojwt "github.com/golang-jwt/jwt"
 	"github.com/golang/mock/gomock"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var (
 	TestPhoneNumber = "+621234567890"
 	TestFullName    = "John Doe"
 	TestPassword    = "P@ssword1"
+	TestNewPassword = "N3w-P@ssword"
+	TestIssuer      = "https://auth.example.com"
+	TestAudience    = "user-service"
 )
 
+// TestBreachedPassword passes the request validation but is in the breached
+// password index of newTestPasswordStrength
+const TestBreachedPassword = "Password1!"
+
+// newTestPasswordStrength returns a checker with TestBreachedPassword in its
+// breached password index.
+func newTestPasswordStrength(t *testing.T) *strength.Checker {
+	t.Helper()
+
+	var buf bytes.Buffer
+	require.NoError(t, strength.WriteIndex(&buf, [][sha1.Size]byte{sha1.Sum([]byte(TestBreachedPassword))}))
+
+	index, err := strength.NewIndex(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+
+	return strength.NewChecker(strength.NewCheckerOptions{
+		Index: index,
+	})
+}
+
+// testPasswords hashes with cheap parameters to keep the tests fast
+var testPasswords = handler.NewPasswordHasher(handler.NewPasswordHasherOptions{
+	Params: handler.Argon2Params{
+		Memory:      1024,
+		Iterations:  1,
+		Parallelism: 1,
+		SaltLength:  16,
+		KeyLength:   32,
+	},
+})
+
+// newTestKey returns a freshly generated PEM encoded RSA key pair.
+func newTestKey(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	prvKey := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+
+	pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	pubKey := pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: pubDER,
+	})
+
+	return prvKey, pubKey
+}
+
+// newTestJWT returns a JWT signer backed by a freshly generated RSA key pair.
+func newTestJWT(t *testing.T) handler.JWT {
+	t.Helper()
+
+	prvKey, _ := newTestKey(t)
+
+	jwt, err := handler.NewJWT(handler.NewJWTOptions{
+		Issuer:     TestIssuer,
+		Audience:   TestAudience,
+		PrivateKey: prvKey,
+	})
+	require.NoError(t, err)
+
+	return jwt
+}
+
 func TestRegisterUser(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -46,6 +143,7 @@ func TestRegisterUser(t *testing.T) {
 			expectedResponseBody: &models.RegisterUserResponse{ID: 1},
 			mockRepoExpectation: func() {
 				mockRepo.EXPECT().CreateUser(gomock.Any(), gomock.Any()).Return(int64(1), nil)
+				mockRepo.EXPECT().AssignRole(gomock.Any(), int64(1), handler.RoleFarmer).Return(nil)
 			},
 			success: true,
 		},
@@ -93,6 +191,28 @@ func TestRegisterUser(t *testing.T) {
 			expectedResponseBody: &models.RegisterUserResponse{ID: 0},
 			success:              false,
 		},
+		{
+			name: "Breached Password",
+			request: &models.RegisterUserRequest{
+				PhoneNumber: TestPhoneNumber,
+				FullName:    TestFullName,
+				Password:    TestBreachedPassword,
+			},
+			expectedStatusCode:   http.StatusBadRequest,
+			expectedResponseBody: &models.RegisterUserResponse{ID: 0},
+			success:              false,
+		},
+		{
+			name: "Predictable Password",
+			request: &models.RegisterUserRequest{
+				PhoneNumber: TestPhoneNumber,
+				FullName:    TestFullName,
+				Password:    "Aaaaaa1!",
+			},
+			expectedStatusCode:   http.StatusBadRequest,
+			expectedResponseBody: &models.RegisterUserResponse{ID: 0},
+			success:              false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -109,7 +229,9 @@ func TestRegisterUser(t *testing.T) {
 			}
 
 			server := &handler.Server{
-				Repository: mockRepo,
+				Repository:       mockRepo,
+				Passwords:        testPasswords,
+				PasswordStrength: newTestPasswordStrength(t),
 			}
 
 			err := server.RegisterUser(c)
@@ -247,3 +369,4470 @@ func TestUpdateUserProfile(t *testing.T) {
 		})
 	}
 }
+
+func TestRefreshToken(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := repository.NewMockRepositoryInterface(ctrl)
+
+	revokedAt := time.Now().Add(-time.Minute)
+	user := &entity.UserData{ID: 1}
+	disabledUser := &entity.UserData{ID: 1, DisabledAt: &revokedAt}
+
+	tests := []struct {
+		name                string
+		request             *models.RefreshTokenRequest
+		expectedStatusCode  int
+		mockRepoExpectation func()
+	}{
+		{
+			name:               "Valid Refresh Token",
+			request:            &models.RefreshTokenRequest{RefreshToken: "valid"},
+			expectedStatusCode: http.StatusOK,
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetRefreshToken(gomock.Any(), handler.HashToken("valid")).Return(&entity.RefreshToken{
+					ID:        1,
+					UserID:    1,
+					FamilyID:  "family",
+					ExpiresAt: time.Now().Add(time.Hour),
+				}, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), &entity.UserFilter{ID: &user.ID}).Return(user, nil)
+				mockRepo.EXPECT().RotateRefreshToken(gomock.Any(), int64(1), gomock.Any()).Return(nil)
+				mockRepo.EXPECT().GetUserRoles(gomock.Any(), int64(1)).Return([]string{handler.RoleFarmer}, nil)
+				mockRepo.EXPECT().TouchSession(gomock.Any(), "family").Return(nil)
+			},
+		},
+		{
+			name:               "Missing Refresh Token",
+			request:            &models.RefreshTokenRequest{},
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "Unknown Refresh Token",
+			request:            &models.RefreshTokenRequest{RefreshToken: "unknown"},
+			expectedStatusCode: http.StatusForbidden,
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetRefreshToken(gomock.Any(), gomock.Any()).Return(nil, nil)
+			},
+		},
+		{
+			name:               "Expired Refresh Token",
+			request:            &models.RefreshTokenRequest{RefreshToken: "expired"},
+			expectedStatusCode: http.StatusForbidden,
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetRefreshToken(gomock.Any(), gomock.Any()).Return(&entity.RefreshToken{
+					ID:        1,
+					UserID:    1,
+					FamilyID:  "family",
+					ExpiresAt: time.Now().Add(-time.Hour),
+				}, nil)
+			},
+		},
+		{
+			name:               "Disabled User",
+			request:            &models.RefreshTokenRequest{RefreshToken: "disabled"},
+			expectedStatusCode: http.StatusForbidden,
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetRefreshToken(gomock.Any(), gomock.Any()).Return(&entity.RefreshToken{
+					ID:        1,
+					UserID:    1,
+					FamilyID:  "family",
+					ExpiresAt: time.Now().Add(time.Hour),
+				}, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(disabledUser, nil)
+			},
+		},
+		{
+			name:               "Reused Refresh Token",
+			request:            &models.RefreshTokenRequest{RefreshToken: "reused"},
+			expectedStatusCode: http.StatusForbidden,
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetRefreshToken(gomock.Any(), gomock.Any()).Return(&entity.RefreshToken{
+					ID:        1,
+					UserID:    1,
+					FamilyID:  "family",
+					ExpiresAt: time.Now().Add(time.Hour),
+					RevokedAt: &revokedAt,
+				}, nil)
+				mockRepo.EXPECT().RevokeRefreshTokenFamily(gomock.Any(), "family").Return(nil)
+			},
+		},
+		{
+			name:               "Concurrently Rotated Refresh Token",
+			request:            &models.RefreshTokenRequest{RefreshToken: "raced"},
+			expectedStatusCode: http.StatusForbidden,
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetRefreshToken(gomock.Any(), gomock.Any()).Return(&entity.RefreshToken{
+					ID:        1,
+					UserID:    1,
+					FamilyID:  "family",
+					ExpiresAt: time.Now().Add(time.Hour),
+				}, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), &entity.UserFilter{ID: &user.ID}).Return(user, nil)
+				mockRepo.EXPECT().RotateRefreshToken(gomock.Any(), int64(1), gomock.Any()).Return(repository.ErrRefreshTokenRevoked)
+				mockRepo.EXPECT().RevokeRefreshTokenFamily(gomock.Any(), "family").Return(nil)
+			},
+		},
+	}
+
+	jwt := newTestJWT(t)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			reqBody, _ := json.Marshal(tt.request)
+			req := httptest.NewRequest(http.MethodPost, "/token/refresh", bytes.NewBuffer(reqBody))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			if tt.mockRepoExpectation != nil {
+				tt.mockRepoExpectation()
+			}
+
+			server := &handler.Server{
+				Repository: mockRepo,
+				JWT:        jwt,
+			}
+
+			err := server.RefreshToken(c)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+
+			if tt.expectedStatusCode == http.StatusOK {
+				var actualResponseBody *models.RefreshTokenResponse
+				err = json.Unmarshal(rec.Body.Bytes(), &actualResponseBody)
+				require.NoError(t, err)
+
+				assert.NotEmpty(t, actualResponseBody.Token)
+				assert.NotEmpty(t, actualResponseBody.RefreshToken)
+				assert.NotEqual(t, tt.request.RefreshToken, actualResponseBody.RefreshToken)
+			}
+		})
+	}
+}
+
+func TestLogoutUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := repository.NewMockRepositoryInterface(ctrl)
+
+	jwt := newTestJWT(t)
+
+	tests := []struct {
+		name                string
+		authorization       func() string
+		request             *models.LogoutRequest
+		expectedStatusCode  int
+		mockRepoExpectation func()
+		revokedSessionID    string
+	}{
+		{
+			name: "Valid Request",
+			authorization: func() string {
+				token, err := jwt.GenerateToken(1, nil, "")
+				require.NoError(t, err)
+				return "Bearer " + token
+			},
+			request:            &models.LogoutRequest{},
+			expectedStatusCode: http.StatusNoContent,
+		},
+		{
+			name: "Valid Request With Refresh Token",
+			authorization: func() string {
+				token, err := jwt.GenerateToken(1, nil, "")
+				require.NoError(t, err)
+				return "Bearer " + token
+			},
+			request:            &models.LogoutRequest{RefreshToken: "refresh"},
+			expectedStatusCode: http.StatusNoContent,
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetRefreshToken(gomock.Any(), handler.HashToken("refresh")).Return(&entity.RefreshToken{
+					ID:       1,
+					UserID:   1,
+					FamilyID: "family",
+				}, nil)
+				mockRepo.EXPECT().RevokeRefreshTokenFamily(gomock.Any(), "family").Return(nil)
+			},
+		},
+		{
+			name: "Valid Request With Session",
+			authorization: func() string {
+				token, err := jwt.GenerateToken(1, nil, "session")
+				require.NoError(t, err)
+				return "Bearer " + token
+			},
+			request:            &models.LogoutRequest{},
+			expectedStatusCode: http.StatusNoContent,
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().RevokeRefreshTokenFamily(gomock.Any(), "session").Return(nil)
+			},
+			revokedSessionID: "session",
+		},
+		{
+			name: "Valid Request With Session And Refresh Token",
+			authorization: func() string {
+				token, err := jwt.GenerateToken(1, nil, "other-session")
+				require.NoError(t, err)
+				return "Bearer " + token
+			},
+			request:            &models.LogoutRequest{RefreshToken: "refresh"},
+			expectedStatusCode: http.StatusNoContent,
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().RevokeRefreshTokenFamily(gomock.Any(), "other-session").Return(nil)
+				mockRepo.EXPECT().GetRefreshToken(gomock.Any(), handler.HashToken("refresh")).Return(&entity.RefreshToken{
+					ID:       1,
+					UserID:   1,
+					FamilyID: "other-session",
+				}, nil)
+			},
+			revokedSessionID: "other-session",
+		},
+		{
+			name: "Session Revocation Failure",
+			authorization: func() string {
+				token, err := jwt.GenerateToken(1, nil, "failed-session")
+				require.NoError(t, err)
+				return "Bearer " + token
+			},
+			request:            &models.LogoutRequest{},
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().RevokeRefreshTokenFamily(gomock.Any(), "failed-session").Return(errors.New("db error"))
+			},
+		},
+		{
+			name: "Missing Authorization",
+			authorization: func() string {
+				return ""
+			},
+			request:            &models.LogoutRequest{},
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			authorization := tt.authorization()
+			reqBody, _ := json.Marshal(tt.request)
+			req := httptest.NewRequest(http.MethodPost, "/logout", bytes.NewBuffer(reqBody))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", authorization)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			if tt.mockRepoExpectation != nil {
+				tt.mockRepoExpectation()
+			}
+
+			server := &handler.Server{
+				Repository: mockRepo,
+				JWT:        jwt,
+			}
+
+			err := server.Authenticate(server.LogoutUser)(c)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+
+			// The token must not be accepted anymore after logging out
+			if tt.expectedStatusCode == http.StatusNoContent {
+				_, err = jwt.ValidateToken(req.Context(), authorization)
+				assert.Error(t, err)
+			}
+
+			// Nor any other token of the same session
+			if tt.revokedSessionID != "" {
+				token, err := jwt.GenerateToken(1, nil, tt.revokedSessionID)
+				require.NoError(t, err)
+				_, err = jwt.ValidateToken(req.Context(), "Bearer "+token)
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestGetJWKS(t *testing.T) {
+	oldPrvKey, oldPubKey := newTestKey(t)
+	newPrvKey, _ := newTestKey(t)
+
+	oldJWT, err := handler.NewJWT(handler.NewJWTOptions{
+		Issuer:     TestIssuer,
+		Audience:   TestAudience,
+		PrivateKey: oldPrvKey,
+	})
+	require.NoError(t, err)
+
+	// Rotate to a new signing key while keeping the old one for verification
+	jwt, err := handler.NewJWT(handler.NewJWTOptions{
+		Issuer:            TestIssuer,
+		Audience:          TestAudience,
+		PrivateKey:        newPrvKey,
+		RetiredPublicKeys: [][]byte{oldPubKey},
+	})
+	require.NoError(t, err)
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	server := &handler.Server{
+		JWT: jwt,
+	}
+
+	err = server.GetJWKS(c)
+	require.NoError(t, err)
+
+	var actualResponseBody *models.JWKSResponse
+	err = json.Unmarshal(rec.Body.Bytes(), &actualResponseBody)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Len(t, actualResponseBody.Keys, 2)
+
+	oldToken, err := oldJWT.GenerateToken(1, nil, "")
+	require.NoError(t, err)
+	_, err = jwt.ValidateToken(req.Context(), "Bearer "+oldToken)
+	assert.NoError(t, err, "token signed with a retired key must stay valid")
+
+	newToken, err := jwt.GenerateToken(1, nil, "")
+	require.NoError(t, err)
+	_, err = oldJWT.ValidateToken(req.Context(), "Bearer "+newToken)
+	assert.Error(t, err, "token signed with an unknown key must be rejected")
+}
+
+func TestGetUserinfo(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := repository.NewMockRepositoryInterface(ctrl)
+
+	jwt := newTestJWT(t)
+
+	user := &entity.UserData{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		FullName:    TestFullName,
+	}
+	phoneVerified := false
+
+	tests := []struct {
+		name                 string
+		authorization        func() string
+		expectedStatusCode   int
+		expectedResponseBody interface{}
+		mockRepoExpectation  func()
+	}{
+		{
+			name: "Valid Request",
+			authorization: func() string {
+				token, err := jwt.GenerateToken(1, nil, "")
+				require.NoError(t, err)
+				return "Bearer " + token
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedResponseBody: &models.UserinfoResponse{
+				Sub:                 "1",
+				PhoneNumber:         TestPhoneNumber,
+				PhoneNumberVerified: &phoneVerified,
+				Name:                TestFullName,
+			},
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+			},
+		},
+		{
+			name: "Client Token With openid Scope",
+			authorization: func() string {
+				token, err := jwt.GenerateClientToken(1, "client", "openid")
+				require.NoError(t, err)
+				return "Bearer " + token
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedResponseBody: &models.UserinfoResponse{
+				Sub: "1",
+			},
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil).Times(2)
+			},
+		},
+		{
+			name: "Client Token With profile Scope",
+			authorization: func() string {
+				token, err := jwt.GenerateClientToken(1, "client", "openid profile")
+				require.NoError(t, err)
+				return "Bearer " + token
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedResponseBody: &models.UserinfoResponse{
+				Sub:  "1",
+				Name: TestFullName,
+			},
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil).Times(2)
+			},
+		},
+		{
+			name: "Client Token With phone Scope",
+			authorization: func() string {
+				token, err := jwt.GenerateClientToken(1, "client", "openid phone")
+				require.NoError(t, err)
+				return "Bearer " + token
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedResponseBody: &models.UserinfoResponse{
+				Sub:                 "1",
+				PhoneNumber:         TestPhoneNumber,
+				PhoneNumberVerified: &phoneVerified,
+			},
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil).Times(2)
+			},
+		},
+		{
+			name: "Client Token Of Disabled User",
+			authorization: func() string {
+				token, err := jwt.GenerateClientToken(1, "client", "openid profile")
+				require.NoError(t, err)
+				return "Bearer " + token
+			},
+			expectedStatusCode:   http.StatusForbidden,
+			expectedResponseBody: &models.UserinfoResponse{},
+			mockRepoExpectation: func() {
+				disabledAt := time.Now()
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(&entity.UserData{
+					ID:         1,
+					DisabledAt: &disabledAt,
+				}, nil)
+			},
+		},
+		{
+			name: "Client Token Without openid Scope",
+			authorization: func() string {
+				token, err := jwt.GenerateClientToken(1, "client", "profile")
+				require.NoError(t, err)
+				return "Bearer " + token
+			},
+			expectedStatusCode:   http.StatusForbidden,
+			expectedResponseBody: &models.UserinfoResponse{},
+		},
+		{
+			name: "ID Token Used As Access Token",
+			authorization: func() string {
+				token, err := jwt.GenerateIDToken(&entity.UserData{ID: 1})
+				require.NoError(t, err)
+				return "Bearer " + token
+			},
+			expectedStatusCode:   http.StatusUnauthorized,
+			expectedResponseBody: &models.UserinfoResponse{},
+		},
+		{
+			name: "Missing Authorization",
+			authorization: func() string {
+				return ""
+			},
+			expectedStatusCode:   http.StatusUnauthorized,
+			expectedResponseBody: &models.UserinfoResponse{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+			req.Header.Set("Authorization", tt.authorization())
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			if tt.mockRepoExpectation != nil {
+				tt.mockRepoExpectation()
+			}
+
+			server := &handler.Server{
+				Repository: mockRepo,
+				JWT:        jwt,
+			}
+
+			err := server.RequireScope("openid")(server.GetUserinfo)(c)
+			require.NoError(t, err)
+
+			var actualResponseBody *models.UserinfoResponse
+			err = json.Unmarshal(rec.Body.Bytes(), &actualResponseBody)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+			assert.Equal(t, tt.expectedResponseBody, actualResponseBody)
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := repository.NewMockRepositoryInterface(ctrl)
+
+	client := &entity.OAuthClient{
+		ClientID:     "client",
+		Name:         "Partner App",
+		RedirectURIs: []string{"https://partner.example.com/callback"},
+	}
+
+	tests := []struct {
+		name                string
+		query               string
+		expectedStatusCode  int
+		expectedLocation    string
+		mockRepoExpectation func()
+	}{
+		{
+			name:               "Valid Request",
+			query:              "response_type=code&client_id=client&scope=openid&state=xyz&code_challenge=challenge&code_challenge_method=S256",
+			expectedStatusCode: http.StatusOK,
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetOAuthClient(gomock.Any(), "client").Return(client, nil)
+			},
+		},
+		{
+			name:               "Unknown Client",
+			query:              "response_type=code&client_id=unknown&code_challenge=challenge&code_challenge_method=S256",
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetOAuthClient(gomock.Any(), "unknown").Return(nil, nil)
+			},
+		},
+		{
+			name:               "Unregistered Redirect URI",
+			query:              "response_type=code&client_id=client&redirect_uri=https://evil.example.com&code_challenge=challenge&code_challenge_method=S256",
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetOAuthClient(gomock.Any(), "client").Return(client, nil)
+			},
+		},
+		{
+			name:               "Missing Code Challenge",
+			query:              "response_type=code&client_id=client&state=xyz",
+			expectedStatusCode: http.StatusFound,
+			expectedLocation:   "https://partner.example.com/callback?error=invalid_request&error_description=A+S256+code+challenge+is+required&state=xyz",
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetOAuthClient(gomock.Any(), "client").Return(client, nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/authorize?"+tt.query, nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			tt.mockRepoExpectation()
+
+			server := &handler.Server{
+				Repository: mockRepo,
+			}
+
+			err := server.Authorize(c)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+			assert.Equal(t, tt.expectedLocation, rec.Header().Get("Location"))
+		})
+	}
+}
+
+func TestAuthorizeSecondFactor(t *testing.T) {
+	secret, err := totp.GenerateSecret()
+	require.NoError(t, err)
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	require.NoError(t, err)
+
+	hashedPassword, err := testPasswords.HashPassword(TestPassword)
+	require.NoError(t, err)
+
+	confirmedAt := time.Now()
+	user := &entity.UserData{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		Password:    hashedPassword,
+	}
+	enrolled := &entity.TOTP{
+		UserID:      user.ID,
+		Secret:      secret,
+		ConfirmedAt: &confirmedAt,
+	}
+	client := &entity.OAuthClient{
+		ClientID:     "client",
+		Name:         "Partner App",
+		RedirectURIs: []string{"https://partner.example.com/callback"},
+	}
+
+	// Every case gets as far as a correct password
+	passwordChecked := func(mockRepo *repository.MockRepositoryInterface) {
+		mockRepo.EXPECT().GetOAuthClient(gomock.Any(), "client").Return(client, nil)
+		mockRepo.EXPECT().GetLoginFailures(gomock.Any(), handler.LockoutScopeIP, "192.0.2.1").Return(nil, nil)
+		mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+		mockRepo.EXPECT().GetLoginFailures(gomock.Any(), handler.LockoutScopeAccount, "1").Return(nil, nil)
+		mockRepo.EXPECT().GetTOTP(gomock.Any(), user.ID).Return(enrolled, nil)
+	}
+
+	tests := []struct {
+		name               string
+		code               string
+		recoveryCode       string
+		expectedStatusCode int
+		mockRepository     func(mockRepo *repository.MockRepositoryInterface)
+	}{
+		{
+			name:               "Missing Code",
+			expectedStatusCode: http.StatusUnauthorized,
+			mockRepository:     passwordChecked,
+		},
+		{
+			name:               "Wrong Code",
+			code:               "000000",
+			expectedStatusCode: http.StatusForbidden,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				passwordChecked(mockRepo)
+				mockRepo.EXPECT().RecordLoginFailure(gomock.Any(), handler.LockoutScopeIP, "192.0.2.1", gomock.Any()).Return(1, nil)
+				mockRepo.EXPECT().RecordLoginFailure(gomock.Any(), handler.LockoutScopeAccount, "1", gomock.Any()).Return(1, nil)
+			},
+		},
+		{
+			name:               "Wrong Recovery Code",
+			recoveryCode:       "aaaaaaaa-aaaaaaaa",
+			expectedStatusCode: http.StatusForbidden,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				passwordChecked(mockRepo)
+				mockRepo.EXPECT().ConsumeRecoveryCode(gomock.Any(), user.ID, gomock.Any()).Return(false, nil)
+				mockRepo.EXPECT().RecordLoginFailure(gomock.Any(), handler.LockoutScopeIP, "192.0.2.1", gomock.Any()).Return(1, nil)
+				mockRepo.EXPECT().RecordLoginFailure(gomock.Any(), handler.LockoutScopeAccount, "1", gomock.Any()).Return(1, nil)
+			},
+		},
+		{
+			name:               "Valid Code",
+			code:               code,
+			expectedStatusCode: http.StatusFound,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				passwordChecked(mockRepo)
+				mockRepo.EXPECT().UseTOTPStep(gomock.Any(), user.ID, gomock.Any()).Return(nil)
+				mockRepo.EXPECT().ClearLoginFailures(gomock.Any(), handler.LockoutScopeAccount, "1").Return(nil)
+				mockRepo.EXPECT().CreateAuthorizationCode(gomock.Any(), gomock.Any()).Return(nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockRepo := repository.NewMockRepositoryInterface(ctrl)
+			tt.mockRepository(mockRepo)
+
+			server := handler.NewServer(handler.NewServerOptions{
+				Repository: mockRepo,
+				Passwords:  testPasswords,
+				JWT:        newTestJWT(t),
+			})
+
+			e := echo.New()
+			server.RegisterHandlers(e)
+
+			form := url.Values{
+				"response_type":         {"code"},
+				"client_id":             {"client"},
+				"scope":                 {"openid"},
+				"state":                 {"xyz"},
+				"code_challenge":        {"challenge"},
+				"code_challenge_method": {"S256"},
+				"phone_number":          {TestPhoneNumber},
+				"password":              {TestPassword},
+				"code":                  {tt.code},
+				"recovery_code":         {tt.recoveryCode},
+				"decision":              {"allow"},
+			}
+			req := httptest.NewRequest(http.MethodPost, "/authorize", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+
+			// The authorization code is only issued after the second factor
+			location, err := url.Parse(rec.Header().Get("Location"))
+			require.NoError(t, err)
+			assert.Equal(t, rec.Code == http.StatusFound, location.Query().Get("code") != "")
+		})
+	}
+}
+
+func TestCreateOAuthClient(t *testing.T) {
+	jwt := newTestJWT(t)
+
+	adminToken, err := jwt.GenerateToken(1, []string{handler.RoleAdmin}, "")
+	require.NoError(t, err)
+	farmerToken, err := jwt.GenerateToken(2, []string{handler.RoleFarmer}, "")
+	require.NoError(t, err)
+
+	request := models.CreateOAuthClientRequest{
+		Name:         "Partner",
+		RedirectURIs: []string{"https://partner.example.com/callback"},
+		Confidential: true,
+		Scopes:       []string{"openid"},
+	}
+
+	tests := []struct {
+		name               string
+		authorization      string
+		expectedStatusCode int
+		mockRepository     func(mockRepo *repository.MockRepositoryInterface)
+	}{
+		{
+			name:               "Admin",
+			authorization:      "Bearer " + adminToken,
+			expectedStatusCode: http.StatusOK,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().CreateOAuthClient(gomock.Any(), gomock.Any()).DoAndReturn(
+					func(ctx context.Context, client *entity.OAuthClient) error {
+						// The client is recorded as created by the admin of the token
+						assert.Equal(t, int64(1), client.CreatedBy)
+						assert.NotEmpty(t, client.ClientSecretHash)
+						return nil
+					})
+			},
+		},
+		{
+			name:               "Not An Admin",
+			authorization:      "Bearer " + farmerToken,
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "Missing Authorization",
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockRepo := repository.NewMockRepositoryInterface(ctrl)
+			if tt.mockRepository != nil {
+				tt.mockRepository(mockRepo)
+			}
+
+			server := handler.NewServer(handler.NewServerOptions{
+				Repository: mockRepo,
+				JWT:        jwt,
+			})
+
+			e := echo.New()
+			server.RegisterHandlers(e)
+
+			body, err := json.Marshal(request)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/oauth/clients", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+
+			if rec.Code == http.StatusOK {
+				var response models.CreateOAuthClientResponse
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				assert.NotEmpty(t, response.ClientID)
+				assert.NotEmpty(t, response.ClientSecret)
+			}
+		})
+	}
+}
+
+func TestClientIDTokenClaims(t *testing.T) {
+	jwt := newTestJWT(t)
+
+	user := &entity.UserData{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		FullName:    TestFullName,
+	}
+
+	tests := []struct {
+		scope          string
+		expectedClaims []string
+		missingClaims  []string
+	}{
+		{
+			scope:         "openid",
+			missingClaims: []string{"name", "phone_number", "phone_number_verified"},
+		},
+		{
+			scope:          "openid profile",
+			expectedClaims: []string{"name"},
+			missingClaims:  []string{"phone_number", "phone_number_verified"},
+		},
+		{
+			scope:          "openid phone",
+			expectedClaims: []string{"phone_number", "phone_number_verified"},
+			missingClaims:  []string{"name"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.scope, func(t *testing.T) {
+			idToken, err := jwt.GenerateClientIDToken(user, "client", tt.scope)
+			require.NoError(t, err)
+
+			claims := gojwt.MapClaims{}
+			_, _, err = new(gojwt.Parser).ParseUnverified(idToken, claims)
+			require.NoError(t, err)
+
+			assert.Equal(t, "1", claims["sub"])
+			for _, claim := range tt.expectedClaims {
+				assert.Contains(t, claims, claim)
+			}
+			for _, claim := range tt.missingClaims {
+				assert.NotContains(t, claims, claim)
+			}
+		})
+	}
+}
+
+func TestTokenAuthorizationCode(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := repository.NewMockRepositoryInterface(ctrl)
+
+	jwt := newTestJWT(t)
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	client := &entity.OAuthClient{
+		ClientID:     "client",
+		RedirectURIs: []string{"https://partner.example.com/callback"},
+	}
+
+	code := &entity.AuthorizationCode{
+		ClientID:      "client",
+		UserID:        1,
+		RedirectURI:   "https://partner.example.com/callback",
+		Scope:         "profile",
+		CodeChallenge: challenge,
+	}
+
+	tests := []struct {
+		name                string
+		form                string
+		expectedStatusCode  int
+		mockRepoExpectation func()
+	}{
+		{
+			name:               "Valid Request",
+			form:               "grant_type=authorization_code&code=code&client_id=client&redirect_uri=https://partner.example.com/callback&code_verifier=" + verifier,
+			expectedStatusCode: http.StatusOK,
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetOAuthClient(gomock.Any(), "client").Return(client, nil)
+				mockRepo.EXPECT().ConsumeAuthorizationCode(gomock.Any(), handler.HashToken("code")).Return(code, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(&entity.UserData{ID: code.UserID}, nil)
+			},
+		},
+		{
+			// A code issued before the user was disabled
+			name:               "Disabled User",
+			form:               "grant_type=authorization_code&code=code&client_id=client&redirect_uri=https://partner.example.com/callback&code_verifier=" + verifier,
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepoExpectation: func() {
+				disabledAt := time.Now()
+				mockRepo.EXPECT().GetOAuthClient(gomock.Any(), "client").Return(client, nil)
+				mockRepo.EXPECT().ConsumeAuthorizationCode(gomock.Any(), handler.HashToken("code")).Return(code, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(&entity.UserData{ID: code.UserID, DisabledAt: &disabledAt}, nil)
+			},
+		},
+		{
+			name:               "Wrong Code Verifier",
+			form:               "grant_type=authorization_code&code=code&client_id=client&redirect_uri=https://partner.example.com/callback&code_verifier=" + challenge,
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetOAuthClient(gomock.Any(), "client").Return(client, nil)
+				mockRepo.EXPECT().ConsumeAuthorizationCode(gomock.Any(), handler.HashToken("code")).Return(code, nil)
+			},
+		},
+		{
+			name:               "Used Code",
+			form:               "grant_type=authorization_code&code=used&client_id=client&redirect_uri=https://partner.example.com/callback&code_verifier=" + verifier,
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetOAuthClient(gomock.Any(), "client").Return(client, nil)
+				mockRepo.EXPECT().ConsumeAuthorizationCode(gomock.Any(), handler.HashToken("used")).Return(nil, nil)
+			},
+		},
+		{
+			name:               "Public Client With Secret",
+			form:               "grant_type=authorization_code&code=code&client_id=client&client_secret=secret&redirect_uri=https://partner.example.com/callback&code_verifier=" + verifier,
+			expectedStatusCode: http.StatusUnauthorized,
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetOAuthClient(gomock.Any(), "client").Return(client, nil)
+			},
+		},
+		{
+			name:               "Unsupported Grant Type",
+			form:               "grant_type=password",
+			expectedStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodPost, "/token", bytes.NewBufferString(tt.form))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			if tt.mockRepoExpectation != nil {
+				tt.mockRepoExpectation()
+			}
+
+			server := &handler.Server{
+				Repository: mockRepo,
+				JWT:        jwt,
+			}
+
+			err := server.Token(c)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+
+			if tt.expectedStatusCode == http.StatusOK {
+				var actualResponseBody *models.OAuthTokenResponse
+				err = json.Unmarshal(rec.Body.Bytes(), &actualResponseBody)
+				require.NoError(t, err)
+
+				claims, err := jwt.ValidateToken(req.Context(), "Bearer "+actualResponseBody.AccessToken)
+				require.NoError(t, err)
+				assert.Equal(t, "client", claims.ClientID)
+				assert.Equal(t, "profile", claims.Scope)
+			}
+		})
+	}
+}
+
+func TestTokenClientCredentials(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := repository.NewMockRepositoryInterface(ctrl)
+
+	jwt := newTestJWT(t)
+
+	clientSecretHash, err := handler.HashClientSecret("secret")
+	require.NoError(t, err)
+
+	client := &entity.OAuthClient{
+		ClientID:         "job",
+		ClientSecretHash: clientSecretHash,
+		Scopes:           []string{"users:read", "users:write"},
+	}
+
+	tests := []struct {
+		name                string
+		form                string
+		basicAuth           bool
+		expectedStatusCode  int
+		expectedScope       string
+		mockRepoExpectation func()
+	}{
+		{
+			name:               "Valid Request With Basic Authentication",
+			form:               "grant_type=client_credentials&scope=users:read",
+			basicAuth:          true,
+			expectedStatusCode: http.StatusOK,
+			expectedScope:      "users:read",
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetOAuthClient(gomock.Any(), "job").Return(client, nil)
+			},
+		},
+		{
+			name:               "Valid Request With Form Credentials",
+			form:               "grant_type=client_credentials&client_id=job&client_secret=secret",
+			expectedStatusCode: http.StatusOK,
+			expectedScope:      "users:read users:write",
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetOAuthClient(gomock.Any(), "job").Return(client, nil)
+			},
+		},
+		{
+			name:               "Wrong Client Secret",
+			form:               "grant_type=client_credentials&client_id=job&client_secret=wrong",
+			expectedStatusCode: http.StatusUnauthorized,
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetOAuthClient(gomock.Any(), "job").Return(client, nil)
+			},
+		},
+		{
+			name:               "Scope Not Allowed",
+			form:               "grant_type=client_credentials&client_id=job&client_secret=secret&scope=admin",
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetOAuthClient(gomock.Any(), "job").Return(client, nil)
+			},
+		},
+		{
+			name:               "Public Client",
+			form:               "grant_type=client_credentials&client_id=public",
+			expectedStatusCode: http.StatusUnauthorized,
+			mockRepoExpectation: func() {
+				mockRepo.EXPECT().GetOAuthClient(gomock.Any(), "public").Return(&entity.OAuthClient{ClientID: "public"}, nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodPost, "/token", bytes.NewBufferString(tt.form))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.basicAuth {
+				req.SetBasicAuth("job", "secret")
+			}
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			tt.mockRepoExpectation()
+
+			server := &handler.Server{
+				Repository: mockRepo,
+				JWT:        jwt,
+			}
+
+			err := server.Token(c)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+
+			if tt.expectedStatusCode == http.StatusOK {
+				var actualResponseBody *models.OAuthTokenResponse
+				err = json.Unmarshal(rec.Body.Bytes(), &actualResponseBody)
+				require.NoError(t, err)
+				assert.Equal(t, tt.expectedScope, actualResponseBody.Scope)
+
+				claims, err := jwt.ValidateToken(req.Context(), "Bearer "+actualResponseBody.AccessToken)
+				require.NoError(t, err)
+				assert.Equal(t, "job", claims.Subject)
+				_, err = claims.UserID()
+				assert.Error(t, err)
+				assert.Equal(t, strings.Fields(tt.expectedScope), claims.Scopes())
+			}
+		})
+	}
+}
+
+func TestIntrospect(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := repository.NewMockRepositoryInterface(ctrl)
+
+	jwt := newTestJWT(t)
+
+	clientSecretHash, err := handler.HashClientSecret("secret")
+	require.NoError(t, err)
+
+	gateway := &entity.OAuthClient{
+		ClientID:         "gateway",
+		ClientSecretHash: clientSecretHash,
+	}
+
+	userToken, err := jwt.GenerateToken(1, nil, "")
+	require.NoError(t, err)
+
+	serviceToken, err := jwt.GenerateServiceToken("job", "users:read")
+	require.NoError(t, err)
+
+	revokedToken, err := jwt.GenerateToken(1, nil, "")
+	require.NoError(t, err)
+	revokedClaims, err := jwt.ParseToken(context.Background(), revokedToken)
+	require.NoError(t, err)
+	require.NoError(t, jwt.RevokeToken(context.Background(), revokedClaims))
+
+	tests := []struct {
+		name               string
+		token              string
+		clientSecret       string
+		expectedStatusCode int
+		expectedActive     bool
+		expectedSub        string
+		expectedScope      string
+		mockRepository     func(mockRepo *repository.MockRepositoryInterface)
+	}{
+		{
+			name:               "Active User Token",
+			token:              userToken,
+			clientSecret:       "secret",
+			expectedStatusCode: http.StatusOK,
+			expectedActive:     true,
+			expectedSub:        "1",
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(&entity.UserData{ID: 1}, nil)
+			},
+		},
+		{
+			name:               "Disabled User Token",
+			token:              userToken,
+			clientSecret:       "secret",
+			expectedStatusCode: http.StatusOK,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				disabledAt := time.Now()
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(&entity.UserData{ID: 1, DisabledAt: &disabledAt}, nil)
+			},
+		},
+		{
+			name:               "Active Service Token",
+			token:              serviceToken,
+			clientSecret:       "secret",
+			expectedStatusCode: http.StatusOK,
+			expectedActive:     true,
+			expectedSub:        "job",
+			expectedScope:      "users:read",
+		},
+		{
+			name:               "Revoked Token",
+			token:              revokedToken,
+			clientSecret:       "secret",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Malformed Token",
+			token:              "malformed",
+			clientSecret:       "secret",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Wrong Client Secret",
+			token:              userToken,
+			clientSecret:       "wrong",
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			form := url.Values{"token": {tt.token}}
+			req := httptest.NewRequest(http.MethodPost, "/introspect", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.SetBasicAuth("gateway", tt.clientSecret)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			mockRepo.EXPECT().GetOAuthClient(gomock.Any(), "gateway").Return(gateway, nil)
+			if tt.mockRepository != nil {
+				tt.mockRepository(mockRepo)
+			}
+
+			server := &handler.Server{
+				Repository: mockRepo,
+				JWT:        jwt,
+			}
+
+			err := server.Introspect(c)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+
+			if tt.expectedStatusCode == http.StatusOK {
+				var actualResponseBody *models.IntrospectionResponse
+				err = json.Unmarshal(rec.Body.Bytes(), &actualResponseBody)
+				require.NoError(t, err)
+
+				assert.Equal(t, tt.expectedActive, actualResponseBody.Active)
+				assert.Equal(t, tt.expectedSub, actualResponseBody.Sub)
+				assert.Equal(t, tt.expectedScope, actualResponseBody.Scope)
+			}
+		})
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	jwt := newTestJWT(t)
+
+	tests := []struct {
+		name               string
+		roles              []string
+		expectedStatusCode int
+	}{
+		{
+			name:               "Required Role",
+			roles:              []string{handler.RoleFarmer, handler.RoleAdmin},
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Missing Role",
+			roles:              []string{handler.RoleFarmer},
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "No Roles",
+			expectedStatusCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &handler.Server{
+				JWT: jwt,
+			}
+
+			e := echo.New()
+			e.GET("/admin", func(c echo.Context) error {
+				return c.NoContent(http.StatusOK)
+			}, server.RequireRole(handler.RoleAdmin))
+
+			token, err := jwt.GenerateToken(1, tt.roles, "")
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+		})
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	jwt := newTestJWT(t)
+
+	evaluator, err := policy.Load("../policy.yml")
+	require.NoError(t, err)
+
+	admin := &entity.UserData{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		FullName:    TestFullName,
+	}
+
+	tests := []struct {
+		name               string
+		query              string
+		roles              []string
+		expectedStatusCode int
+		mockRepository     func(mockRepo *repository.MockRepositoryInterface)
+	}{
+		{
+			name:               "Valid",
+			query:              "phone_prefix=%2B62&name=john&created_from=2024-01-01&created_to=2024-01-31&page=2&per_page=10",
+			roles:              []string{handler.RoleAdmin},
+			expectedStatusCode: http.StatusOK,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(admin, nil)
+				mockRepo.EXPECT().ListUsers(gomock.Any(), gomock.Any(), 10, 10).DoAndReturn(
+					func(ctx context.Context, filter *entity.UserFilter, limit, offset int) ([]*entity.UserData, int64, error) {
+						assert.Equal(t, "+62", *filter.PhoneNumberPrefix)
+						assert.Equal(t, "john", *filter.FullNameContains)
+						assert.Equal(t, "2024-01-01", filter.CreatedFrom.Format(models.DateLayout))
+						assert.Equal(t, "2024-02-01", filter.CreatedTo.Format(models.DateLayout))
+						return []*entity.UserData{admin}, 11, nil
+					})
+			},
+		},
+		{
+			name:               "Invalid Date",
+			query:              "created_from=01-01-2024",
+			roles:              []string{handler.RoleAdmin},
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepository:     func(mockRepo *repository.MockRepositoryInterface) {},
+		},
+		{
+			name:               "Per Page Too Large",
+			query:              "per_page=1000",
+			roles:              []string{handler.RoleAdmin},
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepository:     func(mockRepo *repository.MockRepositoryInterface) {},
+		},
+		{
+			name:               "Not Admin",
+			roles:              []string{handler.RoleEstateManager},
+			expectedStatusCode: http.StatusForbidden,
+			mockRepository:     func(mockRepo *repository.MockRepositoryInterface) {},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockRepo := repository.NewMockRepositoryInterface(ctrl)
+			tt.mockRepository(mockRepo)
+
+			server := handler.NewServer(handler.NewServerOptions{
+				Repository: mockRepo,
+				JWT:        jwt,
+				Policy:     evaluator,
+			})
+
+			e := echo.New()
+			server.RegisterHandlers(e)
+
+			token, err := jwt.GenerateToken(admin.ID, tt.roles, "")
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/admin/users?"+tt.query, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+
+			if rec.Code == http.StatusOK {
+				var response models.ListUsersResponse
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				assert.Equal(t, 2, response.Page)
+				assert.Equal(t, 10, response.PerPage)
+				assert.Equal(t, int64(11), response.Total)
+				assert.Len(t, response.Users, 1)
+			}
+		})
+	}
+}
+
+func TestDisableUser(t *testing.T) {
+	evaluator, err := policy.Load("../policy.yml")
+	require.NoError(t, err)
+
+	admin := &entity.UserData{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		FullName:    TestFullName,
+	}
+	farmer := &entity.UserData{
+		ID:          2,
+		PhoneNumber: "+629876543210",
+		FullName:    TestFullName,
+	}
+
+	tests := []struct {
+		name               string
+		userID             string
+		expectedStatusCode int
+		expectedLoggedOut  bool
+		mockRepository     func(mockRepo *repository.MockRepositoryInterface)
+	}{
+		{
+			name:               "Valid",
+			userID:             "2",
+			expectedStatusCode: http.StatusOK,
+			expectedLoggedOut:  true,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(admin, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(farmer, nil)
+				mockRepo.EXPECT().SetUserDisabled(gomock.Any(), farmer.ID, true).Return(nil)
+				mockRepo.EXPECT().ListActiveSessions(gomock.Any(), farmer.ID).Return([]*entity.Session{{ID: "farmer-session", UserID: farmer.ID}}, nil)
+				mockRepo.EXPECT().RevokeUserRefreshTokens(gomock.Any(), farmer.ID).Return(nil)
+			},
+		},
+		{
+			name:               "Self",
+			userID:             "1",
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(admin, nil).Times(2)
+			},
+		},
+		{
+			name:               "User Not Found",
+			userID:             "3",
+			expectedStatusCode: http.StatusNotFound,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(admin, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(nil, nil)
+			},
+		},
+		{
+			name:               "Invalid User ID",
+			userID:             "abc",
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepository:     func(mockRepo *repository.MockRepositoryInterface) {},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockRepo := repository.NewMockRepositoryInterface(ctrl)
+			tt.mockRepository(mockRepo)
+
+			// A fresh revocation store per case, since disabling revokes sessions
+			jwt := newTestJWT(t)
+
+			server := handler.NewServer(handler.NewServerOptions{
+				Repository: mockRepo,
+				JWT:        jwt,
+				Policy:     evaluator,
+			})
+
+			e := echo.New()
+			server.RegisterHandlers(e)
+
+			token, err := jwt.GenerateToken(admin.ID, []string{handler.RoleAdmin}, "")
+			require.NoError(t, err)
+			farmerToken, err := jwt.GenerateToken(farmer.ID, nil, "farmer-session")
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/admin/users/"+tt.userID+"/disable", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+
+			// The access tokens of a disabled user stop working right away
+			_, err = jwt.ValidateToken(context.Background(), "Bearer "+farmerToken)
+			assert.Equal(t, tt.expectedLoggedOut, err != nil)
+		})
+	}
+}
+
+func TestGetAdminUser(t *testing.T) {
+	jwt := newTestJWT(t)
+
+	evaluator, err := policy.Load("../policy.yml")
+	require.NoError(t, err)
+
+	estateID := int64(10)
+	admin := &entity.UserData{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		FullName:    TestFullName,
+	}
+	farmer := &entity.UserData{
+		ID:          2,
+		PhoneNumber: "+629876543210",
+		FullName:    TestFullName,
+		EstateID:    &estateID,
+	}
+
+	tests := []struct {
+		name               string
+		userID             string
+		roles              []string
+		expectedStatusCode int
+		mockRepository     func(mockRepo *repository.MockRepositoryInterface)
+	}{
+		{
+			name:               "Valid",
+			userID:             "2",
+			roles:              []string{handler.RoleAdmin},
+			expectedStatusCode: http.StatusOK,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(admin, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(farmer, nil)
+				mockRepo.EXPECT().GetUserRoles(gomock.Any(), farmer.ID).Return([]string{handler.RoleFarmer}, nil)
+			},
+		},
+		{
+			name:               "User Not Found",
+			userID:             "3",
+			roles:              []string{handler.RoleAdmin},
+			expectedStatusCode: http.StatusNotFound,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(admin, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(nil, nil)
+			},
+		},
+		{
+			name:               "Invalid User ID",
+			userID:             "abc",
+			roles:              []string{handler.RoleAdmin},
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepository:     func(mockRepo *repository.MockRepositoryInterface) {},
+		},
+		{
+			name:               "Not Admin",
+			userID:             "2",
+			roles:              []string{handler.RoleEstateManager},
+			expectedStatusCode: http.StatusForbidden,
+			mockRepository:     func(mockRepo *repository.MockRepositoryInterface) {},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockRepo := repository.NewMockRepositoryInterface(ctrl)
+			tt.mockRepository(mockRepo)
+
+			server := handler.NewServer(handler.NewServerOptions{
+				Repository: mockRepo,
+				JWT:        jwt,
+				Policy:     evaluator,
+			})
+
+			e := echo.New()
+			server.RegisterHandlers(e)
+
+			token, err := jwt.GenerateToken(admin.ID, tt.roles, "")
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/admin/users/"+tt.userID, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+
+			if rec.Code == http.StatusOK {
+				var response models.AdminUserResponse
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				assert.Equal(t, farmer.ID, response.ID)
+				assert.Equal(t, &estateID, response.EstateID)
+				assert.Equal(t, []string{handler.RoleFarmer}, response.Roles)
+				assert.False(t, response.Disabled)
+			}
+		})
+	}
+}
+
+func TestEnableUser(t *testing.T) {
+	jwt := newTestJWT(t)
+
+	evaluator, err := policy.Load("../policy.yml")
+	require.NoError(t, err)
+
+	admin := &entity.UserData{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		FullName:    TestFullName,
+	}
+	disabledAt := time.Now().Add(-time.Hour)
+	farmer := &entity.UserData{
+		ID:          2,
+		PhoneNumber: "+629876543210",
+		FullName:    TestFullName,
+		DisabledAt:  &disabledAt,
+	}
+
+	tests := []struct {
+		name               string
+		userID             string
+		expectedStatusCode int
+		mockRepository     func(mockRepo *repository.MockRepositoryInterface)
+	}{
+		{
+			name:               "Valid",
+			userID:             "2",
+			expectedStatusCode: http.StatusOK,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(admin, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(farmer, nil)
+				mockRepo.EXPECT().SetUserDisabled(gomock.Any(), farmer.ID, false).Return(nil)
+			},
+		},
+		{
+			name:               "User Not Found",
+			userID:             "3",
+			expectedStatusCode: http.StatusNotFound,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(admin, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(nil, nil)
+			},
+		},
+		{
+			name:               "Invalid User ID",
+			userID:             "abc",
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepository:     func(mockRepo *repository.MockRepositoryInterface) {},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockRepo := repository.NewMockRepositoryInterface(ctrl)
+			tt.mockRepository(mockRepo)
+
+			server := handler.NewServer(handler.NewServerOptions{
+				Repository: mockRepo,
+				JWT:        jwt,
+				Policy:     evaluator,
+			})
+
+			e := echo.New()
+			server.RegisterHandlers(e)
+
+			token, err := jwt.GenerateToken(admin.ID, []string{handler.RoleAdmin}, "")
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/admin/users/"+tt.userID+"/enable", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+
+			if rec.Code == http.StatusOK {
+				var response models.AdminUserResponse
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				assert.False(t, response.Disabled)
+			}
+		})
+	}
+}
+
+func TestDisableThenEnableUser(t *testing.T) {
+	jwt := newTestJWT(t)
+
+	evaluator, err := policy.Load("../policy.yml")
+	require.NoError(t, err)
+
+	admin := &entity.UserData{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		FullName:    TestFullName,
+	}
+	farmer := &entity.UserData{
+		ID:          2,
+		PhoneNumber: "+629876543210",
+		FullName:    TestFullName,
+	}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockRepo := repository.NewMockRepositoryInterface(ctrl)
+	gomock.InOrder(
+		mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(admin, nil),
+		mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(farmer, nil),
+		mockRepo.EXPECT().SetUserDisabled(gomock.Any(), farmer.ID, true).Return(nil),
+		mockRepo.EXPECT().ListActiveSessions(gomock.Any(), farmer.ID).Return([]*entity.Session{{ID: "farmer-session", UserID: farmer.ID}}, nil),
+		mockRepo.EXPECT().RevokeUserRefreshTokens(gomock.Any(), farmer.ID).Return(nil),
+		mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(admin, nil),
+		mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(farmer, nil),
+		mockRepo.EXPECT().SetUserDisabled(gomock.Any(), farmer.ID, false).Return(nil),
+	)
+
+	server := handler.NewServer(handler.NewServerOptions{
+		Repository: mockRepo,
+		JWT:        jwt,
+		Policy:     evaluator,
+	})
+
+	e := echo.New()
+	server.RegisterHandlers(e)
+
+	token, err := jwt.GenerateToken(admin.ID, []string{handler.RoleAdmin}, "")
+	require.NoError(t, err)
+	farmerToken, err := jwt.GenerateToken(farmer.ID, nil, "farmer-session")
+	require.NoError(t, err)
+
+	for _, action := range []string{"disable", "enable"} {
+		req := httptest.NewRequest(http.MethodPost, "/admin/users/2/"+action, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		require.Equal(t, http.StatusOK, rec.Code, action)
+	}
+
+	// Enabling does not bring back the tokens revoked when the user was
+	// disabled, the user has to log in again
+	_, err = jwt.ValidateToken(context.Background(), "Bearer "+farmerToken)
+	assert.Error(t, err)
+
+	newToken, err := jwt.GenerateToken(farmer.ID, nil, "new-farmer-session")
+	require.NoError(t, err)
+	_, err = jwt.ValidateToken(context.Background(), "Bearer "+newToken)
+	assert.NoError(t, err)
+}
+
+func TestUserRoles(t *testing.T) {
+	jwt := newTestJWT(t)
+
+	evaluator, err := policy.Load("../policy.yml")
+	require.NoError(t, err)
+
+	estateID := int64(10)
+	otherEstateID := int64(11)
+
+	admin := &entity.UserData{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		FullName:    TestFullName,
+	}
+	manager := &entity.UserData{
+		ID:          2,
+		PhoneNumber: "+629876543210",
+		FullName:    TestFullName,
+		EstateID:    &estateID,
+	}
+	farmer := &entity.UserData{
+		ID:          3,
+		PhoneNumber: "+629876543211",
+		FullName:    TestFullName,
+		EstateID:    &estateID,
+	}
+	otherFarmer := &entity.UserData{
+		ID:          4,
+		PhoneNumber: "+629876543212",
+		FullName:    TestFullName,
+		EstateID:    &otherEstateID,
+	}
+
+	tests := []struct {
+		name               string
+		method             string
+		path               string
+		body               string
+		actor              *entity.UserData
+		roles              []string
+		expectedStatusCode int
+		mockRepository     func(mockRepo *repository.MockRepositoryInterface)
+	}{
+		{
+			name:               "Admin Assigns",
+			method:             http.MethodPost,
+			path:               "/admin/users/4/roles",
+			body:               `{"role": "estate_manager"}`,
+			actor:              admin,
+			roles:              []string{handler.RoleAdmin},
+			expectedStatusCode: http.StatusOK,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(admin, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(otherFarmer, nil)
+				mockRepo.EXPECT().AssignRole(gomock.Any(), otherFarmer.ID, handler.RoleEstateManager).Return(nil)
+				mockRepo.EXPECT().GetUserRoles(gomock.Any(), otherFarmer.ID).Return([]string{handler.RoleFarmer, handler.RoleEstateManager}, nil)
+			},
+		},
+		{
+			name:               "Estate Manager Assigns Farmer In Same Estate",
+			method:             http.MethodPost,
+			path:               "/admin/users/3/roles",
+			body:               `{"role": "farmer"}`,
+			actor:              manager,
+			roles:              []string{handler.RoleEstateManager},
+			expectedStatusCode: http.StatusOK,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(manager, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(farmer, nil)
+				mockRepo.EXPECT().AssignRole(gomock.Any(), farmer.ID, handler.RoleFarmer).Return(nil)
+				mockRepo.EXPECT().GetUserRoles(gomock.Any(), farmer.ID).Return([]string{handler.RoleFarmer}, nil)
+			},
+		},
+		{
+			name:               "Estate Manager Removes Farmer In Same Estate",
+			method:             http.MethodDelete,
+			path:               "/admin/users/3/roles/farmer",
+			actor:              manager,
+			roles:              []string{handler.RoleEstateManager},
+			expectedStatusCode: http.StatusOK,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(manager, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(farmer, nil)
+				mockRepo.EXPECT().RemoveRole(gomock.Any(), farmer.ID, handler.RoleFarmer).Return(nil)
+				mockRepo.EXPECT().GetUserRoles(gomock.Any(), farmer.ID).Return(nil, nil)
+			},
+		},
+		{
+			name:               "Estate Manager Assigns In Another Estate",
+			method:             http.MethodPost,
+			path:               "/admin/users/4/roles",
+			body:               `{"role": "farmer"}`,
+			actor:              manager,
+			roles:              []string{handler.RoleEstateManager},
+			expectedStatusCode: http.StatusForbidden,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(manager, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(otherFarmer, nil)
+			},
+		},
+		{
+			name:               "Estate Manager Removes In Another Estate",
+			method:             http.MethodDelete,
+			path:               "/admin/users/4/roles/farmer",
+			actor:              manager,
+			roles:              []string{handler.RoleEstateManager},
+			expectedStatusCode: http.StatusForbidden,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(manager, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(otherFarmer, nil)
+			},
+		},
+		{
+			name:               "Estate Manager Assigns Other Role",
+			method:             http.MethodPost,
+			path:               "/admin/users/3/roles",
+			body:               `{"role": "estate_manager"}`,
+			actor:              manager,
+			roles:              []string{handler.RoleEstateManager},
+			expectedStatusCode: http.StatusForbidden,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(manager, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(farmer, nil)
+			},
+		},
+		{
+			name:               "Estate Manager Removes Other Role",
+			method:             http.MethodDelete,
+			path:               "/admin/users/3/roles/admin",
+			actor:              manager,
+			roles:              []string{handler.RoleEstateManager},
+			expectedStatusCode: http.StatusForbidden,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(manager, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(farmer, nil)
+			},
+		},
+		{
+			name:               "Unknown Role",
+			method:             http.MethodPost,
+			path:               "/admin/users/3/roles",
+			body:               `{"role": "owner"}`,
+			actor:              admin,
+			roles:              []string{handler.RoleAdmin},
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepository:     func(mockRepo *repository.MockRepositoryInterface) {},
+		},
+		{
+			name:               "User Not Found",
+			method:             http.MethodPost,
+			path:               "/admin/users/5/roles",
+			body:               `{"role": "farmer"}`,
+			actor:              admin,
+			roles:              []string{handler.RoleAdmin},
+			expectedStatusCode: http.StatusNotFound,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(admin, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(nil, nil)
+			},
+		},
+		{
+			name:               "Farmer",
+			method:             http.MethodPost,
+			path:               "/admin/users/3/roles",
+			body:               `{"role": "farmer"}`,
+			actor:              farmer,
+			roles:              []string{handler.RoleFarmer},
+			expectedStatusCode: http.StatusForbidden,
+			mockRepository:     func(mockRepo *repository.MockRepositoryInterface) {},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockRepo := repository.NewMockRepositoryInterface(ctrl)
+			tt.mockRepository(mockRepo)
+
+			server := handler.NewServer(handler.NewServerOptions{
+				Repository: mockRepo,
+				JWT:        jwt,
+				Policy:     evaluator,
+			})
+
+			e := echo.New()
+			server.RegisterHandlers(e)
+
+			token, err := jwt.GenerateToken(tt.actor.ID, tt.roles, "")
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+
+			if rec.Code == http.StatusOK {
+				var response models.UserRolesResponse
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				assert.NotNil(t, response.Roles)
+			}
+		})
+	}
+}
+
+func TestEnrollTOTP(t *testing.T) {
+	jwt := newTestJWT(t)
+
+	user := &entity.UserData{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		FullName:    TestFullName,
+	}
+	confirmedAt := time.Now()
+
+	tests := []struct {
+		name               string
+		expectedStatusCode int
+		mockRepository     func(mockRepo *repository.MockRepositoryInterface)
+	}{
+		{
+			name:               "Valid",
+			expectedStatusCode: http.StatusOK,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().GetTOTP(gomock.Any(), user.ID).Return(nil, nil)
+				mockRepo.EXPECT().SetTOTPSecret(gomock.Any(), user.ID, gomock.Any()).Return(nil)
+			},
+		},
+		{
+			// Enrolling again replaces a secret that was never confirmed
+			name:               "Pending Enrollment",
+			expectedStatusCode: http.StatusOK,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().GetTOTP(gomock.Any(), user.ID).Return(&entity.TOTP{UserID: user.ID, Secret: "pending"}, nil)
+				mockRepo.EXPECT().SetTOTPSecret(gomock.Any(), user.ID, gomock.Any()).Return(nil)
+			},
+		},
+		{
+			name:               "Already Enabled",
+			expectedStatusCode: http.StatusConflict,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().GetTOTP(gomock.Any(), user.ID).Return(&entity.TOTP{UserID: user.ID, Secret: "enabled", ConfirmedAt: &confirmedAt}, nil)
+			},
+		},
+		{
+			name:               "User Not Found",
+			expectedStatusCode: http.StatusNotFound,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(nil, nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockRepo := repository.NewMockRepositoryInterface(ctrl)
+			tt.mockRepository(mockRepo)
+
+			server := handler.NewServer(handler.NewServerOptions{
+				Repository: mockRepo,
+				JWT:        jwt,
+			})
+
+			e := echo.New()
+			server.RegisterHandlers(e)
+
+			token, err := jwt.GenerateToken(user.ID, nil, "")
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/mfa/totp/enroll", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+
+			if rec.Code == http.StatusOK {
+				var response models.TOTPEnrollResponse
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				assert.NotEmpty(t, response.Secret)
+				assert.Contains(t, response.URI, response.Secret)
+			}
+		})
+	}
+}
+
+func TestConfirmTOTP(t *testing.T) {
+	jwt := newTestJWT(t)
+
+	secret, err := totp.GenerateSecret()
+	require.NoError(t, err)
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	require.NoError(t, err)
+
+	// A code from an hour ago, which no longer verifies
+	wrongCode, err := totp.Code(secret, totp.Step(time.Now().Add(-time.Hour)))
+	require.NoError(t, err)
+	if _, valid := totp.Verify(secret, wrongCode, time.Now()); valid {
+		t.Skip("the old code happens to match a current one")
+	}
+
+	confirmedAt := time.Now()
+	pending := &entity.TOTP{
+		UserID: 1,
+		Secret: secret,
+	}
+	enabled := &entity.TOTP{
+		UserID:      1,
+		Secret:      secret,
+		ConfirmedAt: &confirmedAt,
+	}
+
+	tests := []struct {
+		name               string
+		code               string
+		expectedStatusCode int
+		mockRepository     func(mockRepo *repository.MockRepositoryInterface)
+	}{
+		{
+			name:               "Valid",
+			code:               code,
+			expectedStatusCode: http.StatusOK,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetTOTP(gomock.Any(), pending.UserID).Return(pending, nil)
+				mockRepo.EXPECT().ConfirmTOTP(gomock.Any(), pending.UserID, totp.Step(time.Now()), gomock.Len(handler.RecoveryCodeCount)).Return(nil)
+			},
+		},
+		{
+			name:               "Wrong Code",
+			code:               wrongCode,
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetTOTP(gomock.Any(), pending.UserID).Return(pending, nil)
+			},
+		},
+		{
+			name:               "Already Enabled",
+			code:               code,
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetTOTP(gomock.Any(), enabled.UserID).Return(enabled, nil)
+			},
+		},
+		{
+			name:               "Not Enrolled",
+			code:               code,
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetTOTP(gomock.Any(), pending.UserID).Return(nil, nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockRepo := repository.NewMockRepositoryInterface(ctrl)
+			tt.mockRepository(mockRepo)
+
+			server := handler.NewServer(handler.NewServerOptions{
+				Repository: mockRepo,
+				JWT:        jwt,
+			})
+
+			e := echo.New()
+			server.RegisterHandlers(e)
+
+			token, err := jwt.GenerateToken(pending.UserID, nil, "")
+			require.NoError(t, err)
+
+			body, err := json.Marshal(models.TOTPConfirmRequest{Code: tt.code})
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/mfa/totp/confirm", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+
+			if rec.Code == http.StatusOK {
+				var response models.TOTPConfirmResponse
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				assert.Len(t, response.RecoveryCodes, handler.RecoveryCodeCount)
+			}
+		})
+	}
+}
+
+func TestRecoveryCodesAreSingleUse(t *testing.T) {
+	jwt := newTestJWT(t)
+
+	secret, err := totp.GenerateSecret()
+	require.NoError(t, err)
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	require.NoError(t, err)
+
+	user := &entity.UserData{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		FullName:    TestFullName,
+	}
+	enrollment := &entity.TOTP{
+		UserID: user.ID,
+		Secret: secret,
+	}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// The repository keeps the hashes of the recovery codes not used yet
+	unused := map[string]bool{}
+
+	mockRepo := repository.NewMockRepositoryInterface(ctrl)
+	mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil).AnyTimes()
+	mockRepo.EXPECT().GetTOTP(gomock.Any(), user.ID).Return(enrollment, nil).AnyTimes()
+	mockRepo.EXPECT().ConfirmTOTP(gomock.Any(), user.ID, gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, userID int64, step int64, recoveryCodeHashes []string) error {
+			for _, hash := range recoveryCodeHashes {
+				unused[hash] = true
+			}
+			confirmedAt := time.Now()
+			enrollment.ConfirmedAt = &confirmedAt
+			return nil
+		})
+	mockRepo.EXPECT().ConsumeRecoveryCode(gomock.Any(), user.ID, gomock.Any()).DoAndReturn(
+		func(ctx context.Context, userID int64, codeHash string) (bool, error) {
+			used := unused[codeHash]
+			delete(unused, codeHash)
+			return used, nil
+		}).Times(2)
+	mockRepo.EXPECT().GetLoginFailures(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+	mockRepo.EXPECT().RecordLoginFailure(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(1, nil).AnyTimes()
+	mockRepo.EXPECT().ClearLoginFailures(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	mockRepo.EXPECT().GetUserRoles(gomock.Any(), user.ID).Return(nil, nil)
+	mockRepo.EXPECT().CreateSession(gomock.Any(), gomock.Any()).Return(nil)
+	mockRepo.EXPECT().IncLogin(gomock.Any(), user.ID).Return(nil)
+	mockRepo.EXPECT().CreateRefreshToken(gomock.Any(), gomock.Any()).Return(nil)
+
+	server := handler.NewServer(handler.NewServerOptions{
+		Repository: mockRepo,
+		JWT:        jwt,
+	})
+
+	e := echo.New()
+	server.RegisterHandlers(e)
+
+	token, err := jwt.GenerateToken(user.ID, nil, "")
+	require.NoError(t, err)
+
+	body, err := json.Marshal(models.TOTPConfirmRequest{Code: code})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/mfa/totp/confirm", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var confirmResponse models.TOTPConfirmResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &confirmResponse))
+	require.Len(t, confirmResponse.RecoveryCodes, handler.RecoveryCodeCount)
+	require.Len(t, unused, handler.RecoveryCodeCount)
+
+	// The same recovery code completes a login once, typed in upper case the
+	// first time, and is refused the second time
+	recoveryCode := confirmResponse.RecoveryCodes[0]
+	for i, expectedStatusCode := range []int{http.StatusOK, http.StatusForbidden} {
+		mfaToken, err := jwt.GenerateMFAToken(user.ID)
+		require.NoError(t, err)
+
+		typed := recoveryCode
+		if i == 0 {
+			typed = strings.ToUpper(recoveryCode)
+		}
+
+		body, err := json.Marshal(models.MFALoginRequest{MFAToken: mfaToken, RecoveryCode: typed})
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/login/mfa", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		assert.Equal(t, expectedStatusCode, rec.Code)
+	}
+
+	assert.Len(t, unused, handler.RecoveryCodeCount-1)
+}
+
+func TestLoginMFA(t *testing.T) {
+	prvKey, _ := newTestKey(t)
+
+	secret, err := totp.GenerateSecret()
+	require.NoError(t, err)
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	require.NoError(t, err)
+
+	confirmedAt := time.Now()
+	user := &entity.UserData{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		FullName:    TestFullName,
+	}
+	enrolled := &entity.TOTP{
+		UserID:      user.ID,
+		Secret:      secret,
+		ConfirmedAt: &confirmedAt,
+	}
+
+	completeLogin := func(mockRepo *repository.MockRepositoryInterface, method string) {
+		mockRepo.EXPECT().GetUserRoles(gomock.Any(), user.ID).Return([]string{handler.RoleFarmer}, nil)
+		mockRepo.EXPECT().CreateSession(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(ctx context.Context, session *entity.Session) error {
+				assert.Equal(t, method, session.Method)
+				return nil
+			})
+		mockRepo.EXPECT().IncLogin(gomock.Any(), user.ID).Return(nil)
+		mockRepo.EXPECT().CreateRefreshToken(gomock.Any(), gomock.Any()).Return(nil)
+	}
+
+	// Wrong codes are counted against the MFA token
+	wrongCode := func(mockRepo *repository.MockRepositoryInterface, failedAttempts int) {
+		mockRepo.EXPECT().RecordLoginFailure(gomock.Any(), handler.LockoutScopeMFAToken, gomock.Any(), gomock.Any()).Return(failedAttempts, nil)
+	}
+
+	tests := []struct {
+		name               string
+		request            models.MFALoginRequest
+		useAccessToken     bool
+		expectedStatusCode int
+		expectedRevoked    bool
+		mockRepository     func(mockRepo *repository.MockRepositoryInterface)
+	}{
+		{
+			name:               "Valid Code",
+			request:            models.MFALoginRequest{Code: code},
+			expectedStatusCode: http.StatusOK,
+			expectedRevoked:    true,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().GetTOTP(gomock.Any(), user.ID).Return(enrolled, nil)
+				mockRepo.EXPECT().UseTOTPStep(gomock.Any(), user.ID, totp.Step(time.Now())).Return(nil)
+				completeLogin(mockRepo, handler.LoginMethodTOTP)
+			},
+		},
+		{
+			name:               "Valid Recovery Code",
+			request:            models.MFALoginRequest{RecoveryCode: "ABCDEFGH-IJKLMNOP"},
+			expectedStatusCode: http.StatusOK,
+			expectedRevoked:    true,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().GetTOTP(gomock.Any(), user.ID).Return(enrolled, nil)
+				mockRepo.EXPECT().ConsumeRecoveryCode(gomock.Any(), user.ID, handler.HashRecoveryCode("abcdefghijklmnop")).Return(true, nil)
+				completeLogin(mockRepo, handler.LoginMethodRecoveryCode)
+			},
+		},
+		{
+			name:               "Code Already Used",
+			request:            models.MFALoginRequest{Code: code},
+			expectedStatusCode: http.StatusForbidden,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().GetTOTP(gomock.Any(), user.ID).Return(enrolled, nil)
+				mockRepo.EXPECT().UseTOTPStep(gomock.Any(), user.ID, gomock.Any()).Return(repository.ErrTOTPCodeUsed)
+				wrongCode(mockRepo, 1)
+			},
+		},
+		{
+			name:               "Wrong Code",
+			request:            models.MFALoginRequest{Code: "000000"},
+			expectedStatusCode: http.StatusForbidden,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().GetTOTP(gomock.Any(), user.ID).Return(enrolled, nil)
+				wrongCode(mockRepo, handler.MFAMaxAttempts-1)
+			},
+		},
+		{
+			name:               "Too Many Wrong Codes",
+			request:            models.MFALoginRequest{Code: "000000"},
+			expectedStatusCode: http.StatusForbidden,
+			expectedRevoked:    true,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().GetTOTP(gomock.Any(), user.ID).Return(enrolled, nil)
+				wrongCode(mockRepo, handler.MFAMaxAttempts)
+			},
+		},
+		{
+			name:               "Invalid Recovery Code",
+			request:            models.MFALoginRequest{RecoveryCode: "unknown"},
+			expectedStatusCode: http.StatusForbidden,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().GetTOTP(gomock.Any(), user.ID).Return(enrolled, nil)
+				mockRepo.EXPECT().ConsumeRecoveryCode(gomock.Any(), user.ID, gomock.Any()).Return(false, nil)
+				wrongCode(mockRepo, 1)
+			},
+		},
+		{
+			name:               "Access Token Instead Of MFA Token",
+			request:            models.MFALoginRequest{Code: code},
+			useAccessToken:     true,
+			expectedStatusCode: http.StatusForbidden,
+			mockRepository:     func(mockRepo *repository.MockRepositoryInterface) {},
+		},
+		{
+			name:               "Missing Code",
+			request:            models.MFALoginRequest{},
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepository:     func(mockRepo *repository.MockRepositoryInterface) {},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockRepo := repository.NewMockRepositoryInterface(ctrl)
+			tt.mockRepository(mockRepo)
+
+			// A fresh revocation store per case, since a successful login revokes the challenge token
+			jwt, err := handler.NewJWT(handler.NewJWTOptions{
+				Issuer:     TestIssuer,
+				Audience:   TestAudience,
+				PrivateKey: prvKey,
+			})
+			require.NoError(t, err)
+
+			tt.request.MFAToken, err = jwt.GenerateMFAToken(user.ID)
+			if tt.useAccessToken {
+				tt.request.MFAToken, err = jwt.GenerateToken(user.ID, nil, "")
+			}
+			require.NoError(t, err)
+
+			server := &handler.Server{
+				Repository: mockRepo,
+				JWT:        jwt,
+			}
+
+			body, err := json.Marshal(tt.request)
+			require.NoError(t, err)
+
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodPost, "/login/mfa", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			err = server.LoginMFA(c)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+
+			if !tt.useAccessToken {
+				_, _, err = jwt.ParseMFAToken(context.Background(), tt.request.MFAToken)
+				assert.Equal(t, tt.expectedRevoked, err != nil)
+			}
+
+			if rec.Code == http.StatusOK {
+				var response models.LoginUserResponse
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				assert.NotEmpty(t, response.Token)
+				assert.False(t, response.MFARequired)
+			}
+		})
+	}
+}
+
+func TestMFATokenIsNotAnAccessToken(t *testing.T) {
+	jwt := newTestJWT(t)
+
+	mfaToken, err := jwt.GenerateMFAToken(1)
+	require.NoError(t, err)
+
+	_, err = jwt.ValidateToken(context.Background(), "Bearer "+mfaToken)
+	assert.Error(t, err)
+}
+
+func TestRevocationOutlastsClockSkew(t *testing.T) {
+	prvKey, _ := newTestKey(t)
+	clockSkew := time.Minute
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	revocations := repository.NewMockRevocationStoreInterface(ctrl)
+	revocations.EXPECT().IsRevoked(gomock.Any(), gomock.Any()).Return(false, nil).AnyTimes()
+
+	jwt, err := handler.NewJWT(handler.NewJWTOptions{
+		Issuer:      TestIssuer,
+		Audience:    TestAudience,
+		PrivateKey:  prvKey,
+		ClockSkew:   clockSkew,
+		Revocations: revocations,
+	})
+	require.NoError(t, err)
+
+	token, err := jwt.GenerateToken(1, nil, "session")
+	require.NoError(t, err)
+	claims, err := jwt.ValidateToken(context.Background(), "Bearer "+token)
+	require.NoError(t, err)
+
+	// Tokens are accepted until exp plus the clock skew, so the revocations
+	// have to last that long too
+	revocations.EXPECT().Revoke(gomock.Any(), claims.Id, time.Unix(claims.ExpiresAt, 0).Add(clockSkew)).Return(nil)
+	require.NoError(t, jwt.RevokeToken(context.Background(), claims))
+
+	revocations.EXPECT().Revoke(gomock.Any(), "session:session", gomock.Any()).DoAndReturn(
+		func(ctx context.Context, jti string, expiresAt time.Time) error {
+			assert.WithinDuration(t, time.Now().Add(handler.AccessTokenTTL+clockSkew), expiresAt, time.Second)
+			return nil
+		})
+	require.NoError(t, jwt.RevokeSession(context.Background(), "session"))
+}
+
+func TestNewJWT(t *testing.T) {
+	prvKey, _ := newTestKey(t)
+
+	tests := []struct {
+		name          string
+		opts          handler.NewJWTOptions
+		expectedError bool
+	}{
+		{
+			name: "Valid",
+			opts: handler.NewJWTOptions{Issuer: TestIssuer, Audience: TestAudience, PrivateKey: prvKey},
+		},
+		{
+			name:          "Missing Issuer",
+			opts:          handler.NewJWTOptions{Audience: TestAudience, PrivateKey: prvKey},
+			expectedError: true,
+		},
+		{
+			name:          "Missing Audience",
+			opts:          handler.NewJWTOptions{Issuer: TestIssuer, PrivateKey: prvKey},
+			expectedError: true,
+		},
+		{
+			name:          "Invalid Private Key",
+			opts:          handler.NewJWTOptions{Issuer: TestIssuer, Audience: TestAudience, PrivateKey: []byte("invalid")},
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := handler.NewJWT(tt.opts)
+			assert.Equal(t, tt.expectedError, err != nil)
+		})
+	}
+}
+
+func TestValidateTokenClaims(t *testing.T) {
+	prvKey, _ := newTestKey(t)
+
+	jwt, err := handler.NewJWT(handler.NewJWTOptions{
+		Issuer:        TestIssuer,
+		Audience:      TestAudience,
+		TokenAudience: "user-service",
+		ClockSkew:     time.Minute,
+		PrivateKey:    prvKey,
+	})
+	require.NoError(t, err)
+
+	signingKey, err := gojwt.ParseRSAPrivateKeyFromPEM(prvKey)
+	require.NoError(t, err)
+
+	now := time.Now()
+
+	tests := []struct {
+		name          string
+		claims        func(claims *handler.Claims)
+		expectedError bool
+	}{
+		{
+			name:   "Valid",
+			claims: func(claims *handler.Claims) {},
+		},
+		{
+			name: "Unexpected Issuer",
+			claims: func(claims *handler.Claims) {
+				claims.Issuer = "https://evil.example.com"
+			},
+			expectedError: true,
+		},
+		{
+			name: "Unexpected Audience",
+			claims: func(claims *handler.Claims) {
+				claims.Audience = "other-service"
+			},
+			expectedError: true,
+		},
+		{
+			name: "Missing Audience",
+			claims: func(claims *handler.Claims) {
+				claims.Audience = ""
+			},
+			expectedError: true,
+		},
+		{
+			name: "Missing Expiry",
+			claims: func(claims *handler.Claims) {
+				claims.ExpiresAt = 0
+			},
+			expectedError: true,
+		},
+		{
+			name: "Expired Within Clock Skew",
+			claims: func(claims *handler.Claims) {
+				claims.ExpiresAt = now.Add(-30 * time.Second).Unix()
+			},
+		},
+		{
+			name: "Expired",
+			claims: func(claims *handler.Claims) {
+				claims.ExpiresAt = now.Add(-2 * time.Minute).Unix()
+			},
+			expectedError: true,
+		},
+		{
+			name: "Not Valid Yet Within Clock Skew",
+			claims: func(claims *handler.Claims) {
+				claims.NotBefore = now.Add(30 * time.Second).Unix()
+				claims.IssuedAt = claims.NotBefore
+			},
+		},
+		{
+			name: "Not Valid Yet",
+			claims: func(claims *handler.Claims) {
+				claims.NotBefore = now.Add(2 * time.Minute).Unix()
+			},
+			expectedError: true,
+		},
+		{
+			name: "Issued In The Future",
+			claims: func(claims *handler.Claims) {
+				claims.IssuedAt = now.Add(2 * time.Minute).Unix()
+			},
+			expectedError: true,
+		},
+		{
+			name: "Missing Token ID",
+			claims: func(claims *handler.Claims) {
+				claims.Id = ""
+			},
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := &handler.Claims{
+				StandardClaims: gojwt.StandardClaims{
+					Issuer:    "https://auth.example.com",
+					Subject:   "1",
+					Audience:  "user-service",
+					Id:        "token",
+					ExpiresAt: now.Add(time.Minute).Unix(),
+					NotBefore: now.Unix(),
+					IssuedAt:  now.Unix(),
+				},
+			}
+			tt.claims(claims)
+
+			token, err := gojwt.NewWithClaims(gojwt.SigningMethodRS256, claims).SignedString(signingKey)
+			require.NoError(t, err)
+
+			validated, err := jwt.ValidateToken(context.Background(), "Bearer "+token)
+			if tt.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			userID, err := validated.UserID()
+			require.NoError(t, err)
+			assert.Equal(t, int64(1), userID)
+		})
+	}
+
+	// Tokens issued by the service carry the configured issuer and audience
+	token, err := jwt.GenerateToken(1, nil, "session")
+	require.NoError(t, err)
+
+	claims, err := jwt.ValidateToken(context.Background(), "Bearer "+token)
+	require.NoError(t, err)
+	assert.Equal(t, "https://auth.example.com", claims.Issuer)
+	assert.Equal(t, "user-service", claims.Audience)
+	assert.Equal(t, "1", claims.Subject)
+	assert.Equal(t, "session", claims.SessionID)
+	assert.NotEmpty(t, claims.Id)
+	assert.NotZero(t, claims.NotBefore)
+}
+
+// testAuthenticator is a software WebAuthn authenticator creating a single
+// ES256 passkey with "none" attestation.
+type testAuthenticator struct {
+	t            *testing.T
+	rpID         string
+	origin       string
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newTestAuthenticator(t *testing.T, rpID, origin string) *testAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	credentialID := make([]byte, 16)
+	_, err = rand.Read(credentialID)
+	require.NoError(t, err)
+
+	return &testAuthenticator{
+		t:            t,
+		rpID:         rpID,
+		origin:       origin,
+		key:          key,
+		credentialID: credentialID,
+	}
+}
+
+func (a *testAuthenticator) clientData(ceremony string, challenge protocol.URLEncodedBase64) []byte {
+	clientData, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    a.origin,
+	})
+	require.NoError(a.t, err)
+
+	return clientData
+}
+
+func (a *testAuthenticator) authData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+
+	authData := append([]byte{}, rpIDHash[:]...)
+	authData = append(authData, flags)
+
+	return binary.BigEndian.AppendUint32(authData, a.signCount)
+}
+
+// create answers navigator.credentials.create()
+func (a *testAuthenticator) create(options *protocol.CredentialCreation) json.RawMessage {
+	// The user handle was decoded from JSON into a plain string
+	userHandle, err := base64.RawURLEncoding.DecodeString(options.Response.User.ID.(string))
+	require.NoError(a.t, err)
+	a.userHandle = userHandle
+
+	publicKey, err := cbor.Marshal(map[int]interface{}{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+		-3: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	require.NoError(a.t, err)
+
+	// User present, user verified and attested credential data included
+	authData := a.authData(0x01 | 0x04 | 0x40)
+	authData = append(authData, make([]byte, 16)...)
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credentialID)))
+	authData = append(authData, a.credentialID...)
+	authData = append(authData, publicKey...)
+
+	attestationObject, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	require.NoError(a.t, err)
+
+	credential, err := json.Marshal(map[string]interface{}{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(a.clientData("webauthn.create", options.Response.Challenge)),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestationObject),
+		},
+	})
+	require.NoError(a.t, err)
+
+	return credential
+}
+
+// get answers navigator.credentials.get()
+func (a *testAuthenticator) get(options *protocol.CredentialAssertion) json.RawMessage {
+	a.signCount++
+
+	// User present and user verified
+	authData := a.authData(0x01 | 0x04)
+	clientData := a.clientData("webauthn.get", options.Response.Challenge)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	require.NoError(a.t, err)
+
+	credential, err := json.Marshal(map[string]interface{}{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+		},
+	})
+	require.NoError(a.t, err)
+
+	return credential
+}
+
+func TestWebAuthn(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockRepo := repository.NewMockRepositoryInterface(ctrl)
+	jwt := newTestJWT(t)
+
+	webAuthn, err := webauthn.New(&webauthn.Config{
+		RPID:          "example.com",
+		RPDisplayName: handler.ServiceName,
+		RPOrigins:     []string{"https://example.com"},
+	})
+	require.NoError(t, err)
+
+	server := handler.NewServer(handler.NewServerOptions{
+		Repository: mockRepo,
+		JWT:        jwt,
+		WebAuthn:   webAuthn,
+	})
+
+	e := echo.New()
+	server.RegisterHandlers(e)
+
+	call := func(path string, accessToken string, request interface{}, response interface{}) int {
+		body, err := json.Marshal(request)
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if accessToken != "" {
+			req.Header.Set("Authorization", "Bearer "+accessToken)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		if response != nil && rec.Code < http.StatusBadRequest {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), response))
+		}
+
+		return rec.Code
+	}
+
+	user := &entity.UserData{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		FullName:    TestFullName,
+	}
+	authenticator := newTestAuthenticator(t, "example.com", "https://example.com")
+
+	accessToken, err := jwt.GenerateToken(user.ID, nil, "")
+	require.NoError(t, err)
+
+	// Registration
+	var stored *entity.WebAuthnCredential
+	mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil).Times(2)
+	mockRepo.EXPECT().ListWebAuthnCredentials(gomock.Any(), user.ID).Return(nil, nil).Times(2)
+	mockRepo.EXPECT().CreateWebAuthnCredential(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, credential *entity.WebAuthnCredential) error {
+			credential.ID = 1
+			stored = credential
+			return nil
+		})
+
+	var registration models.WebAuthnRegistrationOptionsResponse
+	code := call("/webauthn/register/begin", accessToken, nil, &registration)
+	require.Equal(t, http.StatusOK, code)
+
+	code = call("/webauthn/register/finish", accessToken, models.WebAuthnFinishRequest{
+		SessionToken: registration.SessionToken,
+		Credential:   authenticator.create(registration.Options),
+	}, nil)
+	require.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, user.ID, stored.UserID)
+	assert.Equal(t, authenticator.credentialID, stored.CredentialID)
+
+	// A registration session cannot be used to log in
+	code = call("/webauthn/login/finish", "", models.WebAuthnFinishRequest{
+		SessionToken: registration.SessionToken,
+		Credential:   json.RawMessage(`{}`),
+	}, nil)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// Login
+	mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+	mockRepo.EXPECT().ListWebAuthnCredentials(gomock.Any(), user.ID).DoAndReturn(
+		func(ctx context.Context, userID int64) ([]*entity.WebAuthnCredential, error) {
+			return []*entity.WebAuthnCredential{stored}, nil
+		})
+	mockRepo.EXPECT().UpdateWebAuthnCredentialSignCount(gomock.Any(), authenticator.credentialID, uint32(1)).Return(nil)
+	mockRepo.EXPECT().GetUserRoles(gomock.Any(), user.ID).Return([]string{handler.RoleFarmer}, nil)
+	mockRepo.EXPECT().CreateSession(gomock.Any(), gomock.Any()).Return(nil)
+	mockRepo.EXPECT().IncLogin(gomock.Any(), user.ID).Return(nil)
+	mockRepo.EXPECT().CreateRefreshToken(gomock.Any(), gomock.Any()).Return(nil)
+
+	var login models.WebAuthnLoginOptionsResponse
+	code = call("/webauthn/login/begin", "", nil, &login)
+	require.Equal(t, http.StatusOK, code)
+
+	credential := authenticator.get(login.Options)
+
+	var loginResponse models.LoginUserResponse
+	code = call("/webauthn/login/finish", "", models.WebAuthnFinishRequest{
+		SessionToken: login.SessionToken,
+		Credential:   credential,
+	}, &loginResponse)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, user.ID, loginResponse.ID)
+
+	claims, err := jwt.ValidateToken(context.Background(), "Bearer "+loginResponse.Token)
+	require.NoError(t, err)
+	userID, err := claims.UserID()
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, userID)
+
+	// The login session can only be used once
+	code = call("/webauthn/login/finish", "", models.WebAuthnFinishRequest{
+		SessionToken: login.SessionToken,
+		Credential:   credential,
+	}, nil)
+	assert.Equal(t, http.StatusForbidden, code)
+}
+
+func TestPhoneVerification(t *testing.T) {
+	jwt := newTestJWT(t)
+
+	user := &entity.UserData{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		FullName:    TestFullName,
+	}
+	verifiedUser := &entity.UserData{
+		ID:            1,
+		PhoneNumber:   TestPhoneNumber,
+		PhoneVerified: true,
+		FullName:      TestFullName,
+	}
+
+	codeHash, err := bcrypt.GenerateFromPassword([]byte("123456"), bcrypt.MinCost)
+	require.NoError(t, err)
+	otp := &entity.OTP{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		Purpose:     handler.OTPPurposePhoneVerification,
+		CodeHash:    string(codeHash),
+		ExpiresAt:   time.Now().Add(handler.OTPTTL),
+	}
+	exhaustedOTP := *otp
+	exhaustedOTP.Attempts = handler.OTPMaxAttempts
+
+	tests := []struct {
+		name               string
+		path               string
+		code               string
+		expectedStatusCode int
+		expectedSMS        bool
+		mockRepository     func(mockRepo *repository.MockRepositoryInterface)
+	}{
+		{
+			name:               "Start",
+			path:               "/phone/verify/start",
+			expectedStatusCode: http.StatusAccepted,
+			expectedSMS:        true,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().CountOTPs(gomock.Any(), TestPhoneNumber, handler.OTPPurposePhoneVerification, gomock.Any()).Return(0, nil)
+				mockRepo.EXPECT().CountOTPsByIP(gomock.Any(), gomock.Any(), handler.OTPPurposePhoneVerification, gomock.Any()).Return(0, nil)
+				mockRepo.EXPECT().CreateOTP(gomock.Any(), gomock.Any()).DoAndReturn(
+					func(ctx context.Context, otp *entity.OTP) error {
+						assert.Equal(t, TestPhoneNumber, otp.PhoneNumber)
+						assert.WithinDuration(t, time.Now().Add(handler.OTPTTL), otp.ExpiresAt, time.Minute)
+						return nil
+					})
+			},
+		},
+		{
+			name:               "Start Rate Limited",
+			path:               "/phone/verify/start",
+			expectedStatusCode: http.StatusTooManyRequests,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().CountOTPs(gomock.Any(), TestPhoneNumber, handler.OTPPurposePhoneVerification, gomock.Any()).Return(handler.OTPSendLimit, nil)
+			},
+		},
+		{
+			name:               "Start Already Verified",
+			path:               "/phone/verify/start",
+			expectedStatusCode: http.StatusConflict,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(verifiedUser, nil)
+			},
+		},
+		{
+			name:               "Confirm",
+			path:               "/phone/verify/confirm",
+			code:               "123456",
+			expectedStatusCode: http.StatusOK,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().GetActiveOTP(gomock.Any(), TestPhoneNumber, handler.OTPPurposePhoneVerification).Return(otp, nil)
+				mockRepo.EXPECT().UseOTPAttempt(gomock.Any(), otp.ID, handler.OTPMaxAttempts).Return(true, nil)
+				mockRepo.EXPECT().ConsumeOTP(gomock.Any(), otp.ID).Return(true, nil)
+				mockRepo.EXPECT().SetPhoneVerified(gomock.Any(), user.ID).Return(nil)
+			},
+		},
+		{
+			name:               "Confirm Wrong Code",
+			path:               "/phone/verify/confirm",
+			code:               "654321",
+			expectedStatusCode: http.StatusForbidden,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().GetActiveOTP(gomock.Any(), TestPhoneNumber, handler.OTPPurposePhoneVerification).Return(otp, nil)
+				mockRepo.EXPECT().UseOTPAttempt(gomock.Any(), otp.ID, handler.OTPMaxAttempts).Return(true, nil)
+			},
+		},
+		{
+			name:               "Confirm Too Many Attempts",
+			path:               "/phone/verify/confirm",
+			code:               "123456",
+			expectedStatusCode: http.StatusTooManyRequests,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().GetActiveOTP(gomock.Any(), TestPhoneNumber, handler.OTPPurposePhoneVerification).Return(&exhaustedOTP, nil)
+				mockRepo.EXPECT().UseOTPAttempt(gomock.Any(), exhaustedOTP.ID, handler.OTPMaxAttempts).Return(false, nil)
+			},
+		},
+		{
+			name:               "Confirm Expired Code",
+			path:               "/phone/verify/confirm",
+			code:               "123456",
+			expectedStatusCode: http.StatusForbidden,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().GetActiveOTP(gomock.Any(), TestPhoneNumber, handler.OTPPurposePhoneVerification).Return(nil, nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockRepo := repository.NewMockRepositoryInterface(ctrl)
+			tt.mockRepository(mockRepo)
+
+			var sms bytes.Buffer
+			server := handler.NewServer(handler.NewServerOptions{
+				Repository: mockRepo,
+				JWT:        jwt,
+				SMS:        &handler.LogSMSSender{Logger: log.New(&sms, "", 0)},
+			})
+
+			e := echo.New()
+			server.RegisterHandlers(e)
+
+			token, err := jwt.GenerateToken(user.ID, nil, "")
+			require.NoError(t, err)
+
+			body, err := json.Marshal(models.PhoneVerificationConfirmRequest{Code: tt.code})
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+
+			if tt.expectedSMS {
+				assert.Regexp(t, `^to \+621234567890: .* [0-9]{6}\n$`, sms.String())
+			} else {
+				assert.Empty(t, sms.String())
+			}
+		})
+	}
+}
+
+func TestSMSLogin(t *testing.T) {
+	prvKey, _ := newTestKey(t)
+
+	confirmedAt := time.Now()
+	user := &entity.UserData{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		FullName:    TestFullName,
+	}
+	disabledUser := &entity.UserData{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		FullName:    TestFullName,
+		DisabledAt:  &confirmedAt,
+	}
+	// Confirming the login marks the phone number as verified on the user
+	unverifiedUser := func() *entity.UserData {
+		copied := *user
+		return &copied
+	}
+
+	codeHash, err := bcrypt.GenerateFromPassword([]byte("123456"), bcrypt.MinCost)
+	require.NoError(t, err)
+	otp := &entity.OTP{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		Purpose:     handler.OTPPurposeLogin,
+		CodeHash:    string(codeHash),
+		ExpiresAt:   time.Now().Add(handler.OTPTTL),
+	}
+
+	tests := []struct {
+		name                string
+		path                string
+		request             models.SMSLoginConfirmRequest
+		expectedStatusCode  int
+		expectedSMS         bool
+		expectedMFARequired bool
+		mockRepository      func(mockRepo *repository.MockRepositoryInterface)
+	}{
+		{
+			name:               "Start",
+			path:               "/login/sms/start",
+			request:            models.SMSLoginConfirmRequest{PhoneNumber: TestPhoneNumber},
+			expectedStatusCode: http.StatusAccepted,
+			expectedSMS:        true,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().CountOTPs(gomock.Any(), TestPhoneNumber, handler.OTPPurposeLogin, gomock.Any()).Return(0, nil)
+				mockRepo.EXPECT().CountOTPsByIP(gomock.Any(), "192.0.2.1", handler.OTPPurposeLogin, gomock.Any()).Return(0, nil)
+				mockRepo.EXPECT().CreateOTP(gomock.Any(), gomock.Any()).DoAndReturn(
+					func(ctx context.Context, otp *entity.OTP) error {
+						assert.Equal(t, handler.OTPPurposeLogin, otp.Purpose)
+						assert.Equal(t, "192.0.2.1", otp.IPAddress)
+						assert.True(t, strings.HasPrefix(otp.CodeHash, "$2"), "code is stored as a bcrypt hash")
+						return nil
+					})
+			},
+		},
+		{
+			name:               "Start Unknown Phone Number",
+			path:               "/login/sms/start",
+			request:            models.SMSLoginConfirmRequest{PhoneNumber: TestPhoneNumber},
+			expectedStatusCode: http.StatusAccepted,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(nil, nil)
+			},
+		},
+		{
+			// Answered like any other number, the code is just not sent
+			name:               "Start Rate Limited Per Phone Number",
+			path:               "/login/sms/start",
+			request:            models.SMSLoginConfirmRequest{PhoneNumber: TestPhoneNumber},
+			expectedStatusCode: http.StatusAccepted,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().CountOTPs(gomock.Any(), TestPhoneNumber, handler.OTPPurposeLogin, gomock.Any()).Return(handler.OTPSendLimit, nil)
+			},
+		},
+		{
+			name:               "Start Rate Limited Per IP",
+			path:               "/login/sms/start",
+			request:            models.SMSLoginConfirmRequest{PhoneNumber: TestPhoneNumber},
+			expectedStatusCode: http.StatusAccepted,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().CountOTPs(gomock.Any(), TestPhoneNumber, handler.OTPPurposeLogin, gomock.Any()).Return(0, nil)
+				mockRepo.EXPECT().CountOTPsByIP(gomock.Any(), "192.0.2.1", handler.OTPPurposeLogin, gomock.Any()).Return(handler.OTPSendLimitPerIP, nil)
+			},
+		},
+		{
+			name:               "Start Invalid Phone Number",
+			path:               "/login/sms/start",
+			request:            models.SMSLoginConfirmRequest{PhoneNumber: "081234567890"},
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepository:     func(mockRepo *repository.MockRepositoryInterface) {},
+		},
+		{
+			name:               "Confirm",
+			path:               "/login/sms/confirm",
+			request:            models.SMSLoginConfirmRequest{PhoneNumber: TestPhoneNumber, Code: "123456"},
+			expectedStatusCode: http.StatusOK,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetActiveOTP(gomock.Any(), TestPhoneNumber, handler.OTPPurposeLogin).Return(otp, nil)
+				mockRepo.EXPECT().UseOTPAttempt(gomock.Any(), otp.ID, handler.OTPMaxAttempts).Return(true, nil)
+				mockRepo.EXPECT().ConsumeOTP(gomock.Any(), otp.ID).Return(true, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(unverifiedUser(), nil)
+				mockRepo.EXPECT().SetPhoneVerified(gomock.Any(), user.ID).Return(nil)
+				mockRepo.EXPECT().GetTOTP(gomock.Any(), user.ID).Return(nil, nil)
+				mockRepo.EXPECT().GetUserRoles(gomock.Any(), user.ID).Return([]string{handler.RoleFarmer}, nil)
+				mockRepo.EXPECT().CreateSession(gomock.Any(), gomock.Any()).Return(nil)
+				mockRepo.EXPECT().IncLogin(gomock.Any(), user.ID).Return(nil)
+				mockRepo.EXPECT().CreateRefreshToken(gomock.Any(), gomock.Any()).Return(nil)
+			},
+		},
+		{
+			name:                "Confirm With TOTP Enabled",
+			path:                "/login/sms/confirm",
+			request:             models.SMSLoginConfirmRequest{PhoneNumber: TestPhoneNumber, Code: "123456"},
+			expectedStatusCode:  http.StatusOK,
+			expectedMFARequired: true,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetActiveOTP(gomock.Any(), TestPhoneNumber, handler.OTPPurposeLogin).Return(otp, nil)
+				mockRepo.EXPECT().UseOTPAttempt(gomock.Any(), otp.ID, handler.OTPMaxAttempts).Return(true, nil)
+				mockRepo.EXPECT().ConsumeOTP(gomock.Any(), otp.ID).Return(true, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(unverifiedUser(), nil)
+				mockRepo.EXPECT().SetPhoneVerified(gomock.Any(), user.ID).Return(nil)
+				mockRepo.EXPECT().GetTOTP(gomock.Any(), user.ID).Return(&entity.TOTP{UserID: user.ID, ConfirmedAt: &confirmedAt}, nil)
+			},
+		},
+		{
+			name:               "Confirm Code Already Used",
+			path:               "/login/sms/confirm",
+			request:            models.SMSLoginConfirmRequest{PhoneNumber: TestPhoneNumber, Code: "123456"},
+			expectedStatusCode: http.StatusForbidden,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetActiveOTP(gomock.Any(), TestPhoneNumber, handler.OTPPurposeLogin).Return(otp, nil)
+				mockRepo.EXPECT().UseOTPAttempt(gomock.Any(), otp.ID, handler.OTPMaxAttempts).Return(true, nil)
+				mockRepo.EXPECT().ConsumeOTP(gomock.Any(), otp.ID).Return(false, nil)
+			},
+		},
+		{
+			name:               "Confirm Wrong Code",
+			path:               "/login/sms/confirm",
+			request:            models.SMSLoginConfirmRequest{PhoneNumber: TestPhoneNumber, Code: "654321"},
+			expectedStatusCode: http.StatusForbidden,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetActiveOTP(gomock.Any(), TestPhoneNumber, handler.OTPPurposeLogin).Return(otp, nil)
+				mockRepo.EXPECT().UseOTPAttempt(gomock.Any(), otp.ID, handler.OTPMaxAttempts).Return(true, nil)
+			},
+		},
+		{
+			name:               "Confirm Disabled User",
+			path:               "/login/sms/confirm",
+			request:            models.SMSLoginConfirmRequest{PhoneNumber: TestPhoneNumber, Code: "123456"},
+			expectedStatusCode: http.StatusForbidden,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetActiveOTP(gomock.Any(), TestPhoneNumber, handler.OTPPurposeLogin).Return(otp, nil)
+				mockRepo.EXPECT().UseOTPAttempt(gomock.Any(), otp.ID, handler.OTPMaxAttempts).Return(true, nil)
+				mockRepo.EXPECT().ConsumeOTP(gomock.Any(), otp.ID).Return(true, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(disabledUser, nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockRepo := repository.NewMockRepositoryInterface(ctrl)
+			tt.mockRepository(mockRepo)
+
+			jwt, err := handler.NewJWT(handler.NewJWTOptions{
+				Issuer:     TestIssuer,
+				Audience:   TestAudience,
+				PrivateKey: prvKey,
+			})
+			require.NoError(t, err)
+
+			var sms bytes.Buffer
+			server := handler.NewServer(handler.NewServerOptions{
+				Repository: mockRepo,
+				JWT:        jwt,
+				SMS:        &handler.LogSMSSender{Logger: log.New(&sms, "", 0)},
+			})
+
+			e := echo.New()
+			server.RegisterHandlers(e)
+
+			body, err := json.Marshal(tt.request)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+
+			if tt.expectedSMS {
+				assert.Regexp(t, `^to \+621234567890: .* login code is [0-9]{6}\n$`, sms.String())
+			} else {
+				assert.Empty(t, sms.String())
+			}
+
+			if strings.HasSuffix(tt.path, "/confirm") && rec.Code == http.StatusOK {
+				var response models.LoginUserResponse
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				assert.Equal(t, tt.expectedMFARequired, response.MFARequired)
+				assert.Equal(t, tt.expectedMFARequired, response.Token == "")
+			}
+		})
+	}
+}
+
+// recordingNotifier keeps the password reset codes instead of delivering them
+type recordingNotifier struct {
+	codes []string
+}
+
+func (notifier *recordingNotifier) NotifyPasswordReset(ctx context.Context, user *entity.UserData, code string) error {
+	notifier.codes = append(notifier.codes, code)
+	return nil
+}
+
+func TestPasswordReset(t *testing.T) {
+	jwt := newTestJWT(t)
+
+	user := &entity.UserData{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		FullName:    TestFullName,
+	}
+
+	codeHash, err := bcrypt.GenerateFromPassword([]byte("123456"), bcrypt.MinCost)
+	require.NoError(t, err)
+	otp := &entity.OTP{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		Purpose:     handler.OTPPurposePasswordReset,
+		CodeHash:    string(codeHash),
+		ExpiresAt:   time.Now().Add(handler.OTPTTL),
+	}
+
+	tests := []struct {
+		name               string
+		path               string
+		request            models.ResetPasswordRequest
+		expectedStatusCode int
+		expectedNotified   bool
+		// expectedLoggedOut is set when the session of the user has to end
+		expectedLoggedOut bool
+		mockRepository    func(mockRepo *repository.MockRepositoryInterface)
+	}{
+		{
+			name:               "Forgot",
+			path:               "/password/forgot",
+			request:            models.ResetPasswordRequest{PhoneNumber: TestPhoneNumber},
+			expectedStatusCode: http.StatusAccepted,
+			expectedNotified:   true,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().CountOTPs(gomock.Any(), TestPhoneNumber, handler.OTPPurposePasswordReset, gomock.Any()).Return(0, nil)
+				mockRepo.EXPECT().CountOTPsByIP(gomock.Any(), gomock.Any(), handler.OTPPurposePasswordReset, gomock.Any()).Return(0, nil)
+				mockRepo.EXPECT().CreateOTP(gomock.Any(), gomock.Any()).Return(nil)
+			},
+		},
+		{
+			name:               "Forgot Unknown Phone Number",
+			path:               "/password/forgot",
+			request:            models.ResetPasswordRequest{PhoneNumber: TestPhoneNumber},
+			expectedStatusCode: http.StatusAccepted,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(nil, nil)
+			},
+		},
+		{
+			// Answered like any other number, the code is just not sent
+			name:               "Forgot Rate Limited",
+			path:               "/password/forgot",
+			request:            models.ResetPasswordRequest{PhoneNumber: TestPhoneNumber},
+			expectedStatusCode: http.StatusAccepted,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().CountOTPs(gomock.Any(), TestPhoneNumber, handler.OTPPurposePasswordReset, gomock.Any()).Return(handler.OTPSendLimit, nil)
+			},
+		},
+		{
+			name:               "Reset",
+			path:               "/password/reset",
+			request:            models.ResetPasswordRequest{PhoneNumber: TestPhoneNumber, Code: "123456", Password: TestNewPassword},
+			expectedStatusCode: http.StatusNoContent,
+			expectedLoggedOut:  true,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetActiveOTP(gomock.Any(), TestPhoneNumber, handler.OTPPurposePasswordReset).Return(otp, nil)
+				mockRepo.EXPECT().UseOTPAttempt(gomock.Any(), otp.ID, handler.OTPMaxAttempts).Return(true, nil)
+				mockRepo.EXPECT().ConsumeOTP(gomock.Any(), otp.ID).Return(true, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().ListActiveSessions(gomock.Any(), user.ID).Return([]*entity.Session{{ID: "session", UserID: user.ID}}, nil)
+				mockRepo.EXPECT().ResetPassword(gomock.Any(), user.ID, gomock.Any()).DoAndReturn(
+					func(ctx context.Context, userID int64, hashedPassword string) error {
+						assert.NoError(t, testPasswords.ValidatePassword(TestNewPassword, "", hashedPassword))
+						return nil
+					})
+			},
+		},
+		{
+			name:               "Reset Weak Password",
+			path:               "/password/reset",
+			request:            models.ResetPasswordRequest{PhoneNumber: TestPhoneNumber, Code: "123456", Password: "password"},
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepository:     func(mockRepo *repository.MockRepositoryInterface) {},
+		},
+		{
+			name:               "Reset Breached Password",
+			path:               "/password/reset",
+			request:            models.ResetPasswordRequest{PhoneNumber: TestPhoneNumber, Code: "123456", Password: TestBreachedPassword},
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepository:     func(mockRepo *repository.MockRepositoryInterface) {},
+		},
+		{
+			name:               "Reset Wrong Code",
+			path:               "/password/reset",
+			request:            models.ResetPasswordRequest{PhoneNumber: TestPhoneNumber, Code: "654321", Password: TestNewPassword},
+			expectedStatusCode: http.StatusForbidden,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetActiveOTP(gomock.Any(), TestPhoneNumber, handler.OTPPurposePasswordReset).Return(otp, nil)
+				mockRepo.EXPECT().UseOTPAttempt(gomock.Any(), otp.ID, handler.OTPMaxAttempts).Return(true, nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockRepo := repository.NewMockRepositoryInterface(ctrl)
+			tt.mockRepository(mockRepo)
+
+			accessToken, err := jwt.GenerateToken(user.ID, nil, "session")
+			require.NoError(t, err)
+
+			notifier := &recordingNotifier{}
+			server := handler.NewServer(handler.NewServerOptions{
+				Repository:       mockRepo,
+				Passwords:        testPasswords,
+				PasswordStrength: newTestPasswordStrength(t),
+				JWT:              jwt,
+				Notifier:         notifier,
+			})
+
+			e := echo.New()
+			server.RegisterHandlers(e)
+
+			body, err := json.Marshal(tt.request)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+
+			if tt.expectedLoggedOut {
+				_, err = jwt.ValidateToken(context.Background(), "Bearer "+accessToken)
+				assert.Error(t, err)
+			}
+
+			if tt.expectedNotified {
+				require.Len(t, notifier.codes, 1)
+				assert.Regexp(t, `^[0-9]{6}$`, notifier.codes[0])
+			} else {
+				assert.Empty(t, notifier.codes)
+			}
+		})
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	jwt := newTestJWT(t)
+
+	hashedPassword, err := testPasswords.HashPassword(TestPassword)
+	require.NoError(t, err)
+	user := &entity.UserData{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		FullName:    TestFullName,
+		Password:    hashedPassword,
+	}
+
+	tests := []struct {
+		name               string
+		request            models.ChangePasswordRequest
+		expectedStatusCode int
+		mockRepository     func(mockRepo *repository.MockRepositoryInterface)
+	}{
+		{
+			name:               "Valid Request",
+			request:            models.ChangePasswordRequest{CurrentPassword: TestPassword, NewPassword: TestNewPassword},
+			expectedStatusCode: http.StatusNoContent,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().UpdatePassword(gomock.Any(), user.ID, gomock.Any()).DoAndReturn(
+					func(ctx context.Context, userID int64, hashedPassword string) error {
+						assert.NoError(t, testPasswords.ValidatePassword(TestNewPassword, "", hashedPassword))
+						return nil
+					})
+			},
+		},
+		{
+			name:               "Wrong Current Password",
+			request:            models.ChangePasswordRequest{CurrentPassword: "Wr0ng-P@ssword", NewPassword: TestNewPassword},
+			expectedStatusCode: http.StatusForbidden,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+			},
+		},
+		{
+			name:               "Breached New Password",
+			request:            models.ChangePasswordRequest{CurrentPassword: TestPassword, NewPassword: TestBreachedPassword},
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+			},
+		},
+		{
+			name:               "Weak New Password",
+			request:            models.ChangePasswordRequest{CurrentPassword: TestPassword, NewPassword: "password"},
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockRepo := repository.NewMockRepositoryInterface(ctrl)
+			tt.mockRepository(mockRepo)
+
+			server := handler.NewServer(handler.NewServerOptions{
+				Repository:       mockRepo,
+				Passwords:        testPasswords,
+				PasswordStrength: newTestPasswordStrength(t),
+				JWT:              jwt,
+			})
+
+			e := echo.New()
+			server.RegisterHandlers(e)
+
+			token, err := jwt.GenerateToken(user.ID, nil, "")
+			require.NoError(t, err)
+
+			body, err := json.Marshal(tt.request)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPut, "/profile/password", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+		})
+	}
+}
+
+func TestLoginUpgradesPasswordHash(t *testing.T) {
+	jwt := newTestJWT(t)
+
+	// Hashes made before salts were random are salted with the phone number
+	legacyHash, err := bcrypt.GenerateFromPassword([]byte(TestPassword+TestPhoneNumber), bcrypt.MinCost)
+	require.NoError(t, err)
+	currentHash, err := testPasswords.HashPassword(TestPassword)
+	require.NoError(t, err)
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte(TestPassword), bcrypt.MinCost)
+	require.NoError(t, err)
+	outdatedHash, err := handler.NewPasswordHasher(handler.NewPasswordHasherOptions{
+		Params: handler.Argon2Params{
+			Memory:      512,
+			Iterations:  1,
+			Parallelism: 1,
+			SaltLength:  16,
+			KeyLength:   32,
+		},
+	}).HashPassword(TestPassword)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name               string
+		user               entity.UserData
+		expectedStatusCode int
+		expectedUpgrade    bool
+	}{
+		{
+			name: "Legacy Hash",
+			user: entity.UserData{
+				ID:                 1,
+				PhoneNumber:        TestPhoneNumber,
+				Password:           string(legacyHash),
+				LegacyPasswordSalt: TestPhoneNumber,
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedUpgrade:    true,
+		},
+		{
+			name: "Legacy Hash After Phone Number Change",
+			user: entity.UserData{
+				ID:                 1,
+				PhoneNumber:        "+620987654321",
+				Password:           string(legacyHash),
+				LegacyPasswordSalt: TestPhoneNumber,
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedUpgrade:    true,
+		},
+		{
+			name: "Bcrypt Hash",
+			user: entity.UserData{
+				ID:          1,
+				PhoneNumber: TestPhoneNumber,
+				Password:    string(bcryptHash),
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedUpgrade:    true,
+		},
+		{
+			name: "Outdated Argon2 Parameters",
+			user: entity.UserData{
+				ID:          1,
+				PhoneNumber: TestPhoneNumber,
+				Password:    outdatedHash,
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedUpgrade:    true,
+		},
+		{
+			name: "Current Hash",
+			user: entity.UserData{
+				ID:          1,
+				PhoneNumber: TestPhoneNumber,
+				Password:    currentHash,
+			},
+			expectedStatusCode: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			user := tt.user
+			mockRepo := repository.NewMockRepositoryInterface(ctrl)
+			mockRepo.EXPECT().GetLoginFailures(gomock.Any(), handler.LockoutScopeIP, gomock.Any()).Return(nil, nil)
+			mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(&user, nil)
+			mockRepo.EXPECT().GetLoginFailures(gomock.Any(), handler.LockoutScopeAccount, "1").Return(nil, nil)
+			mockRepo.EXPECT().ClearLoginFailures(gomock.Any(), handler.LockoutScopeAccount, "1").Return(nil)
+			if tt.expectedUpgrade {
+				mockRepo.EXPECT().UpdatePassword(gomock.Any(), user.ID, gomock.Any()).DoAndReturn(
+					func(ctx context.Context, userID int64, hashedPassword string) error {
+						assert.NoError(t, testPasswords.ValidatePassword(TestPassword, "", hashedPassword))
+						assert.False(t, testPasswords.NeedsRehash("", hashedPassword))
+						return nil
+					})
+			}
+			mockRepo.EXPECT().GetTOTP(gomock.Any(), user.ID).Return(nil, nil)
+			mockRepo.EXPECT().GetUserRoles(gomock.Any(), user.ID).Return(nil, nil)
+			mockRepo.EXPECT().CreateSession(gomock.Any(), gomock.Any()).Return(nil)
+			mockRepo.EXPECT().IncLogin(gomock.Any(), user.ID).Return(nil)
+			mockRepo.EXPECT().CreateRefreshToken(gomock.Any(), gomock.Any()).Return(nil)
+
+			server := handler.NewServer(handler.NewServerOptions{
+				Repository: mockRepo,
+				Passwords:  testPasswords,
+				JWT:        jwt,
+			})
+
+			e := echo.New()
+			server.RegisterHandlers(e)
+
+			body, err := json.Marshal(models.LoginUserRequest{
+				PhoneNumber: user.PhoneNumber,
+				Password:    TestPassword,
+			})
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+		})
+	}
+}
+
+func TestPasswordHasher(t *testing.T) {
+	hashedPassword, err := testPasswords.HashPassword(TestPassword)
+	require.NoError(t, err)
+
+	assert.Regexp(t, `^\$argon2id\$v=19\$m=1024,t=1,p=1\$[A-Za-z0-9+/]{22}\$[A-Za-z0-9+/]{43}$`, hashedPassword)
+	assert.NoError(t, testPasswords.ValidatePassword(TestPassword, "", hashedPassword))
+	assert.ErrorIs(t, testPasswords.ValidatePassword(TestNewPassword, "", hashedPassword), handler.ErrPasswordMismatch)
+
+	// Every hash gets its own salt
+	otherHash, err := testPasswords.HashPassword(TestPassword)
+	require.NoError(t, err)
+	assert.NotEqual(t, hashedPassword, otherHash)
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte(TestPassword), bcrypt.MinCost)
+	require.NoError(t, err)
+	assert.NoError(t, testPasswords.ValidatePassword(TestPassword, "", string(bcryptHash)))
+	assert.ErrorIs(t, testPasswords.ValidatePassword(TestNewPassword, "", string(bcryptHash)), handler.ErrPasswordMismatch)
+
+	assert.False(t, testPasswords.NeedsRehash("", hashedPassword))
+	assert.True(t, testPasswords.NeedsRehash("", string(bcryptHash)))
+	assert.True(t, handler.NewPasswordHasher(handler.NewPasswordHasherOptions{}).NeedsRehash("", hashedPassword))
+
+	assert.Error(t, testPasswords.ValidatePassword(TestPassword, "", "$argon2id$v=19$m=1024$salt$key"))
+}
+
+func TestPasswordHasherPepper(t *testing.T) {
+	params := handler.Argon2Params{
+		Memory:      1024,
+		Iterations:  1,
+		Parallelism: 1,
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+	peppered := handler.NewPasswordHasher(handler.NewPasswordHasherOptions{
+		Params:  params,
+		Peppers: map[int][]byte{1: []byte("first pepper")},
+	})
+	rotated := handler.NewPasswordHasher(handler.NewPasswordHasherOptions{
+		Params:  params,
+		Peppers: map[int][]byte{1: []byte("first pepper"), 2: []byte("second pepper")},
+	})
+	leaked := handler.NewPasswordHasher(handler.NewPasswordHasherOptions{
+		Params:  params,
+		Peppers: map[int][]byte{1: []byte("guessed pepper")},
+	})
+
+	hashedPassword, err := peppered.HashPassword(TestPassword)
+	require.NoError(t, err)
+	assert.Contains(t, hashedPassword, ",keyid=1$")
+	assert.NoError(t, peppered.ValidatePassword(TestPassword, "", hashedPassword))
+	assert.False(t, peppered.NeedsRehash("", hashedPassword))
+
+	// The hash is useless without the pepper
+	assert.Error(t, testPasswords.ValidatePassword(TestPassword, "", hashedPassword))
+	assert.ErrorIs(t, leaked.ValidatePassword(TestPassword, "", hashedPassword), handler.ErrPasswordMismatch)
+
+	// After a rotation old hashes still work until they are re-hashed
+	assert.NoError(t, rotated.ValidatePassword(TestPassword, "", hashedPassword))
+	assert.True(t, rotated.NeedsRehash("", hashedPassword))
+
+	rehashed, err := rotated.HashPassword(TestPassword)
+	require.NoError(t, err)
+	assert.Contains(t, rehashed, ",keyid=2$")
+	assert.NoError(t, rotated.ValidatePassword(TestPassword, "", rehashed))
+	assert.False(t, rotated.NeedsRehash("", rehashed))
+
+	// Hashes made before the pepper was introduced get one on the next login
+	unpeppered, err := testPasswords.HashPassword(TestPassword)
+	require.NoError(t, err)
+	assert.NoError(t, peppered.ValidatePassword(TestPassword, "", unpeppered))
+	assert.True(t, peppered.NeedsRehash("", unpeppered))
+}
+
+func TestLoginLockout(t *testing.T) {
+	jwt := newTestJWT(t)
+
+	hashedPassword, err := testPasswords.HashPassword(TestPassword)
+	require.NoError(t, err)
+	user := &entity.UserData{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		FullName:    TestFullName,
+		Password:    hashedPassword,
+	}
+
+	lockedUntil := time.Now().Add(90 * time.Second)
+	expiredLock := time.Now().Add(-time.Second)
+
+	tests := []struct {
+		name               string
+		password           string
+		expectedStatusCode int
+		expectedRetryAfter string
+		mockRepository     func(mockRepo *repository.MockRepositoryInterface)
+	}{
+		{
+			name:               "Wrong Password",
+			password:           TestNewPassword,
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetLoginFailures(gomock.Any(), handler.LockoutScopeIP, "192.0.2.1").Return(nil, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().GetLoginFailures(gomock.Any(), handler.LockoutScopeAccount, "1").Return(nil, nil)
+				mockRepo.EXPECT().RecordLoginFailure(gomock.Any(), handler.LockoutScopeIP, "192.0.2.1", gomock.Any()).Return(1, nil)
+				mockRepo.EXPECT().RecordLoginFailure(gomock.Any(), handler.LockoutScopeAccount, "1", gomock.Any()).Return(1, nil)
+			},
+		},
+		{
+			name:               "Wrong Password Reaching Threshold",
+			password:           TestNewPassword,
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetLoginFailures(gomock.Any(), handler.LockoutScopeIP, "192.0.2.1").Return(nil, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().GetLoginFailures(gomock.Any(), handler.LockoutScopeAccount, "1").Return(nil, nil)
+				mockRepo.EXPECT().RecordLoginFailure(gomock.Any(), handler.LockoutScopeIP, "192.0.2.1", gomock.Any()).Return(5, nil)
+				mockRepo.EXPECT().RecordLoginFailure(gomock.Any(), handler.LockoutScopeAccount, "1", gomock.Any()).Return(handler.DefaultAccountLockout.Threshold, nil)
+				mockRepo.EXPECT().LockLogin(gomock.Any(), handler.LockoutScopeAccount, "1", gomock.Any()).DoAndReturn(
+					func(ctx context.Context, scope, key string, until time.Time) error {
+						assert.WithinDuration(t, time.Now().Add(handler.DefaultAccountLockout.BaseDelay), until, time.Second)
+						return nil
+					})
+			},
+		},
+		{
+			name:               "IP Failure Not Recorded",
+			password:           TestNewPassword,
+			expectedStatusCode: http.StatusBadRequest,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetLoginFailures(gomock.Any(), handler.LockoutScopeIP, "192.0.2.1").Return(nil, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().GetLoginFailures(gomock.Any(), handler.LockoutScopeAccount, "1").Return(nil, nil)
+				mockRepo.EXPECT().RecordLoginFailure(gomock.Any(), handler.LockoutScopeIP, "192.0.2.1", gomock.Any()).Return(0, errors.New("value too long"))
+				mockRepo.EXPECT().RecordLoginFailure(gomock.Any(), handler.LockoutScopeAccount, "1", gomock.Any()).Return(1, nil)
+			},
+		},
+		{
+			name:               "Unknown Phone Number",
+			password:           TestPassword,
+			expectedStatusCode: http.StatusNotFound,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetLoginFailures(gomock.Any(), handler.LockoutScopeIP, "192.0.2.1").Return(nil, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(nil, nil)
+				mockRepo.EXPECT().RecordLoginFailure(gomock.Any(), handler.LockoutScopeIP, "192.0.2.1", gomock.Any()).Return(1, nil)
+			},
+		},
+		{
+			name:               "Account Locked",
+			password:           TestPassword,
+			expectedStatusCode: http.StatusLocked,
+			expectedRetryAfter: "90",
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetLoginFailures(gomock.Any(), handler.LockoutScopeIP, "192.0.2.1").Return(nil, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().GetLoginFailures(gomock.Any(), handler.LockoutScopeAccount, "1").Return(&entity.LoginFailures{
+					FailedAttempts: 5,
+					LockedUntil:    &lockedUntil,
+				}, nil)
+			},
+		},
+		{
+			name:               "IP Locked",
+			password:           TestPassword,
+			expectedStatusCode: http.StatusLocked,
+			expectedRetryAfter: "90",
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetLoginFailures(gomock.Any(), handler.LockoutScopeIP, "192.0.2.1").Return(&entity.LoginFailures{
+					FailedAttempts: 20,
+					LockedUntil:    &lockedUntil,
+				}, nil)
+			},
+		},
+		{
+			name:               "Lock Expired",
+			password:           TestPassword,
+			expectedStatusCode: http.StatusOK,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetLoginFailures(gomock.Any(), handler.LockoutScopeIP, "192.0.2.1").Return(nil, nil)
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+				mockRepo.EXPECT().GetLoginFailures(gomock.Any(), handler.LockoutScopeAccount, "1").Return(&entity.LoginFailures{
+					FailedAttempts: 5,
+					LockedUntil:    &expiredLock,
+				}, nil)
+				mockRepo.EXPECT().ClearLoginFailures(gomock.Any(), handler.LockoutScopeAccount, "1").Return(nil)
+				mockRepo.EXPECT().GetTOTP(gomock.Any(), user.ID).Return(nil, nil)
+				mockRepo.EXPECT().GetUserRoles(gomock.Any(), user.ID).Return(nil, nil)
+				mockRepo.EXPECT().CreateSession(gomock.Any(), gomock.Any()).Return(nil)
+				mockRepo.EXPECT().IncLogin(gomock.Any(), user.ID).Return(nil)
+				mockRepo.EXPECT().CreateRefreshToken(gomock.Any(), gomock.Any()).Return(nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockRepo := repository.NewMockRepositoryInterface(ctrl)
+			tt.mockRepository(mockRepo)
+
+			server := handler.NewServer(handler.NewServerOptions{
+				Repository: mockRepo,
+				Passwords:  testPasswords,
+				JWT:        jwt,
+			})
+
+			e := echo.New()
+			server.RegisterHandlers(e)
+
+			body, err := json.Marshal(models.LoginUserRequest{
+				PhoneNumber: TestPhoneNumber,
+				Password:    tt.password,
+			})
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+			assert.Equal(t, tt.expectedRetryAfter, rec.Header().Get("Retry-After"))
+		})
+	}
+}
+
+func TestLockoutPolicy(t *testing.T) {
+	policy := handler.LockoutPolicy{
+		Threshold: 3,
+		Window:    time.Hour,
+		BaseDelay: time.Minute,
+		MaxDelay:  10 * time.Minute,
+	}
+
+	assert.Equal(t, time.Duration(0), policy.LockDuration(2))
+	assert.Equal(t, time.Minute, policy.LockDuration(3))
+	assert.Equal(t, 2*time.Minute, policy.LockDuration(4))
+	assert.Equal(t, 8*time.Minute, policy.LockDuration(6))
+	assert.Equal(t, 10*time.Minute, policy.LockDuration(7))
+	assert.Equal(t, 10*time.Minute, policy.LockDuration(1000))
+
+	assert.Equal(t, time.Duration(0), handler.LockoutPolicy{}.LockDuration(1000))
+}
+
+func TestRateLimit(t *testing.T) {
+	type request struct {
+		phoneNumber        string
+		forwardedFor       string
+		expectedStatusCode int
+		expectedRemaining  string
+		expectedRetryAfter string
+	}
+
+	tests := []struct {
+		name     string
+		limits   []handler.RateLimit
+		requests []request
+	}{
+		{
+			name: "By IP",
+			limits: []handler.RateLimit{
+				{Requests: 2, Per: time.Minute, Key: handler.RateLimitByIP},
+			},
+			requests: []request{
+				{phoneNumber: TestPhoneNumber, expectedStatusCode: http.StatusOK, expectedRemaining: "1"},
+				{phoneNumber: "+628987654321", expectedStatusCode: http.StatusOK, expectedRemaining: "0"},
+				{phoneNumber: TestPhoneNumber, expectedStatusCode: http.StatusTooManyRequests, expectedRemaining: "0", expectedRetryAfter: "30"},
+			},
+		},
+		{
+			// Headers that do not hold an IP address are not trusted
+			name: "By IP Ignoring Invalid Forwarded Address",
+			limits: []handler.RateLimit{
+				{Requests: 2, Per: time.Minute, Key: handler.RateLimitByIP},
+			},
+			requests: []request{
+				{phoneNumber: TestPhoneNumber, forwardedFor: strings.Repeat("a", 100), expectedStatusCode: http.StatusOK, expectedRemaining: "1"},
+				{phoneNumber: TestPhoneNumber, forwardedFor: strings.Repeat("b", 100), expectedStatusCode: http.StatusOK, expectedRemaining: "0"},
+				{phoneNumber: TestPhoneNumber, expectedStatusCode: http.StatusTooManyRequests, expectedRemaining: "0", expectedRetryAfter: "30"},
+			},
+		},
+		{
+			name: "By Phone Number",
+			limits: []handler.RateLimit{
+				{Requests: 10, Per: time.Minute, Key: handler.RateLimitByIP},
+				{Requests: 1, Per: time.Minute, Key: handler.RateLimitByPhoneNumber},
+			},
+			requests: []request{
+				{phoneNumber: TestPhoneNumber, expectedStatusCode: http.StatusOK, expectedRemaining: "0"},
+				{phoneNumber: "+628987654321", expectedStatusCode: http.StatusOK, expectedRemaining: "0"},
+				{phoneNumber: TestPhoneNumber, expectedStatusCode: http.StatusTooManyRequests, expectedRemaining: "0", expectedRetryAfter: "60"},
+				{expectedStatusCode: http.StatusOK, expectedRemaining: "6"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &handler.Server{
+				RateLimits: repository.NewMemoryRateLimitStore(),
+			}
+
+			e := echo.New()
+			e.POST("/limited", func(c echo.Context) error {
+				// The handler still gets the body the limit was keyed by
+				var body models.LoginUserRequest
+				err := c.Bind(&body)
+				if err != nil {
+					return err
+				}
+				return c.String(http.StatusOK, body.PhoneNumber)
+			}, server.RateLimit("limited", tt.limits...))
+
+			for _, r := range tt.requests {
+				body, err := json.Marshal(models.LoginUserRequest{
+					PhoneNumber: r.phoneNumber,
+				})
+				require.NoError(t, err)
+
+				req := httptest.NewRequest(http.MethodPost, "/limited", bytes.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				if r.forwardedFor != "" {
+					req.Header.Set(echo.HeaderXForwardedFor, r.forwardedFor)
+				}
+				rec := httptest.NewRecorder()
+				e.ServeHTTP(rec, req)
+
+				assert.Equal(t, r.expectedStatusCode, rec.Code)
+				assert.Equal(t, r.expectedRemaining, rec.Header().Get("RateLimit-Remaining"))
+				assert.Equal(t, r.expectedRetryAfter, rec.Header().Get("Retry-After"))
+				if r.expectedStatusCode == http.StatusOK {
+					assert.Equal(t, r.phoneNumber, rec.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestOAuthEndpointsRateLimited(t *testing.T) {
+	for _, path := range []string{"/authorize", "/token", "/introspect"} {
+		t.Run(path, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			// Only how the request is limited matters, not how it is answered
+			mockRepo := repository.NewMockRepositoryInterface(ctrl)
+			mockRepo.EXPECT().GetOAuthClient(gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+
+			server := handler.NewServer(handler.NewServerOptions{
+				Repository: mockRepo,
+				JWT:        newTestJWT(t),
+			})
+
+			e := echo.New()
+			server.RegisterHandlers(e)
+
+			req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(""))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.NotEmpty(t, rec.Header().Get("RateLimit-Limit"))
+		})
+	}
+}
+
+func TestRateLimitStoreError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	store := repository.NewMockRateLimitStoreInterface(ctrl)
+	store.EXPECT().Take(gomock.Any(), "limited:ip:192.0.2.1", 5, 12*time.Second).Return(false, 0.0, errors.New("connection refused"))
+
+	server := &handler.Server{
+		RateLimits: store,
+	}
+
+	e := echo.New()
+	e.POST("/limited", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, server.RateLimit("limited", handler.RateLimit{Requests: 5, Per: time.Minute, Key: handler.RateLimitByIP}))
+
+	req := httptest.NewRequest(http.MethodPost, "/limited", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestLoginStartsSession(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	jwt := newTestJWT(t)
+
+	hashedPassword, err := testPasswords.HashPassword(TestPassword)
+	require.NoError(t, err)
+	user := &entity.UserData{
+		ID:          1,
+		PhoneNumber: TestPhoneNumber,
+		FullName:    TestFullName,
+		Password:    hashedPassword,
+	}
+
+	var sessionID string
+	mockRepo := repository.NewMockRepositoryInterface(ctrl)
+	mockRepo.EXPECT().GetLoginFailures(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, nil).Times(2)
+	mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(user, nil)
+	mockRepo.EXPECT().ClearLoginFailures(gomock.Any(), handler.LockoutScopeAccount, "1").Return(nil)
+	mockRepo.EXPECT().GetTOTP(gomock.Any(), user.ID).Return(nil, nil)
+	mockRepo.EXPECT().GetUserRoles(gomock.Any(), user.ID).Return(nil, nil)
+	mockRepo.EXPECT().CreateSession(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, session *entity.Session) error {
+			assert.NotEmpty(t, session.ID)
+			assert.Equal(t, user.ID, session.UserID)
+			assert.Equal(t, handler.LoginMethodPassword, session.Method)
+			assert.Equal(t, "192.0.2.1", session.IPAddress)
+			assert.Equal(t, "TestAgent/1.0", session.UserAgent)
+			sessionID = session.ID
+			return nil
+		})
+	mockRepo.EXPECT().IncLogin(gomock.Any(), user.ID).Return(nil)
+	mockRepo.EXPECT().CreateRefreshToken(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, token *entity.RefreshToken) error {
+			// The session is the refresh token family
+			assert.Equal(t, sessionID, token.FamilyID)
+			return nil
+		})
+
+	server := handler.NewServer(handler.NewServerOptions{
+		Repository: mockRepo,
+		Passwords:  testPasswords,
+		JWT:        jwt,
+	})
+
+	e := echo.New()
+	server.RegisterHandlers(e)
+
+	body, err := json.Marshal(models.LoginUserRequest{
+		PhoneNumber: user.PhoneNumber,
+		Password:    TestPassword,
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "TestAgent/1.0")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var response models.LoginUserResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+
+	claims, err := jwt.ParseToken(context.Background(), response.Token)
+	require.NoError(t, err)
+	assert.Equal(t, sessionID, claims.SessionID)
+}
+
+func TestSessions(t *testing.T) {
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	current := &entity.Session{
+		ID:         "current",
+		UserID:     1,
+		Method:     handler.LoginMethodPassword,
+		IPAddress:  "192.0.2.1",
+		UserAgent:  "TestAgent/1.0",
+		CreatedAt:  createdAt,
+		LastUsedAt: createdAt.Add(time.Hour),
+	}
+	other := &entity.Session{
+		ID:         "other",
+		UserID:     1,
+		Method:     handler.LoginMethodPasskey,
+		IPAddress:  "198.51.100.1",
+		UserAgent:  "OtherAgent/2.0",
+		CreatedAt:  createdAt,
+		LastUsedAt: createdAt,
+	}
+	foreign := &entity.Session{
+		ID:     "foreign",
+		UserID: 2,
+	}
+
+	tests := []struct {
+		name               string
+		method             string
+		path               string
+		expectedStatusCode int
+		expectedSessions   []models.SessionResponse
+		expectRevoked      bool
+		mockRepository     func(mockRepo *repository.MockRepositoryInterface)
+	}{
+		{
+			name:               "List",
+			method:             http.MethodGet,
+			path:               "/sessions",
+			expectedStatusCode: http.StatusOK,
+			expectedSessions: []models.SessionResponse{
+				{
+					ID:         "current",
+					Method:     handler.LoginMethodPassword,
+					IPAddress:  "192.0.2.1",
+					UserAgent:  "TestAgent/1.0",
+					CreatedAt:  createdAt,
+					LastUsedAt: createdAt.Add(time.Hour),
+					Current:    true,
+				},
+				{
+					ID:         "other",
+					Method:     handler.LoginMethodPasskey,
+					IPAddress:  "198.51.100.1",
+					UserAgent:  "OtherAgent/2.0",
+					CreatedAt:  createdAt,
+					LastUsedAt: createdAt,
+				},
+			},
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().ListActiveSessions(gomock.Any(), int64(1)).Return([]*entity.Session{current, other}, nil)
+			},
+		},
+		{
+			name:               "List Empty",
+			method:             http.MethodGet,
+			path:               "/sessions",
+			expectedStatusCode: http.StatusOK,
+			expectedSessions:   []models.SessionResponse{},
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().ListActiveSessions(gomock.Any(), int64(1)).Return(nil, nil)
+			},
+		},
+		{
+			name:               "Delete Current",
+			method:             http.MethodDelete,
+			path:               "/sessions/current",
+			expectedStatusCode: http.StatusNoContent,
+			expectRevoked:      true,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetSession(gomock.Any(), "current").Return(current, nil)
+				mockRepo.EXPECT().RevokeRefreshTokenFamily(gomock.Any(), "current").Return(nil)
+			},
+		},
+		{
+			name:               "Delete Other",
+			method:             http.MethodDelete,
+			path:               "/sessions/other",
+			expectedStatusCode: http.StatusNoContent,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetSession(gomock.Any(), "other").Return(other, nil)
+				mockRepo.EXPECT().RevokeRefreshTokenFamily(gomock.Any(), "other").Return(nil)
+			},
+		},
+		{
+			name:               "Delete Session Of Another User",
+			method:             http.MethodDelete,
+			path:               "/sessions/foreign",
+			expectedStatusCode: http.StatusNotFound,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetSession(gomock.Any(), "foreign").Return(foreign, nil)
+			},
+		},
+		{
+			name:               "Delete Unknown",
+			method:             http.MethodDelete,
+			path:               "/sessions/unknown",
+			expectedStatusCode: http.StatusNotFound,
+			mockRepository: func(mockRepo *repository.MockRepositoryInterface) {
+				mockRepo.EXPECT().GetSession(gomock.Any(), "unknown").Return(nil, nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockRepo := repository.NewMockRepositoryInterface(ctrl)
+			tt.mockRepository(mockRepo)
+
+			jwt := newTestJWT(t)
+			server := &handler.Server{
+				Repository: mockRepo,
+				JWT:        jwt,
+			}
+
+			e := echo.New()
+			server.RegisterHandlers(e)
+
+			token, err := jwt.GenerateToken(1, nil, "current")
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+
+			if tt.expectedSessions != nil {
+				var response models.ListSessionsResponse
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				assert.Equal(t, tt.expectedSessions, response.Sessions)
+			}
+
+			// Access tokens of a revoked session stop working right away
+			_, err = jwt.ValidateToken(context.Background(), "Bearer "+token)
+			if tt.expectRevoked {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	jwt := newTestJWT(t)
+
+	userToken, err := jwt.GenerateToken(1, []string{handler.RoleFarmer}, "session")
+	require.NoError(t, err)
+	clientToken, err := jwt.GenerateClientToken(2, "client", "openid profile")
+	require.NoError(t, err)
+	serviceToken, err := jwt.GenerateServiceToken("client", "users:read")
+	require.NoError(t, err)
+
+	disabledAt := time.Now()
+
+	tests := []struct {
+		name               string
+		authorization      string
+		requireRole        bool
+		requireScope       string
+		clientUser         *entity.UserData
+		expectedStatusCode int
+		expectedChallenge  string
+		expectedPrincipal  *handler.Principal
+	}{
+		{
+			name:               "User Token",
+			authorization:      "Bearer " + userToken,
+			expectedStatusCode: http.StatusOK,
+			expectedPrincipal: &handler.Principal{
+				UserID:    1,
+				Roles:     []string{handler.RoleFarmer},
+				Scopes:    []string{},
+				SessionID: "session",
+			},
+		},
+		{
+			name:               "Client Token",
+			authorization:      "Bearer " + clientToken,
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "Client Token With Scope",
+			authorization:      "Bearer " + clientToken,
+			requireScope:       "profile",
+			clientUser:         &entity.UserData{ID: 2},
+			expectedStatusCode: http.StatusOK,
+			expectedPrincipal: &handler.Principal{
+				UserID:   2,
+				Roles:    nil,
+				Scopes:   []string{"openid", "profile"},
+				ClientID: "client",
+			},
+		},
+		{
+			name:               "Client Token Of Disabled User",
+			authorization:      "Bearer " + clientToken,
+			requireScope:       "profile",
+			clientUser:         &entity.UserData{ID: 2, DisabledAt: &disabledAt},
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "Client Token Missing Scope",
+			authorization:      "Bearer " + clientToken,
+			requireScope:       "phone",
+			expectedStatusCode: http.StatusForbidden,
+			expectedChallenge:  `Bearer error="insufficient_scope", scope="phone"`,
+		},
+		{
+			name:               "User Token Not Limited By Scope",
+			authorization:      "Bearer " + userToken,
+			requireScope:       "phone",
+			expectedStatusCode: http.StatusOK,
+			expectedPrincipal: &handler.Principal{
+				UserID:    1,
+				Roles:     []string{handler.RoleFarmer},
+				Scopes:    []string{},
+				SessionID: "session",
+			},
+		},
+		{
+			name:               "Client Token Has No Role",
+			authorization:      "Bearer " + clientToken,
+			requireRole:        true,
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "Missing Authorization",
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedChallenge:  "Bearer",
+		},
+		{
+			name:               "Invalid Token",
+			authorization:      "Bearer invalid",
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedChallenge:  `Bearer error="invalid_token"`,
+		},
+		{
+			name:               "Bearer Without Token",
+			authorization:      "Bearer",
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedChallenge:  `Bearer error="invalid_token"`,
+		},
+		{
+			name:               "Bearer With Empty Token",
+			authorization:      "Bearer ",
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedChallenge:  `Bearer error="invalid_token"`,
+		},
+		{
+			name:               "Other Scheme",
+			authorization:      "Basic dXNlcjpwYXNz",
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedChallenge:  `Bearer error="invalid_token"`,
+		},
+		{
+			name:               "Token Without User",
+			authorization:      "Bearer " + serviceToken,
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedChallenge:  `Bearer error="invalid_token"`,
+		},
+		{
+			name:               "Role Without Token",
+			requireRole:        true,
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedChallenge:  "Bearer",
+		},
+		{
+			name:               "Missing Role",
+			authorization:      "Bearer " + userToken,
+			requireRole:        true,
+			expectedStatusCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			// Client tokens are only accepted while their user is active
+			mockRepo := repository.NewMockRepositoryInterface(ctrl)
+			if tt.clientUser != nil {
+				mockRepo.EXPECT().GetUser(gomock.Any(), gomock.Any()).Return(tt.clientUser, nil)
+			}
+
+			server := &handler.Server{
+				Repository: mockRepo,
+				JWT:        jwt,
+			}
+
+			middleware := server.Authenticate
+			if tt.requireRole {
+				middleware = server.RequireRole(handler.RoleAdmin)
+			}
+			if tt.requireScope != "" {
+				middleware = server.RequireScope(tt.requireScope)
+			}
+
+			e := echo.New()
+			e.GET("/private", func(c echo.Context) error {
+				principal := handler.CurrentPrincipal(c)
+				require.NotNil(t, principal)
+				assert.NotNil(t, principal.Claims)
+
+				// Claims are compared on their own
+				principal.Claims = nil
+				assert.Equal(t, tt.expectedPrincipal, principal)
+
+				return c.NoContent(http.StatusOK)
+			}, middleware)
+
+			req := httptest.NewRequest(http.MethodGet, "/private", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expectedStatusCode, rec.Code)
+			assert.Equal(t, tt.expectedChallenge, rec.Header().Get("WWW-Authenticate"))
+		})
+	}
+}
+
+func TestClientTokenOnAccountRoutes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// The repository is never reached
+	mockRepo := repository.NewMockRepositoryInterface(ctrl)
+	jwt := newTestJWT(t)
+
+	webAuthn, err := webauthn.New(&webauthn.Config{
+		RPID:          "example.com",
+		RPDisplayName: handler.ServiceName,
+		RPOrigins:     []string{"https://example.com"},
+	})
+	require.NoError(t, err)
+
+	server := handler.NewServer(handler.NewServerOptions{
+		Repository: mockRepo,
+		JWT:        jwt,
+		WebAuthn:   webAuthn,
+	})
+
+	e := echo.New()
+	server.RegisterHandlers(e)
+
+	// Every scope a client can be granted
+	clientToken, err := jwt.GenerateClientToken(1, "client", strings.Join(handler.SupportedScopes, " "))
+	require.NoError(t, err)
+
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{method: http.MethodGet, path: "/profile"},
+		{method: http.MethodPut, path: "/profile"},
+		{method: http.MethodPut, path: "/profile/password"},
+		{method: http.MethodPost, path: "/webauthn/register/begin"},
+		{method: http.MethodPost, path: "/webauthn/register/finish"},
+		{method: http.MethodPost, path: "/mfa/totp/enroll"},
+		{method: http.MethodPost, path: "/mfa/totp/confirm"},
+		{method: http.MethodGet, path: "/sessions"},
+		{method: http.MethodDelete, path: "/sessions/session"},
+		{method: http.MethodPost, path: "/phone/verify/start"},
+		{method: http.MethodPost, path: "/logout"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader("{}"))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+clientToken)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusForbidden, rec.Code)
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SawitProRecruitment/UserService/handler/models"
+	"github.com/SawitProRecruitment/UserService/repository/entity"
+	"github.com/labstack/echo/v4"
+)
+
+// Scopes failed logins are counted in
+const (
+	LockoutScopeAccount = "account"
+	LockoutScopeIP      = "ip"
+	// LockoutScopeMFAToken counts wrong codes per MFA token, by token ID
+	LockoutScopeMFAToken = "mfa_token"
+)
+
+// LockoutPolicy decides when failed logins lock further attempts.
+type LockoutPolicy struct {
+	// Threshold failed logins in a row lock the login, it is never locked
+	// when zero
+	Threshold int
+	// Window without failures after which counting starts over
+	Window time.Duration
+	// BaseDelay is the first lockout, every further failure doubles it up to
+	// MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+var (
+	DefaultAccountLockout = LockoutPolicy{
+		Threshold: 5,
+		Window:    time.Hour,
+		BaseDelay: time.Minute,
+		MaxDelay:  time.Hour,
+	}
+	// DefaultIPLockout allows more failures, since many users can share an
+	// IP address
+	DefaultIPLockout = LockoutPolicy{
+		Threshold: 20,
+		Window:    time.Hour,
+		BaseDelay: time.Minute,
+		MaxDelay:  time.Hour,
+	}
+)
+
+// LockDuration returns how long the login is locked after the number of
+// failures in a row, zero when it is not locked yet.
+func (policy LockoutPolicy) LockDuration(failedAttempts int) time.Duration {
+	if policy.Threshold == 0 || failedAttempts < policy.Threshold {
+		return 0
+	}
+
+	exponent := failedAttempts - policy.Threshold
+	if exponent > 30 {
+		return policy.MaxDelay
+	}
+
+	delay := time.Duration(float64(policy.BaseDelay) * math.Pow(2, float64(exponent)))
+	if delay > policy.MaxDelay {
+		return policy.MaxDelay
+	}
+
+	return delay
+}
+
+func (server *Server) lockoutPolicy(scope string) LockoutPolicy {
+	if scope == LockoutScopeAccount {
+		return server.AccountLockout
+	}
+
+	return server.IPLockout
+}
+
+// checkLoginLockout rejects a login while the account or IP address is
+// locked. When it is locked the response has already been written and ok is
+// false.
+func (server *Server) checkLoginLockout(c echo.Context, scope, key string) (ok bool, err error) {
+	locked, err := server.loginLocked(c, scope, key)
+	if err != nil {
+		return false, c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to check failed logins",
+			Error:   err.Error(),
+		})
+	}
+	if locked {
+		return false, c.JSON(http.StatusLocked, models.ErrorResponse{
+			Message: "Too many failed logins, try again later",
+		})
+	}
+
+	return true, nil
+}
+
+// loginLocked tells whether the account or IP address is locked, and sets
+// the Retry-After header to when it unlocks if so.
+func (server *Server) loginLocked(c echo.Context, scope, key string) (bool, error) {
+	if server.lockoutPolicy(scope).Threshold == 0 {
+		return false, nil
+	}
+
+	failures, err := server.Repository.GetLoginFailures(c.Request().Context(), scope, key)
+	if err != nil {
+		return false, err
+	}
+	if failures == nil || failures.LockedUntil == nil {
+		return false, nil
+	}
+
+	retryAfter := time.Until(*failures.LockedUntil)
+	if retryAfter <= 0 {
+		return false, nil
+	}
+
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+
+	return true, nil
+}
+
+// recordFailedLogin counts a failed login for the IP address and, when the
+// user exists, for their account. The account failure is counted even when
+// the IP address one could not be, so the account lockout never depends on
+// the address.
+func (server *Server) recordFailedLogin(c echo.Context, user *entity.UserData) error {
+	ipErr := server.recordLoginFailure(c, LockoutScopeIP, clientIP(c))
+
+	if user != nil {
+		err := server.recordLoginFailure(c, LockoutScopeAccount, strconv.FormatInt(user.ID, 10))
+		if err != nil {
+			return err
+		}
+	}
+
+	return ipErr
+}
+
+// recordLoginFailure counts a failed login for the account or IP address and
+// locks it once the policy says so.
+func (server *Server) recordLoginFailure(c echo.Context, scope, key string) error {
+	policy := server.lockoutPolicy(scope)
+	if policy.Threshold == 0 {
+		return nil
+	}
+
+	ctx := c.Request().Context()
+
+	failedAttempts, err := server.Repository.RecordLoginFailure(ctx, scope, key, time.Now().Add(-policy.Window))
+	if err != nil {
+		return err
+	}
+
+	lockDuration := policy.LockDuration(failedAttempts)
+	if lockDuration == 0 {
+		return nil
+	}
+
+	return server.Repository.LockLogin(ctx, scope, key, time.Now().Add(lockDuration))
+}
+
+// clearLoginFailures starts counting the failed logins of the account over
+// after a successful login. Failures by IP address are left to expire, so
+// logging into one account does not allow guessing more passwords of others.
+func (server *Server) clearLoginFailures(c echo.Context, userID int64) error {
+	if server.AccountLockout.Threshold == 0 {
+		return nil
+	}
+
+	return server.Repository.ClearLoginFailures(c.Request().Context(), LockoutScopeAccount, strconv.FormatInt(userID, 10))
+}
@@ -0,0 +1,346 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SawitProRecruitment/UserService/handler/models"
+	"github.com/SawitProRecruitment/UserService/repository"
+	"github.com/SawitProRecruitment/UserService/repository/entity"
+	"github.com/SawitProRecruitment/UserService/totp"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// ServiceName is shown to users by authenticator apps and passkey prompts
+	ServiceName = "SawitPro"
+	// RecoveryCodeCount is how many recovery codes are issued on enrollment
+	RecoveryCodeCount = 10
+	// MFAMaxAttempts wrong codes can be entered with one MFA token before it
+	// is revoked and the login has to start over with the password
+	MFAMaxAttempts = 5
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// EnrollTOTP starts TOTP enrollment for the authenticated user. The secret is
+// only used for login once it is confirmed with ConfirmTOTP.
+func (server *Server) EnrollTOTP(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := CurrentPrincipal(c).UserID
+
+	user, err := server.Repository.GetUser(ctx, &entity.UserFilter{
+		ID: &userID,
+	})
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get user",
+			Error:   err.Error(),
+		})
+	}
+	if user == nil {
+		return c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Message: "User not found",
+		})
+	}
+
+	existing, err := server.Repository.GetTOTP(ctx, userID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get TOTP",
+			Error:   err.Error(),
+		})
+	}
+	if existing != nil && existing.ConfirmedAt != nil {
+		return c.JSON(http.StatusConflict, models.ErrorResponse{
+			Message: "TOTP already enabled",
+		})
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to generate TOTP secret",
+			Error:   err.Error(),
+		})
+	}
+
+	err = server.Repository.SetTOTPSecret(ctx, userID, secret)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to save TOTP secret",
+			Error:   err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, models.TOTPEnrollResponse{
+		Secret: secret,
+		URI:    totp.URI(ServiceName, user.PhoneNumber, secret),
+	})
+}
+
+// ConfirmTOTP enables TOTP for the authenticated user once they prove their
+// authenticator app generates valid codes, and returns their recovery codes.
+func (server *Server) ConfirmTOTP(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := CurrentPrincipal(c).UserID
+
+	confirmRequest := &models.TOTPConfirmRequest{}
+
+	err := c.Bind(confirmRequest)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to read request",
+			Error:   err.Error(),
+		})
+	}
+
+	pending, err := server.Repository.GetTOTP(ctx, userID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get TOTP",
+			Error:   err.Error(),
+		})
+	}
+	if pending == nil || pending.ConfirmedAt != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "No pending TOTP enrollment",
+		})
+	}
+
+	step, valid := totp.Verify(pending.Secret, confirmRequest.Code, time.Now())
+	if !valid {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Invalid code",
+		})
+	}
+
+	recoveryCodes, recoveryCodeHashes, err := GenerateRecoveryCodes()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to generate recovery codes",
+			Error:   err.Error(),
+		})
+	}
+
+	err = server.Repository.ConfirmTOTP(ctx, userID, step, recoveryCodeHashes)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to confirm TOTP",
+			Error:   err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, models.TOTPConfirmResponse{
+		RecoveryCodes: recoveryCodes,
+	})
+}
+
+// LoginMFA completes a login that returned mfa_required by exchanging the
+// challenge token and a TOTP or recovery code for the login tokens.
+func (server *Server) LoginMFA(c echo.Context) error {
+	ctx := c.Request().Context()
+	mfaRequest := &models.MFALoginRequest{}
+
+	err := c.Bind(mfaRequest)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to read request",
+			Error:   err.Error(),
+		})
+	}
+
+	errs := mfaRequest.Validate()
+	if len(errs) > 0 {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Invalid request",
+			Error:   errs,
+		})
+	}
+
+	ok, err := server.checkLoginLockout(c, LockoutScopeIP, clientIP(c))
+	if !ok {
+		return err
+	}
+
+	userID, claims, err := server.JWT.ParseMFAToken(ctx, mfaRequest.MFAToken)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: "Invalid MFA token",
+			Error:   err.Error(),
+		})
+	}
+
+	ok, err = server.checkLoginLockout(c, LockoutScopeAccount, strconv.FormatInt(userID, 10))
+	if !ok {
+		return err
+	}
+
+	user, err := server.Repository.GetUser(ctx, &entity.UserFilter{
+		ID: &userID,
+	})
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get user",
+			Error:   err.Error(),
+		})
+	}
+	if user == nil || user.DisabledAt != nil {
+		return c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: "User not allowed to login",
+		})
+	}
+
+	enrolled, err := server.Repository.GetTOTP(ctx, userID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get TOTP",
+			Error:   err.Error(),
+		})
+	}
+	if enrolled == nil || enrolled.ConfirmedAt == nil {
+		return c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: "TOTP not enabled",
+		})
+	}
+
+	method, rejection, err := server.verifySecondFactor(ctx, userID, enrolled, mfaRequest.Code, mfaRequest.RecoveryCode)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to verify code",
+			Error:   err.Error(),
+		})
+	}
+	if rejection != "" {
+		revoked, err := server.recordFailedSecondFactor(c, user, claims)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Message: "Failed to record failed login",
+				Error:   err.Error(),
+			})
+		}
+		if revoked {
+			return c.JSON(http.StatusForbidden, models.ErrorResponse{
+				Message: "Too many wrong codes, log in again",
+			})
+		}
+
+		return c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: rejection,
+		})
+	}
+
+	// The challenge token can only be exchanged once
+	err = server.JWT.RevokeToken(ctx, claims)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to revoke MFA token",
+			Error:   err.Error(),
+		})
+	}
+
+	return server.completeLogin(c, user, method)
+}
+
+// verifySecondFactor checks a TOTP code of the user with confirmed TOTP, or
+// the recovery code when code is empty, and returns the login method it
+// completes. A recovery code can only be used once. When the code is not
+// accepted rejection says why.
+func (server *Server) verifySecondFactor(ctx context.Context, userID int64, enrolled *entity.TOTP, code, recoveryCode string) (method string, rejection string, err error) {
+	if code != "" {
+		step, valid := totp.Verify(enrolled.Secret, code, time.Now())
+		if !valid {
+			return "", "Invalid code", nil
+		}
+
+		err = server.Repository.UseTOTPStep(ctx, userID, step)
+		if errors.Is(err, repository.ErrTOTPCodeUsed) {
+			return "", "Code already used", nil
+		}
+		if err != nil {
+			return "", "", err
+		}
+
+		return LoginMethodTOTP, "", nil
+	}
+
+	used, err := server.Repository.ConsumeRecoveryCode(ctx, userID, HashRecoveryCode(recoveryCode))
+	if err != nil {
+		return "", "", err
+	}
+	if !used {
+		return "", "Invalid recovery code", nil
+	}
+
+	return LoginMethodRecoveryCode, "", nil
+}
+
+// recordFailedSecondFactor counts a wrong code like a failed login, and
+// against the MFA token it was entered with. The token is revoked once
+// MFAMaxAttempts wrong codes were entered with it.
+func (server *Server) recordFailedSecondFactor(c echo.Context, user *entity.UserData, claims *Claims) (revoked bool, err error) {
+	ctx := c.Request().Context()
+
+	err = server.recordFailedLogin(c, user)
+	if err != nil {
+		return false, err
+	}
+
+	// The token expires within MFATokenTTL, so earlier failures never reset
+	failedAttempts, err := server.Repository.RecordLoginFailure(ctx, LockoutScopeMFAToken, claims.Id, time.Now().Add(-MFATokenTTL))
+	if err != nil {
+		return false, err
+	}
+	if failedAttempts < MFAMaxAttempts {
+		return false, nil
+	}
+
+	err = server.JWT.RevokeToken(ctx, claims)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// GenerateRecoveryCodes returns new recovery codes for the user and the hashes
+// they are stored under.
+func GenerateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, RecoveryCodeCount)
+	hashes := make([]string, 0, RecoveryCodeCount)
+
+	for i := 0; i < RecoveryCodeCount; i++ {
+		b := make([]byte, 10)
+
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Formatted as xxxxxxxx-xxxxxxxx to be easier to copy by hand
+		encoded := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))
+		code := encoded[:8] + "-" + encoded[8:]
+
+		codes = append(codes, code)
+		hashes = append(hashes, HashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode returns the hash under which a recovery code is stored,
+// ignoring case and separators the user may have typed differently.
+func HashRecoveryCode(code string) string {
+	normalized := strings.ToLower(code)
+	normalized = strings.NewReplacer("-", "", " ", "").Replace(normalized)
+
+	return HashToken(normalized)
+}
@@ -1,7 +1,12 @@
 package models
 
 import (
+	"encoding/json"
+	"net/url"
 	"regexp"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
 )
 
 const (
@@ -9,6 +14,11 @@ const (
 	RegexNumber               = "[0-9]+"
 	RegexSpecialChars         = "[^a-zA-Z0-9 ]+"
 	RegexIndonesiaPhoneNumber = `^\+62[0-9]*$`
+	RegexScope                = `^[a-z0-9_.:-]+$`
+
+	DateLayout     = "2006-01-02"
+	DefaultPerPage = 20
+	MaxPerPage     = 100
 )
 
 type ErrorResponse struct {
@@ -40,15 +50,64 @@ func (registerRequest *RegisterUserRequest) Validate() map[string][]string {
 		errs["full_name"] = append(errs["full_name"], "Full name must be at minimum 3 characters and maximum 60 characters")
 	}
 
-	if len(registerRequest.Password) < 6 || len(registerRequest.Password) > 64 {
-		errs["password"] = append(errs["password"], "Password must be minimum 6 characters and maximum 64 characters")
+	if passwordErrs := validatePassword(registerRequest.Password); len(passwordErrs) > 0 {
+		errs["password"] = passwordErrs
+	}
+
+	return errs
+}
+
+// validatePassword checks the rules every new password has to follow.
+func validatePassword(password string) []string {
+	var errs []string
+
+	if len(password) < 6 || len(password) > 64 {
+		errs = append(errs, "Password must be minimum 6 characters and maximum 64 characters")
 	}
 
-	passwordContainUppercase := regexp.MustCompile(RegexUppercase).MatchString(registerRequest.Password)
-	passwordContainNumber := regexp.MustCompile(RegexNumber).MatchString(registerRequest.Password)
-	passwordContainSpecialChars := regexp.MustCompile(RegexSpecialChars).MatchString(registerRequest.Password)
+	passwordContainUppercase := regexp.MustCompile(RegexUppercase).MatchString(password)
+	passwordContainNumber := regexp.MustCompile(RegexNumber).MatchString(password)
+	passwordContainSpecialChars := regexp.MustCompile(RegexSpecialChars).MatchString(password)
 	if !passwordContainUppercase || !passwordContainNumber || !passwordContainSpecialChars {
-		errs["password"] = append(errs["password"], "Password must contain at least 1 capital letter, 1 number, and 1 special characters")
+		errs = append(errs, "Password must contain at least 1 capital letter, 1 number, and 1 special characters")
+	}
+
+	return errs
+}
+
+type ForgotPasswordRequest struct {
+	PhoneNumber string `json:"phone_number"`
+}
+
+func (forgotRequest *ForgotPasswordRequest) Validate() map[string][]string {
+	errs := make(map[string][]string)
+
+	if !regexp.MustCompile(RegexIndonesiaPhoneNumber).MatchString(forgotRequest.PhoneNumber) {
+		errs["phone_number"] = append(errs["phone_number"], "Phone number must start with the Indonesia country code")
+	}
+
+	return errs
+}
+
+type ResetPasswordRequest struct {
+	PhoneNumber string `json:"phone_number"`
+	Code        string `json:"code"`
+	Password    string `json:"password"`
+}
+
+func (resetRequest *ResetPasswordRequest) Validate() map[string][]string {
+	errs := make(map[string][]string)
+
+	if resetRequest.PhoneNumber == "" {
+		errs["phone_number"] = append(errs["phone_number"], "Phone number is required")
+	}
+
+	if resetRequest.Code == "" {
+		errs["code"] = append(errs["code"], "Code is required")
+	}
+
+	if passwordErrs := validatePassword(resetRequest.Password); len(passwordErrs) > 0 {
+		errs["password"] = passwordErrs
 	}
 
 	return errs
@@ -64,13 +123,144 @@ type LoginUserRequest struct {
 }
 
 type LoginUserResponse struct {
-	ID    int64  `json:"id"`
-	Token string `json:"token"`
+	ID           int64  `json:"id"`
+	Token        string `json:"token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	// MFARequired is set instead of the tokens when the user has to complete
+	// the login with a second factor using MFAToken
+	MFARequired bool   `json:"mfa_required,omitempty"`
+	MFAToken    string `json:"mfa_token,omitempty"`
 }
 
-type GetUserProfileResponse struct {
+type SMSLoginStartRequest struct {
 	PhoneNumber string `json:"phone_number"`
-	FullName    string `json:"full_name"`
+}
+
+func (startRequest *SMSLoginStartRequest) Validate() map[string][]string {
+	errs := make(map[string][]string)
+
+	if !regexp.MustCompile(RegexIndonesiaPhoneNumber).MatchString(startRequest.PhoneNumber) {
+		errs["phone_number"] = append(errs["phone_number"], "Phone number must start with the Indonesia country code")
+	}
+
+	return errs
+}
+
+type SMSLoginConfirmRequest struct {
+	PhoneNumber string `json:"phone_number"`
+	Code        string `json:"code"`
+}
+
+func (confirmRequest *SMSLoginConfirmRequest) Validate() map[string][]string {
+	errs := make(map[string][]string)
+
+	if confirmRequest.PhoneNumber == "" {
+		errs["phone_number"] = append(errs["phone_number"], "Phone number is required")
+	}
+
+	if confirmRequest.Code == "" {
+		errs["code"] = append(errs["code"], "Code is required")
+	}
+
+	return errs
+}
+
+type MFALoginRequest struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+func (mfaRequest *MFALoginRequest) Validate() map[string][]string {
+	errs := make(map[string][]string)
+
+	if mfaRequest.MFAToken == "" {
+		errs["mfa_token"] = append(errs["mfa_token"], "MFA token is required")
+	}
+
+	if (mfaRequest.Code == "") == (mfaRequest.RecoveryCode == "") {
+		errs["code"] = append(errs["code"], "Either a code or a recovery code is required")
+	}
+
+	return errs
+}
+
+type WebAuthnRegistrationOptionsResponse struct {
+	// Options are passed to navigator.credentials.create()
+	Options      *protocol.CredentialCreation `json:"options"`
+	SessionToken string                       `json:"session_token"`
+}
+
+type WebAuthnLoginOptionsResponse struct {
+	// Options are passed to navigator.credentials.get()
+	Options      *protocol.CredentialAssertion `json:"options"`
+	SessionToken string                        `json:"session_token"`
+}
+
+type WebAuthnFinishRequest struct {
+	SessionToken string `json:"session_token"`
+	// Credential is the PublicKeyCredential returned by the browser
+	Credential json.RawMessage `json:"credential"`
+}
+
+func (finishRequest *WebAuthnFinishRequest) Validate() map[string][]string {
+	errs := make(map[string][]string)
+
+	if finishRequest.SessionToken == "" {
+		errs["session_token"] = append(errs["session_token"], "Session token is required")
+	}
+
+	if len(finishRequest.Credential) == 0 {
+		errs["credential"] = append(errs["credential"], "Credential is required")
+	}
+
+	return errs
+}
+
+type WebAuthnCredentialResponse struct {
+	ID int64 `json:"id"`
+}
+
+type OTPSentResponse struct {
+	// ExpiresIn is the number of seconds the code is valid for
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+type PhoneVerificationConfirmRequest struct {
+	Code string `json:"code"`
+}
+
+type TOTPEnrollResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type TOTPConfirmRequest struct {
+	Code string `json:"code"`
+}
+
+type TOTPConfirmResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type RefreshTokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+type GetUserProfileResponse struct {
+	PhoneNumber   string `json:"phone_number"`
+	PhoneVerified bool   `json:"phone_verified"`
+	FullName      string `json:"full_name"`
 }
 
 type UpdateUserProfileRequest struct {
@@ -103,7 +293,242 @@ func (updateRequest *UpdateUserProfileRequest) Validate() map[string][]string {
 	return errs
 }
 
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+func (changeRequest *ChangePasswordRequest) Validate() map[string][]string {
+	errs := make(map[string][]string)
+
+	if changeRequest.CurrentPassword == "" {
+		errs["current_password"] = append(errs["current_password"], "Current password is required")
+	}
+
+	if passwordErrs := validatePassword(changeRequest.NewPassword); len(passwordErrs) > 0 {
+		errs["new_password"] = passwordErrs
+	}
+
+	return errs
+}
+
 type UpdateUserProfileResponse struct {
 	PhoneNumber *string `json:"phone_number,omitempty"`
 	FullName    *string `json:"full_name,omitempty"`
 }
+
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JWKSResponse struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+type OpenIDConfigurationResponse struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+type UserinfoResponse struct {
+	Sub                 string `json:"sub"`
+	PhoneNumber         string `json:"phone_number,omitempty"`
+	PhoneNumberVerified *bool  `json:"phone_number_verified,omitempty"`
+	Name                string `json:"name,omitempty"`
+}
+
+type CreateOAuthClientRequest struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	// Confidential clients get a client secret and may use the
+	// client_credentials grant with the given scopes
+	Confidential bool     `json:"confidential"`
+	Scopes       []string `json:"scopes"`
+}
+
+func (clientRequest *CreateOAuthClientRequest) Validate() map[string][]string {
+	errs := make(map[string][]string)
+
+	if len(clientRequest.Name) < 3 ||
+		len(clientRequest.Name) > 60 {
+		errs["name"] = append(errs["name"], "Name must be at minimum 3 characters and maximum 60 characters")
+	}
+
+	if len(clientRequest.RedirectURIs) == 0 && !clientRequest.Confidential {
+		errs["redirect_uris"] = append(errs["redirect_uris"], "At least 1 redirect URI is required")
+	}
+
+	if len(clientRequest.Scopes) > 0 && !clientRequest.Confidential {
+		errs["scopes"] = append(errs["scopes"], "Only confidential clients can be given scopes")
+	}
+
+	for _, scope := range clientRequest.Scopes {
+		if !regexp.MustCompile(RegexScope).MatchString(scope) {
+			errs["scopes"] = append(errs["scopes"], "Scope must only contain lowercase letters, numbers and _.:-: "+scope)
+		}
+	}
+
+	for _, redirectURI := range clientRequest.RedirectURIs {
+		u, err := url.Parse(redirectURI)
+		if err != nil || !u.IsAbs() || u.Fragment != "" {
+			errs["redirect_uris"] = append(errs["redirect_uris"], "Redirect URI must be an absolute URI without fragment: "+redirectURI)
+			continue
+		}
+
+		// Plain HTTP is only allowed for clients running on the user's machine
+		if u.Scheme == "http" && u.Hostname() != "localhost" && u.Hostname() != "127.0.0.1" {
+			errs["redirect_uris"] = append(errs["redirect_uris"], "Redirect URI must use HTTPS: "+redirectURI)
+		}
+	}
+
+	return errs
+}
+
+type CreateOAuthClientResponse struct {
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret,omitempty"`
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Scopes       []string `json:"scopes,omitempty"`
+}
+
+// AuthorizeRequest holds the parameters of an OAuth2 authorization request,
+// read from the query on GET and from the consent form on POST.
+type AuthorizeRequest struct {
+	ResponseType        string `query:"response_type" form:"response_type"`
+	ClientID            string `query:"client_id" form:"client_id"`
+	RedirectURI         string `query:"redirect_uri" form:"redirect_uri"`
+	Scope               string `query:"scope" form:"scope"`
+	State               string `query:"state" form:"state"`
+	CodeChallenge       string `query:"code_challenge" form:"code_challenge"`
+	CodeChallengeMethod string `query:"code_challenge_method" form:"code_challenge_method"`
+
+	// Filled in by the consent form only
+	PhoneNumber string `form:"phone_number"`
+	Password    string `form:"password"`
+	// Code or RecoveryCode is required from users with TOTP enabled
+	Code         string `form:"code"`
+	RecoveryCode string `form:"recovery_code"`
+	Decision     string `form:"decision"`
+}
+
+type OAuthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+	IDToken     string `json:"id_token,omitempty"`
+}
+
+// OAuthErrorResponse is the error format mandated by RFC 6749 for the token endpoint.
+type OAuthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// IntrospectionResponse follows RFC 7662, an inactive token only has active set.
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Sub       string `json:"sub,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Iss       string `json:"iss,omitempty"`
+}
+
+type AssignRoleRequest struct {
+	Role string `json:"role"`
+}
+
+type UserRolesResponse struct {
+	Roles []string `json:"roles"`
+}
+
+type ListUsersRequest struct {
+	PhonePrefix string `query:"phone_prefix"`
+	Name        string `query:"name"`
+	// CreatedFrom and CreatedTo are inclusive dates in DateLayout
+	CreatedFrom string `query:"created_from"`
+	CreatedTo   string `query:"created_to"`
+	Page        int    `query:"page"`
+	PerPage     int    `query:"per_page"`
+}
+
+func (listRequest *ListUsersRequest) Validate() map[string][]string {
+	errs := make(map[string][]string)
+
+	if listRequest.CreatedFrom != "" {
+		_, err := time.Parse(DateLayout, listRequest.CreatedFrom)
+		if err != nil {
+			errs["created_from"] = append(errs["created_from"], "Created from must be a date formatted as YYYY-MM-DD")
+		}
+	}
+
+	if listRequest.CreatedTo != "" {
+		_, err := time.Parse(DateLayout, listRequest.CreatedTo)
+		if err != nil {
+			errs["created_to"] = append(errs["created_to"], "Created to must be a date formatted as YYYY-MM-DD")
+		}
+	}
+
+	if listRequest.Page < 0 {
+		errs["page"] = append(errs["page"], "Page must be at minimum 1")
+	}
+
+	if listRequest.PerPage < 0 || listRequest.PerPage > MaxPerPage {
+		errs["per_page"] = append(errs["per_page"], "Per page must be at minimum 1 and maximum 100")
+	}
+
+	return errs
+}
+
+type AdminUserResponse struct {
+	ID          int64     `json:"id"`
+	PhoneNumber string    `json:"phone_number"`
+	FullName    string    `json:"full_name"`
+	EstateID    *int64    `json:"estate_id,omitempty"`
+	Roles       []string  `json:"roles,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	Disabled    bool      `json:"disabled"`
+}
+
+type ListUsersResponse struct {
+	Users   []AdminUserResponse `json:"users"`
+	Page    int                 `json:"page"`
+	PerPage int                 `json:"per_page"`
+	Total   int64               `json:"total"`
+}
+
+type SessionResponse struct {
+	ID         string    `json:"id"`
+	Method     string    `json:"method"`
+	IPAddress  string    `json:"ip_address"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	// Current is set on the session of the token that listed the sessions
+	Current bool `json:"current"`
+}
+
+type ListSessionsResponse struct {
+	Sessions []SessionResponse `json:"sessions"`
+}
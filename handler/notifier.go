@@ -0,0 +1,22 @@
+package handler
+
+import (
+	"context"
+
+	"github.com/SawitProRecruitment/UserService/repository/entity"
+)
+
+// Notifier delivers account notifications to users.
+type Notifier interface {
+	// NotifyPasswordReset delivers the code the user resets their password with
+	NotifyPasswordReset(ctx context.Context, user *entity.UserData, code string) error
+}
+
+// SMSNotifier texts notifications to the phone number of the user.
+type SMSNotifier struct {
+	SMS SMSSender
+}
+
+func (notifier *SMSNotifier) NotifyPasswordReset(ctx context.Context, user *entity.UserData, code string) error {
+	return notifier.SMS.SendSMS(ctx, user.PhoneNumber, "Your "+ServiceName+" password reset code is "+code)
+}
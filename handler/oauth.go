@@ -0,0 +1,663 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SawitProRecruitment/UserService/handler/models"
+	"github.com/SawitProRecruitment/UserService/repository/entity"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const AuthorizationCodeTTL = 5 * time.Minute
+
+// SupportedScopes are the scopes a client may request from a user
+var SupportedScopes = []string{"openid", "profile", "phone"}
+
+var consentTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Authorize {{.ClientName}}</title></head>
+<body>
+<h1>{{.ClientName}} wants to access your account</h1>
+{{if .Scopes}}<p>Requested access:</p>
+<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>{{end}}
+{{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+<form method="POST" action="/authorize">
+<input type="hidden" name="response_type" value="{{.Request.ResponseType}}">
+<input type="hidden" name="client_id" value="{{.Request.ClientID}}">
+<input type="hidden" name="redirect_uri" value="{{.Request.RedirectURI}}">
+<input type="hidden" name="scope" value="{{.Request.Scope}}">
+<input type="hidden" name="state" value="{{.Request.State}}">
+<input type="hidden" name="code_challenge" value="{{.Request.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="{{.Request.CodeChallengeMethod}}">
+<p><label>Phone number <input type="tel" name="phone_number" value="{{.Request.PhoneNumber}}"></label></p>
+<p><label>Password <input type="password" name="password"></label></p>
+<p>If two-factor authentication is enabled:</p>
+<p><label>Authenticator code <input type="text" name="code" inputmode="numeric" autocomplete="one-time-code"></label></p>
+<p><label>Or recovery code <input type="text" name="recovery_code" autocomplete="off"></label></p>
+<button type="submit" name="decision" value="allow">Allow</button>
+<button type="submit" name="decision" value="deny">Deny</button>
+</form>
+</body>
+</html>
+`))
+
+func (server *Server) CreateOAuthClient(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	id := CurrentPrincipal(c).UserID
+
+	clientRequest := &models.CreateOAuthClientRequest{}
+
+	err := c.Bind(clientRequest)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to read request",
+			Error:   err.Error(),
+		})
+	}
+
+	errs := clientRequest.Validate()
+	if len(errs) > 0 {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Invalid request",
+			Error:   errs,
+		})
+	}
+
+	clientID, err := randomString(16)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to generate client ID",
+			Error:   err.Error(),
+		})
+	}
+
+	client := &entity.OAuthClient{
+		ClientID:     clientID,
+		Name:         clientRequest.Name,
+		RedirectURIs: clientRequest.RedirectURIs,
+		Scopes:       clientRequest.Scopes,
+		CreatedBy:    id,
+	}
+
+	// The secret is only shown once, only its hash is stored
+	var clientSecret string
+	if clientRequest.Confidential {
+		clientSecret, err = randomString(32)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Message: "Failed to generate client secret",
+				Error:   err.Error(),
+			})
+		}
+
+		client.ClientSecretHash, err = HashClientSecret(clientSecret)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Message: "Failed to generate hashed client secret",
+				Error:   err.Error(),
+			})
+		}
+	}
+
+	err = server.Repository.CreateOAuthClient(ctx, client)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to register client",
+			Error:   err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, models.CreateOAuthClientResponse{
+		ClientID:     client.ClientID,
+		ClientSecret: clientSecret,
+		Name:         client.Name,
+		RedirectURIs: client.RedirectURIs,
+		Scopes:       client.Scopes,
+	})
+}
+
+// Authorize shows the consent page of the authorization code flow.
+func (server *Server) Authorize(c echo.Context) error {
+	authorizeRequest := &models.AuthorizeRequest{}
+
+	err := c.Bind(authorizeRequest)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to read request",
+			Error:   err.Error(),
+		})
+	}
+
+	client, redirectURI, ok, err := server.validateAuthorizeRequest(c, authorizeRequest)
+	if !ok {
+		return err
+	}
+
+	if authorizeRequest.Decision == "" {
+		return renderConsent(c, http.StatusOK, client, authorizeRequest, "")
+	}
+
+	if authorizeRequest.Decision != "allow" {
+		return redirectWithParams(c, redirectURI, url.Values{
+			"error": {"access_denied"},
+			"state": {authorizeRequest.State},
+		})
+	}
+
+	ctx := c.Request().Context()
+
+	// Logins here count towards the same lockouts as LoginUser
+	locked, err := server.loginLocked(c, LockoutScopeIP, clientIP(c))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to check failed logins",
+			Error:   err.Error(),
+		})
+	}
+	if locked {
+		return renderConsent(c, http.StatusLocked, client, authorizeRequest, "Too many failed logins, try again later")
+	}
+
+	user, err := server.Repository.GetUser(ctx, &entity.UserFilter{
+		PhoneNumber: &authorizeRequest.PhoneNumber,
+	})
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get user",
+			Error:   err.Error(),
+		})
+	}
+
+	if user != nil {
+		locked, err = server.loginLocked(c, LockoutScopeAccount, strconv.FormatInt(user.ID, 10))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Message: "Failed to check failed logins",
+				Error:   err.Error(),
+			})
+		}
+		if locked {
+			return renderConsent(c, http.StatusLocked, client, authorizeRequest, "Too many failed logins, try again later")
+		}
+	}
+
+	if user == nil || server.Passwords.ValidatePassword(authorizeRequest.Password, user.LegacyPasswordSalt, user.Password) != nil {
+		err = server.recordFailedLogin(c, user)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Message: "Failed to record failed login",
+				Error:   err.Error(),
+			})
+		}
+
+		return renderConsent(c, http.StatusForbidden, client, authorizeRequest, "Invalid phone number or password")
+	}
+
+	if user.DisabledAt != nil {
+		return renderConsent(c, http.StatusForbidden, client, authorizeRequest, "User is disabled")
+	}
+
+	// Users with TOTP enabled need their second factor here as well, the
+	// client gets no chance to run the MFA challenge of LoginUser
+	enrolled, err := server.Repository.GetTOTP(ctx, user.ID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get TOTP",
+			Error:   err.Error(),
+		})
+	}
+	if enrolled != nil && enrolled.ConfirmedAt != nil {
+		if authorizeRequest.Code == "" && authorizeRequest.RecoveryCode == "" {
+			return renderConsent(c, http.StatusUnauthorized, client, authorizeRequest, "Enter the code from your authenticator app or a recovery code")
+		}
+
+		_, rejection, err := server.verifySecondFactor(ctx, user.ID, enrolled, authorizeRequest.Code, authorizeRequest.RecoveryCode)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Message: "Failed to verify code",
+				Error:   err.Error(),
+			})
+		}
+		if rejection != "" {
+			// Wrong codes count like wrong passwords, so they cannot be guessed
+			err = server.recordFailedLogin(c, user)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+					Message: "Failed to record failed login",
+					Error:   err.Error(),
+				})
+			}
+
+			return renderConsent(c, http.StatusForbidden, client, authorizeRequest, rejection)
+		}
+	}
+
+	err = server.clearLoginFailures(c, user.ID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to clear failed logins",
+			Error:   err.Error(),
+		})
+	}
+
+	err = server.upgradePasswordHash(ctx, user, authorizeRequest.Password)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to upgrade password hash",
+			Error:   err.Error(),
+		})
+	}
+
+	code, err := randomString(32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to generate authorization code",
+			Error:   err.Error(),
+		})
+	}
+
+	// The original redirect URI is stored since the token request has to repeat
+	// it exactly, including leaving it out
+	err = server.Repository.CreateAuthorizationCode(ctx, &entity.AuthorizationCode{
+		CodeHash:      HashToken(code),
+		ClientID:      client.ClientID,
+		UserID:        user.ID,
+		RedirectURI:   authorizeRequest.RedirectURI,
+		Scope:         authorizeRequest.Scope,
+		CodeChallenge: authorizeRequest.CodeChallenge,
+		ExpiresAt:     time.Now().Add(AuthorizationCodeTTL),
+	})
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to store authorization code",
+			Error:   err.Error(),
+		})
+	}
+
+	return redirectWithParams(c, redirectURI, url.Values{
+		"code":  {code},
+		"state": {authorizeRequest.State},
+	})
+}
+
+// validateAuthorizeRequest checks the client and redirect URI first, as errors
+// about those must not be sent to the redirect URI. Any other error is sent to
+// the client through the redirect URI. When the request is invalid the response
+// has already been written and ok is false.
+func (server *Server) validateAuthorizeRequest(c echo.Context, authorizeRequest *models.AuthorizeRequest) (client *entity.OAuthClient, redirectURI string, ok bool, err error) {
+	client, err = server.Repository.GetOAuthClient(c.Request().Context(), authorizeRequest.ClientID)
+	if err != nil {
+		return nil, "", false, c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get client",
+			Error:   err.Error(),
+		})
+	}
+	if client == nil {
+		return nil, "", false, c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Unknown client",
+		})
+	}
+
+	redirectURI = authorizeRequest.RedirectURI
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !containsString(client.RedirectURIs, redirectURI) {
+		return nil, "", false, c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Redirect URI is not registered for this client",
+		})
+	}
+
+	redirectError := func(code, description string) error {
+		return redirectWithParams(c, redirectURI, url.Values{
+			"error":             {code},
+			"error_description": {description},
+			"state":             {authorizeRequest.State},
+		})
+	}
+
+	if authorizeRequest.ResponseType != "code" {
+		return nil, "", false, redirectError("unsupported_response_type", "Only the code response type is supported")
+	}
+
+	// PKCE is mandatory since clients are public and hold no secret
+	if authorizeRequest.CodeChallenge == "" || authorizeRequest.CodeChallengeMethod != "S256" {
+		return nil, "", false, redirectError("invalid_request", "A S256 code challenge is required")
+	}
+
+	for _, scope := range strings.Fields(authorizeRequest.Scope) {
+		if !containsString(SupportedScopes, scope) {
+			return nil, "", false, redirectError("invalid_scope", "Unsupported scope: "+scope)
+		}
+	}
+
+	return client, redirectURI, true, nil
+}
+
+// Token is the OAuth2 token endpoint.
+func (server *Server) Token(c echo.Context) error {
+	switch c.FormValue("grant_type") {
+	case "authorization_code":
+		return server.exchangeAuthorizationCode(c)
+	case "client_credentials":
+		return server.exchangeClientCredentials(c)
+	default:
+		return c.JSON(http.StatusBadRequest, models.OAuthErrorResponse{
+			Error: "unsupported_grant_type",
+		})
+	}
+}
+
+func (server *Server) exchangeAuthorizationCode(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	invalidGrant := func(description string) error {
+		return c.JSON(http.StatusBadRequest, models.OAuthErrorResponse{
+			Error:            "invalid_grant",
+			ErrorDescription: description,
+		})
+	}
+
+	// Public clients only identify themselves, confidential ones must authenticate
+	client, ok, err := server.authenticateClient(c, false)
+	if !ok {
+		return err
+	}
+
+	code, err := server.Repository.ConsumeAuthorizationCode(ctx, HashToken(c.FormValue("code")))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, models.OAuthErrorResponse{
+			Error:            "server_error",
+			ErrorDescription: err.Error(),
+		})
+	}
+	if code == nil {
+		return invalidGrant("Authorization code is invalid, expired or already used")
+	}
+
+	if code.ClientID != client.ClientID || code.RedirectURI != c.FormValue("redirect_uri") {
+		return invalidGrant("Authorization code was issued to another client or redirect URI")
+	}
+
+	if !VerifyCodeChallenge(c.FormValue("code_verifier"), code.CodeChallenge) {
+		return invalidGrant("Code verifier does not match the code challenge")
+	}
+
+	// The user may have been disabled since the code was issued
+	user, err := server.Repository.GetUser(ctx, &entity.UserFilter{
+		ID: &code.UserID,
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, models.OAuthErrorResponse{
+			Error:            "server_error",
+			ErrorDescription: err.Error(),
+		})
+	}
+	if user == nil {
+		return invalidGrant("User no longer exists")
+	}
+	if user.DisabledAt != nil {
+		return invalidGrant("User is disabled")
+	}
+
+	accessToken, err := server.JWT.GenerateClientToken(code.UserID, code.ClientID, code.Scope)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, models.OAuthErrorResponse{
+			Error:            "server_error",
+			ErrorDescription: err.Error(),
+		})
+	}
+
+	tokenResponse := models.OAuthTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(AccessTokenTTL.Seconds()),
+		Scope:       code.Scope,
+	}
+
+	if containsString(strings.Fields(code.Scope), "openid") {
+		tokenResponse.IDToken, err = server.JWT.GenerateClientIDToken(user, code.ClientID, code.Scope)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, models.OAuthErrorResponse{
+				Error:            "server_error",
+				ErrorDescription: err.Error(),
+			})
+		}
+	}
+
+	c.Response().Header().Set("Cache-Control", "no-store")
+
+	return c.JSON(http.StatusOK, tokenResponse)
+}
+
+func (server *Server) exchangeClientCredentials(c echo.Context) error {
+	client, ok, err := server.authenticateClient(c, true)
+	if !ok {
+		return err
+	}
+
+	// Without a requested scope the client gets every scope it was given
+	scopes := strings.Fields(c.FormValue("scope"))
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+
+	for _, scope := range scopes {
+		if !containsString(client.Scopes, scope) {
+			return c.JSON(http.StatusBadRequest, models.OAuthErrorResponse{
+				Error:            "invalid_scope",
+				ErrorDescription: "Scope is not allowed for this client: " + scope,
+			})
+		}
+	}
+	scope := strings.Join(scopes, " ")
+
+	accessToken, err := server.JWT.GenerateServiceToken(client.ClientID, scope)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, models.OAuthErrorResponse{
+			Error:            "server_error",
+			ErrorDescription: err.Error(),
+		})
+	}
+
+	c.Response().Header().Set("Cache-Control", "no-store")
+
+	return c.JSON(http.StatusOK, models.OAuthTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(AccessTokenTTL.Seconds()),
+		Scope:       scope,
+	})
+}
+
+// Introspect implements RFC 7662 token introspection for confidential clients.
+func (server *Server) Introspect(c echo.Context) error {
+	_, ok, err := server.authenticateClient(c, true)
+	if !ok {
+		return err
+	}
+
+	c.Response().Header().Set("Cache-Control", "no-store")
+
+	// Any token that fails validation, including revoked ones, is inactive
+	claims, err := server.JWT.ParseToken(c.Request().Context(), c.FormValue("token"))
+	if err != nil {
+		return c.JSON(http.StatusOK, models.IntrospectionResponse{
+			Active: false,
+		})
+	}
+
+	// Tokens of disabled users are inactive, even those issued to clients
+	// that were not revoked on disable
+	if userID, err := claims.UserID(); err == nil {
+		active, err := server.userActive(c.Request().Context(), userID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, models.OAuthErrorResponse{
+				Error:            "server_error",
+				ErrorDescription: err.Error(),
+			})
+		}
+		if !active {
+			return c.JSON(http.StatusOK, models.IntrospectionResponse{
+				Active: false,
+			})
+		}
+	}
+
+	introspection := models.IntrospectionResponse{
+		Active:    true,
+		TokenType: "Bearer",
+		Scope:     strings.Join(claims.Scopes(), " "),
+		ClientID:  claims.ClientID,
+		Sub:       claims.Subject,
+		Iss:       claims.Issuer,
+		Exp:       claims.ExpiresAt,
+		Iat:       claims.IssuedAt,
+	}
+
+	return c.JSON(http.StatusOK, introspection)
+}
+
+// authenticateClient identifies the client of a token request, either with
+// HTTP Basic authentication or with client_id and client_secret form values.
+// Confidential clients must always present their secret, public clients are
+// only accepted when requireSecret is false. When the client cannot be
+// authenticated the response has already been written and ok is false.
+func (server *Server) authenticateClient(c echo.Context, requireSecret bool) (client *entity.OAuthClient, ok bool, err error) {
+	clientID, clientSecret, basicAuth := c.Request().BasicAuth()
+	if basicAuth {
+		// Credentials are form encoded before being put in the header
+		clientID, err = url.QueryUnescape(clientID)
+		if err == nil {
+			clientSecret, err = url.QueryUnescape(clientSecret)
+		}
+		if err != nil {
+			clientID, clientSecret = "", ""
+		}
+	} else {
+		clientID = c.FormValue("client_id")
+		clientSecret = c.FormValue("client_secret")
+	}
+
+	invalidClient := func() (*entity.OAuthClient, bool, error) {
+		if basicAuth {
+			c.Response().Header().Set("WWW-Authenticate", `Basic realm="token"`)
+		}
+
+		return nil, false, c.JSON(http.StatusUnauthorized, models.OAuthErrorResponse{
+			Error:            "invalid_client",
+			ErrorDescription: "Client authentication failed",
+		})
+	}
+
+	if clientID == "" {
+		return invalidClient()
+	}
+
+	client, err = server.Repository.GetOAuthClient(c.Request().Context(), clientID)
+	if err != nil {
+		return nil, false, c.JSON(http.StatusInternalServerError, models.OAuthErrorResponse{
+			Error:            "server_error",
+			ErrorDescription: err.Error(),
+		})
+	}
+	if client == nil {
+		return invalidClient()
+	}
+
+	if client.ClientSecretHash == "" {
+		if requireSecret || clientSecret != "" {
+			return invalidClient()
+		}
+
+		return client, true, nil
+	}
+
+	if ValidateClientSecret(clientSecret, client.ClientSecretHash) != nil {
+		return invalidClient()
+	}
+
+	return client, true, nil
+}
+
+// VerifyCodeChallenge checks a PKCE code verifier against its S256 challenge.
+func VerifyCodeChallenge(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+
+	hash := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(hash[:])
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+func HashClientSecret(clientSecret string) (string, error) {
+	hashedSecret, err := bcrypt.GenerateFromPassword([]byte(clientSecret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hashedSecret), nil
+}
+
+func ValidateClientSecret(clientSecret, hashedSecret string) error {
+	return bcrypt.CompareHashAndPassword([]byte(hashedSecret), []byte(clientSecret))
+}
+
+func renderConsent(c echo.Context, status int, client *entity.OAuthClient, authorizeRequest *models.AuthorizeRequest, errMessage string) error {
+	var page strings.Builder
+
+	err := consentTemplate.Execute(&page, map[string]interface{}{
+		"ClientName": client.Name,
+		"Scopes":     strings.Fields(authorizeRequest.Scope),
+		"Request":    authorizeRequest,
+		"Error":      errMessage,
+	})
+	if err != nil {
+		return err
+	}
+
+	// The page asks for credentials, so it must never be framed by another site
+	c.Response().Header().Set("X-Frame-Options", "DENY")
+	c.Response().Header().Set("Cache-Control", "no-store")
+
+	return c.HTML(status, page.String())
+}
+
+func redirectWithParams(c echo.Context, redirectURI string, params url.Values) error {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return err
+	}
+
+	query := u.Query()
+	for key, values := range params {
+		if len(values) > 0 && values[0] != "" {
+			query.Set(key, values[0])
+		}
+	}
+	u.RawQuery = query.Encode()
+
+	return c.Redirect(http.StatusFound, u.String())
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/SawitProRecruitment/UserService/handler/models"
+	"github.com/SawitProRecruitment/UserService/repository/entity"
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+)
+
+// GetOpenIDConfiguration serves the OpenID Connect discovery document.
+func (server *Server) GetOpenIDConfiguration(c echo.Context) error {
+	issuer := server.JWT.Issuer()
+
+	return c.JSON(http.StatusOK, models.OpenIDConfigurationResponse{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/authorize",
+		TokenEndpoint:                     issuer + "/token",
+		IntrospectionEndpoint:             issuer + "/introspect",
+		JWKSURI:                           issuer + "/.well-known/jwks.json",
+		UserinfoEndpoint:                  issuer + "/userinfo",
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "client_credentials"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		TokenEndpointAuthMethodsSupported: []string{"none", "client_secret_basic", "client_secret_post"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{jwt.SigningMethodRS256.Alg()},
+		ScopesSupported:                   SupportedScopes,
+		ClaimsSupported:                   []string{"sub", "iss", "aud", "exp", "iat", "name", "phone_number", "phone_number_verified"},
+	})
+}
+
+func (server *Server) GetUserinfo(c echo.Context) error {
+	user, err := server.Repository.GetUser(c.Request().Context(), &entity.UserFilter{
+		ID: &CurrentPrincipal(c).UserID,
+	})
+	if err != nil {
+		return c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: "Failed to get user",
+			Error:   err.Error(),
+		})
+	}
+	if user == nil {
+		return c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Message: "User not found",
+		})
+	}
+
+	// Clients get the claims their scopes grant, the user's own tokens all
+	principal := CurrentPrincipal(c)
+	scopes := SupportedScopes
+	if principal.ClientID != "" {
+		scopes = principal.Scopes
+	}
+
+	userinfo := models.UserinfoResponse{
+		Sub: strconv.FormatInt(user.ID, 10),
+	}
+	if containsString(scopes, "profile") {
+		userinfo.Name = user.FullName
+	}
+	if containsString(scopes, "phone") {
+		phoneVerified := user.PhoneVerified
+		userinfo.PhoneNumber = user.PhoneNumber
+		userinfo.PhoneNumberVerified = &phoneVerified
+	}
+
+	return c.JSON(http.StatusOK, userinfo)
+}
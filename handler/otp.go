@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SawitProRecruitment/UserService/handler/models"
+	"github.com/SawitProRecruitment/UserService/repository/entity"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	OTPTTL = 5 * time.Minute
+	// OTPSendLimit codes can be sent to a phone number, and OTPSendLimitPerIP
+	// codes can be requested from an IP address, for the same purpose within
+	// OTPSendWindow
+	OTPSendLimit      = 3
+	OTPSendLimitPerIP = 10
+	OTPSendWindow     = 15 * time.Minute
+	// OTPMaxAttempts wrong codes can be entered before a new one is needed
+	OTPMaxAttempts = 5
+
+	otpDigits = 6
+)
+
+// Purposes of one-time codes, a code sent for one cannot be used for another
+const (
+	OTPPurposePhoneVerification = "phone_verification"
+	OTPPurposeLogin             = "login"
+	OTPPurposePasswordReset     = "password_reset"
+)
+
+// GenerateOTP returns a random numeric code.
+func GenerateOTP() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < otpDigits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%0*d", otpDigits, n), nil
+}
+
+// sendOTP texts a new one-time code for the purpose to the phone number. The
+// message is formatted with the code. When no code was sent the response has
+// already been written and ok is false.
+func (server *Server) sendOTP(c echo.Context, phoneNumber, purpose, message string) (ok bool, err error) {
+	code, ok, err := server.issueOTP(c, phoneNumber, purpose)
+	if !ok {
+		return false, err
+	}
+
+	err = server.SMS.SendSMS(c.Request().Context(), phoneNumber, fmt.Sprintf(message, code))
+	if err != nil {
+		return false, c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to send code",
+			Error:   err.Error(),
+		})
+	}
+
+	return true, nil
+}
+
+// otpSendLimited tells whether too many codes for the purpose were sent to
+// the phone number or requested from the IP address recently. It is checked
+// before sendOTP and issueOTP, which always issue a code.
+func (server *Server) otpSendLimited(c echo.Context, phoneNumber, purpose string) (bool, error) {
+	ctx := c.Request().Context()
+
+	sent, err := server.Repository.CountOTPs(ctx, phoneNumber, purpose, time.Now().Add(-OTPSendWindow))
+	if err != nil {
+		return false, err
+	}
+	if sent >= OTPSendLimit {
+		return true, nil
+	}
+
+	requested, err := server.Repository.CountOTPsByIP(ctx, clientIP(c), purpose, time.Now().Add(-OTPSendWindow))
+	if err != nil {
+		return false, err
+	}
+
+	return requested >= OTPSendLimitPerIP, nil
+}
+
+// issueOTP stores a new one-time code for the purpose and phone number and
+// returns it to be delivered. When no code was issued the response has
+// already been written and ok is false.
+func (server *Server) issueOTP(c echo.Context, phoneNumber, purpose string) (code string, ok bool, err error) {
+	ctx := c.Request().Context()
+
+	code, err = GenerateOTP()
+	if err != nil {
+		return "", false, c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to generate code",
+			Error:   err.Error(),
+		})
+	}
+
+	// Codes are short, so they get a slow hash like passwords
+	codeHash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+	if err != nil {
+		return "", false, c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to hash code",
+			Error:   err.Error(),
+		})
+	}
+
+	err = server.Repository.CreateOTP(ctx, &entity.OTP{
+		PhoneNumber: phoneNumber,
+		Purpose:     purpose,
+		CodeHash:    string(codeHash),
+		IPAddress:   clientIP(c),
+		ExpiresAt:   time.Now().Add(OTPTTL),
+	})
+	if err != nil {
+		return "", false, c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to save code",
+			Error:   err.Error(),
+		})
+	}
+
+	return code, true, nil
+}
+
+func otpSendLimitReached(c echo.Context) error {
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(OTPSendWindow.Seconds())))
+
+	return c.JSON(http.StatusTooManyRequests, models.ErrorResponse{
+		Message: "Too many codes requested, try again later",
+	})
+}
+
+// verifyOTP checks the code against the latest one sent to the phone number
+// for the purpose and marks it as used. When the code is not valid the
+// response has already been written and ok is false.
+func (server *Server) verifyOTP(c echo.Context, phoneNumber, purpose, code string) (ok bool, err error) {
+	ctx := c.Request().Context()
+
+	otp, err := server.Repository.GetActiveOTP(ctx, phoneNumber, purpose)
+	if err != nil {
+		return false, c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get code",
+			Error:   err.Error(),
+		})
+	}
+	if otp == nil {
+		return false, c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: "Invalid or expired code",
+		})
+	}
+
+	// The guess is counted before the code is compared, so concurrent guesses
+	// cannot get past the limit
+	allowed, err := server.Repository.UseOTPAttempt(ctx, otp.ID, OTPMaxAttempts)
+	if err != nil {
+		return false, c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to verify code",
+			Error:   err.Error(),
+		})
+	}
+	if !allowed {
+		return false, c.JSON(http.StatusTooManyRequests, models.ErrorResponse{
+			Message: "Too many wrong codes, request a new one",
+		})
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(otp.CodeHash), []byte(code)) != nil {
+		return false, c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: "Invalid or expired code",
+		})
+	}
+
+	consumed, err := server.Repository.ConsumeOTP(ctx, otp.ID)
+	if err != nil {
+		return false, c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to verify code",
+			Error:   err.Error(),
+		})
+	}
+	if !consumed {
+		return false, c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: "Invalid or expired code",
+		})
+	}
+
+	return true, nil
+}
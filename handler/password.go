@@ -1,23 +1,267 @@
 package handler
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
 
-func ValidatePassword(password, phoneNumber, hashedPassword string) error {
-	// Concatenate the password and phone number to add uniqueness
-	passwordWithSalt := password + phoneNumber
+	"github.com/SawitProRecruitment/UserService/handler/models"
+	"github.com/SawitProRecruitment/UserService/repository/entity"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
 
-	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(passwordWithSalt))
+// ErrPasswordMismatch is returned when a password does not match its hash
+var ErrPasswordMismatch = errors.New("password does not match")
+
+// Argon2Params tune the cost of argon2id password hashes.
+type Argon2Params struct {
+	// Memory in KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params follow the second recommended option of RFC 9106 with
+// a little more parallelism.
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+var phcEncoding = base64.RawStdEncoding
+
+type PasswordHasher struct {
+	params  Argon2Params
+	peppers map[int][]byte
+	// pepperVersion is the pepper new hashes use, 0 without peppers
+	pepperVersion int
 }
 
-func HashPassword(password, phoneNumber string) (string, error) {
-	// Concatenate the password and phone number to add uniqueness
-	passwordWithSalt := password + phoneNumber
+type NewPasswordHasherOptions struct {
+	// Params default to DefaultArgon2Params when zero
+	Params Argon2Params
+	// Peppers are secrets by version that passwords are mixed with before
+	// hashing, so the hashes alone cannot be cracked. New hashes use the
+	// highest version, older ones stay valid until users log in again.
+	Peppers map[int][]byte
+}
+
+func NewPasswordHasher(opts NewPasswordHasherOptions) *PasswordHasher {
+	params := opts.Params
+	if params == (Argon2Params{}) {
+		params = DefaultArgon2Params
+	}
 
-	// Generate salted hash of the password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(passwordWithSalt), bcrypt.DefaultCost)
+	pepperVersion := 0
+	for version := range opts.Peppers {
+		if version > pepperVersion {
+			pepperVersion = version
+		}
+	}
+
+	return &PasswordHasher{
+		params:        params,
+		peppers:       opts.Peppers,
+		pepperVersion: pepperVersion,
+	}
+}
+
+// HashPassword hashes the password with argon2id and a random salt, encoded
+// in the PHC string format so the parameters can change later. The version
+// of the pepper is recorded as the keyid parameter.
+func (hasher *PasswordHasher) HashPassword(password string) (string, error) {
+	salt := make([]byte, hasher.params.SaltLength)
+
+	_, err := rand.Read(salt)
 	if err != nil {
 		return "", err
 	}
 
-	return string(hashedPassword), nil
+	peppered, err := hasher.pepper(password, hasher.pepperVersion)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey(peppered, salt, hasher.params.Iterations, hasher.params.Memory, hasher.params.Parallelism, hasher.params.KeyLength)
+
+	params := fmt.Sprintf("m=%d,t=%d,p=%d", hasher.params.Memory, hasher.params.Iterations, hasher.params.Parallelism)
+	if hasher.pepperVersion != 0 {
+		params += fmt.Sprintf(",keyid=%d", hasher.pepperVersion)
+	}
+
+	return fmt.Sprintf("$argon2id$v=%d$%s$%s$%s",
+		argon2.Version, params, phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key)), nil
+}
+
+// pepper mixes the password with the pepper of the version using HMAC.
+// Version 0 leaves the password as it is.
+func (hasher *PasswordHasher) pepper(password string, version int) ([]byte, error) {
+	if version == 0 {
+		return []byte(password), nil
+	}
+
+	secret, ok := hasher.peppers[version]
+	if !ok {
+		return nil, fmt.Errorf("unknown pepper version %d", version)
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(password))
+
+	return mac.Sum(nil), nil
+}
+
+// ValidatePassword checks the password against an argon2id or bcrypt hash.
+// Hashes made before the salt was decoupled from the phone number were
+// salted with the phone number at the time, which is passed as legacySalt.
+// Current hashes have no legacy salt.
+func (hasher *PasswordHasher) ValidatePassword(password, legacySalt, hashedPassword string) error {
+	if !strings.HasPrefix(hashedPassword, "$argon2id$") {
+		err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password+legacySalt))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrPasswordMismatch
+		}
+
+		return err
+	}
+
+	params, pepperVersion, salt, key, err := decodeArgon2Hash(hashedPassword)
+	if err != nil {
+		return err
+	}
+
+	peppered, err := hasher.pepper(password, pepperVersion)
+	if err != nil {
+		return err
+	}
+
+	actual := argon2.IDKey(peppered, salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	if subtle.ConstantTimeCompare(actual, key) != 1 {
+		return ErrPasswordMismatch
+	}
+
+	return nil
+}
+
+// NeedsRehash tells whether the hash was made with another algorithm, other
+// parameters or another pepper than HashPassword uses now.
+func (hasher *PasswordHasher) NeedsRehash(legacySalt, hashedPassword string) bool {
+	if legacySalt != "" {
+		return true
+	}
+
+	params, pepperVersion, _, _, err := decodeArgon2Hash(hashedPassword)
+	if err != nil {
+		return true
+	}
+
+	return params != hasher.params || pepperVersion != hasher.pepperVersion
+}
+
+// decodeArgon2Hash parses a hash made by HashPassword.
+func decodeArgon2Hash(hashedPassword string) (params Argon2Params, pepperVersion int, salt, key []byte, err error) {
+	parts := strings.Split(hashedPassword, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return params, 0, nil, nil, fmt.Errorf("not an argon2id hash")
+	}
+
+	var version int
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return params, 0, nil, nil, fmt.Errorf("invalid argon2id version: %w", err)
+	}
+	if version != argon2.Version {
+		return params, 0, nil, nil, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+
+	paramsPart := parts[3]
+
+	// The pepper version is optional, hashes made without a pepper have none
+	if i := strings.Index(paramsPart, ",keyid="); i >= 0 {
+		pepperVersion, err = strconv.Atoi(paramsPart[i+len(",keyid="):])
+		if err != nil || pepperVersion <= 0 {
+			return params, 0, nil, nil, fmt.Errorf("invalid argon2id pepper version")
+		}
+		paramsPart = paramsPart[:i]
+	}
+
+	_, err = fmt.Sscanf(paramsPart, "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return params, 0, nil, nil, fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+
+	salt, err = phcEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, 0, nil, nil, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+
+	key, err = phcEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, 0, nil, nil, fmt.Errorf("invalid argon2id key: %w", err)
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	return params, pepperVersion, salt, key, nil
+}
+
+// upgradePasswordHash re-hashes the password with the current algorithm and
+// parameters once the user proved they know it.
+func (server *Server) upgradePasswordHash(ctx context.Context, user *entity.UserData, password string) error {
+	if !server.Passwords.NeedsRehash(user.LegacyPasswordSalt, user.Password) {
+		return nil
+	}
+
+	hashedPassword, err := server.Passwords.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	err = server.Repository.UpdatePassword(ctx, user.ID, hashedPassword)
+	if err != nil {
+		return err
+	}
+
+	user.Password = hashedPassword
+	user.LegacyPasswordSalt = ""
+
+	return nil
+}
+
+// checkPasswordStrength rejects a new password that was breached or is too
+// easy to guess, reporting it under the field of the request. When the
+// password is rejected the response has already been written and ok is false.
+func (server *Server) checkPasswordStrength(c echo.Context, field, password string) (ok bool, err error) {
+	if server.PasswordStrength == nil {
+		return true, nil
+	}
+
+	errs, err := server.PasswordStrength.Check(password)
+	if err != nil {
+		return false, err
+	}
+	if len(errs) > 0 {
+		return false, c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Invalid request",
+			Error:   map[string][]string{field: errs},
+		})
+	}
+
+	return true, nil
 }
@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/SawitProRecruitment/UserService/handler/models"
+	"github.com/SawitProRecruitment/UserService/repository/entity"
+	"github.com/labstack/echo/v4"
+)
+
+// ForgotPassword sends a password reset code to the user through the
+// notifier. Like StartSMSLogin, the response does not tell whether the phone
+// number is registered.
+func (server *Server) ForgotPassword(c echo.Context) error {
+	ctx := c.Request().Context()
+	forgotRequest := &models.ForgotPasswordRequest{}
+
+	err := c.Bind(forgotRequest)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to read request",
+			Error:   err.Error(),
+		})
+	}
+
+	errs := forgotRequest.Validate()
+	if len(errs) > 0 {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Invalid request",
+			Error:   errs,
+		})
+	}
+
+	user, err := server.Repository.GetUser(ctx, &entity.UserFilter{
+		PhoneNumber: &forgotRequest.PhoneNumber,
+	})
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get user",
+			Error:   err.Error(),
+		})
+	}
+
+	if user != nil && user.DisabledAt == nil {
+		limited, err := server.otpSendLimited(c, user.PhoneNumber, OTPPurposePasswordReset)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Message: "Failed to check sent codes",
+				Error:   err.Error(),
+			})
+		}
+
+		// Codes over the limit are dropped without saying so, since only
+		// registered numbers could ever reach it
+		if !limited {
+			code, ok, err := server.issueOTP(c, user.PhoneNumber, OTPPurposePasswordReset)
+			if !ok {
+				return err
+			}
+
+			err = server.Notifier.NotifyPasswordReset(ctx, user, code)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+					Message: "Failed to send code",
+					Error:   err.Error(),
+				})
+			}
+		}
+	}
+
+	return c.JSON(http.StatusAccepted, models.OTPSentResponse{
+		ExpiresIn: int64(OTPTTL.Seconds()),
+	})
+}
+
+// ResetPassword sets a new password with the code sent by ForgotPassword and
+// ends all sessions of the user.
+func (server *Server) ResetPassword(c echo.Context) error {
+	ctx := c.Request().Context()
+	resetRequest := &models.ResetPasswordRequest{}
+
+	err := c.Bind(resetRequest)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to read request",
+			Error:   err.Error(),
+		})
+	}
+
+	errs := resetRequest.Validate()
+	if len(errs) > 0 {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Invalid request",
+			Error:   errs,
+		})
+	}
+
+	// Checked before the code, which cannot be used again once verified
+	ok, err := server.checkPasswordStrength(c, "password", resetRequest.Password)
+	if !ok {
+		return err
+	}
+
+	ok, err = server.verifyOTP(c, resetRequest.PhoneNumber, OTPPurposePasswordReset, resetRequest.Code)
+	if !ok {
+		return err
+	}
+
+	user, err := server.Repository.GetUser(ctx, &entity.UserFilter{
+		PhoneNumber: &resetRequest.PhoneNumber,
+	})
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get user",
+			Error:   err.Error(),
+		})
+	}
+	if user == nil || user.DisabledAt != nil {
+		return c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: "User not allowed to reset password",
+		})
+	}
+
+	hashedPassword, err := server.Passwords.HashPassword(resetRequest.Password)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to hash password",
+			Error:   err.Error(),
+		})
+	}
+
+	// Whoever knew the old password is logged out everywhere
+	err = server.revokeUserSessions(ctx, user.ID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to revoke sessions",
+			Error:   err.Error(),
+		})
+	}
+
+	err = server.Repository.ResetPassword(ctx, user.ID, hashedPassword)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to reset password",
+			Error:   err.Error(),
+		})
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
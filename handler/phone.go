@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/SawitProRecruitment/UserService/handler/models"
+	"github.com/SawitProRecruitment/UserService/repository/entity"
+	"github.com/labstack/echo/v4"
+)
+
+// StartPhoneVerification texts a code to the phone number of the
+// authenticated user.
+func (server *Server) StartPhoneVerification(c echo.Context) error {
+	user, ok, err := server.tokenUser(c)
+	if !ok {
+		return err
+	}
+
+	if user.PhoneVerified {
+		return c.JSON(http.StatusConflict, models.ErrorResponse{
+			Message: "Phone number already verified",
+		})
+	}
+
+	limited, err := server.otpSendLimited(c, user.PhoneNumber, OTPPurposePhoneVerification)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to check sent codes",
+			Error:   err.Error(),
+		})
+	}
+	if limited {
+		return otpSendLimitReached(c)
+	}
+
+	ok, err = server.sendOTP(c, user.PhoneNumber, OTPPurposePhoneVerification, "Your "+ServiceName+" verification code is %s")
+	if !ok {
+		return err
+	}
+
+	return c.JSON(http.StatusAccepted, models.OTPSentResponse{
+		ExpiresIn: int64(OTPTTL.Seconds()),
+	})
+}
+
+// ConfirmPhoneVerification marks the phone number of the authenticated user
+// as verified when they enter the code texted to it.
+func (server *Server) ConfirmPhoneVerification(c echo.Context) error {
+	user, ok, err := server.tokenUser(c)
+	if !ok {
+		return err
+	}
+
+	confirmRequest := &models.PhoneVerificationConfirmRequest{}
+
+	err = c.Bind(confirmRequest)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to read request",
+			Error:   err.Error(),
+		})
+	}
+
+	if user.PhoneVerified {
+		return c.JSON(http.StatusConflict, models.ErrorResponse{
+			Message: "Phone number already verified",
+		})
+	}
+
+	ok, err = server.verifyOTP(c, user.PhoneNumber, OTPPurposePhoneVerification, confirmRequest.Code)
+	if !ok {
+		return err
+	}
+
+	err = server.Repository.SetPhoneVerified(c.Request().Context(), user.ID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to verify phone number",
+			Error:   err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, models.GetUserProfileResponse{
+		PhoneNumber:   user.PhoneNumber,
+		PhoneVerified: true,
+		FullName:      user.FullName,
+	})
+}
+
+// tokenUser loads the user authenticated by Authenticate. When there is no
+// such user the response has already been written and ok is false.
+func (server *Server) tokenUser(c echo.Context) (user *entity.UserData, ok bool, err error) {
+	user, err = server.Repository.GetUser(c.Request().Context(), &entity.UserFilter{
+		ID: &CurrentPrincipal(c).UserID,
+	})
+	if err != nil {
+		return nil, false, c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get user",
+			Error:   err.Error(),
+		})
+	}
+	if user == nil {
+		return nil, false, c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Message: "User not found",
+		})
+	}
+
+	return user, true, nil
+}
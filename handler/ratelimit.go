@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SawitProRecruitment/UserService/handler/models"
+	"github.com/labstack/echo/v4"
+)
+
+// RateLimitKey picks who a request is counted against. Requests it returns
+// an empty key for are not limited.
+type RateLimitKey func(c echo.Context) string
+
+// RateLimit allows a burst of Requests that refills evenly over Per for every
+// key.
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+	Key      RateLimitKey
+}
+
+// refillEvery is how long it takes to gain one more request.
+func (limit RateLimit) refillEvery() time.Duration {
+	return limit.Per / time.Duration(limit.Requests)
+}
+
+// RateLimitByIP counts requests by the IP address of the client.
+func RateLimitByIP(c echo.Context) string {
+	return "ip:" + clientIP(c)
+}
+
+// clientIP returns the IP address of the client as found by the IPExtractor
+// of Echo, which should only trust headers set by known proxies. Whatever
+// else ends up there is replaced by the address of the connection, so that
+// it cannot be used to make up keys or to overflow the columns it is stored
+// in.
+func clientIP(c echo.Context) string {
+	ip := c.RealIP()
+	if net.ParseIP(ip) == nil {
+		return echo.ExtractIPDirect()(c.Request())
+	}
+
+	return ip
+}
+
+// RateLimitByPhoneNumber counts requests by the phone_number in the JSON
+// body, so a number cannot be targeted from many IP addresses. The body is
+// left for the handler to bind.
+func RateLimitByPhoneNumber(c echo.Context) string {
+	body, err := io.ReadAll(c.Request().Body)
+	c.Request().Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	var request struct {
+		PhoneNumber string `json:"phone_number"`
+	}
+	if json.Unmarshal(body, &request) != nil || request.PhoneNumber == "" {
+		return ""
+	}
+
+	return "phone:" + request.PhoneNumber
+}
+
+// RateLimitByUser counts requests by the user authenticated by Authenticate,
+// which has to run before the limit.
+func RateLimitByUser(c echo.Context) string {
+	principal := CurrentPrincipal(c)
+	if principal == nil {
+		return ""
+	}
+
+	return "user:" + strconv.FormatInt(principal.UserID, 10)
+}
+
+// RateLimit rejects requests to the route with 429 once any of the limits is
+// used up. Keys are prefixed with the name so routes have their own buckets.
+// The most restrictive limit is reported in the RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers.
+func (server *Server) RateLimit(name string, limits ...RateLimit) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if server.RateLimits == nil {
+				return next(c)
+			}
+
+			// The limit closest to being used up is reported, -1 until one is
+			lowest := -1
+			for _, limit := range limits {
+				key := limit.Key(c)
+				if key == "" {
+					continue
+				}
+
+				allowed, remaining, err := server.RateLimits.Take(c.Request().Context(), name+":"+key, limit.Requests, limit.refillEvery())
+				if err != nil {
+					return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+						Message: "Failed to check rate limit",
+						Error:   err.Error(),
+					})
+				}
+
+				if lowest == -1 || int(remaining) < lowest {
+					setRateLimitHeaders(c, limit, remaining)
+					lowest = int(remaining)
+				}
+
+				if !allowed {
+					retryAfter := time.Duration((1 - remaining) * float64(limit.refillEvery()))
+					c.Response().Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+
+					return c.JSON(http.StatusTooManyRequests, models.ErrorResponse{
+						Message: "Too many requests, try again later",
+					})
+				}
+			}
+
+			return next(c)
+		}
+	}
+}
+
+func setRateLimitHeaders(c echo.Context, limit RateLimit, remaining float64) {
+	header := c.Response().Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(limit.Requests))
+	header.Set("RateLimit-Remaining", strconv.Itoa(int(remaining)))
+	// The bucket is back to the full limit after the missing requests refill
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(time.Duration((float64(limit.Requests)-remaining)*float64(limit.refillEvery())))))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,220 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/SawitProRecruitment/UserService/handler/models"
+	"github.com/SawitProRecruitment/UserService/policy"
+	"github.com/SawitProRecruitment/UserService/repository/entity"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	RoleAdmin         = "admin"
+	RoleEstateManager = "estate_manager"
+	RoleFarmer        = "farmer"
+)
+
+// Roles are all roles that exist in the roles table
+var Roles = []string{RoleAdmin, RoleEstateManager, RoleFarmer}
+
+// RequireRole returns a middleware that only lets requests through when the
+// access token carries at least one of the given roles. Requests are
+// authenticated like by Authenticate, and answered 403 without the role.
+// Tokens issued to OAuth2 clients carry no roles.
+func (server *Server) RequireRole(roles ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			principal, ok, err := server.authenticate(c)
+			if !ok {
+				return err
+			}
+
+			for _, role := range principal.Roles {
+				if containsString(roles, role) {
+					return next(c)
+				}
+			}
+
+			return c.JSON(http.StatusForbidden, models.ErrorResponse{
+				Message: "Insufficient role",
+			})
+		}
+	}
+}
+
+func (server *Server) AssignUserRole(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Invalid user ID",
+			Error:   err.Error(),
+		})
+	}
+
+	assignRequest := &models.AssignRoleRequest{}
+
+	err = c.Bind(assignRequest)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to read request",
+			Error:   err.Error(),
+		})
+	}
+
+	if !containsString(Roles, assignRequest.Role) {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Unknown role",
+		})
+	}
+
+	_, ok, err := server.authorizeOnUser(c, userID, "user_role", "assign", map[string]string{
+		"role": assignRequest.Role,
+	})
+	if !ok {
+		return err
+	}
+
+	err = server.Repository.AssignRole(ctx, userID, assignRequest.Role)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to assign role",
+			Error:   err.Error(),
+		})
+	}
+
+	return server.userRolesResponse(c, userID)
+}
+
+func (server *Server) RemoveUserRole(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Invalid user ID",
+			Error:   err.Error(),
+		})
+	}
+
+	_, ok, err := server.authorizeOnUser(c, userID, "user_role", "remove", map[string]string{
+		"role": c.Param("role"),
+	})
+	if !ok {
+		return err
+	}
+
+	err = server.Repository.RemoveRole(ctx, userID, c.Param("role"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to remove role",
+			Error:   err.Error(),
+		})
+	}
+
+	return server.userRolesResponse(c, userID)
+}
+
+func (server *Server) userRolesResponse(c echo.Context, userID int64) error {
+	roles, err := server.Repository.GetUserRoles(c.Request().Context(), userID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get user roles",
+			Error:   err.Error(),
+		})
+	}
+
+	if roles == nil {
+		roles = []string{}
+	}
+
+	return c.JSON(http.StatusOK, models.UserRolesResponse{
+		Roles: roles,
+	})
+}
+
+// authorizeOnUser evaluates the access policy for an action of the
+// authenticated user on a resource belonging to the target user, and returns
+// the target user. The resource has the target user's attributes plus the
+// given extra attributes. When the action is not allowed the response has
+// already been written and ok is false.
+func (server *Server) authorizeOnUser(c echo.Context, targetUserID int64, resourceType, action string, extra map[string]string) (targetUser *entity.UserData, ok bool, err error) {
+	subject, ok, err := server.policySubject(c)
+	if !ok {
+		return nil, false, err
+	}
+
+	targetUser, err = server.Repository.GetUser(c.Request().Context(), &entity.UserFilter{
+		ID: &targetUserID,
+	})
+	if err != nil {
+		return nil, false, c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get user",
+			Error:   err.Error(),
+		})
+	}
+	if targetUser == nil {
+		return nil, false, c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Message: "User not found",
+		})
+	}
+
+	resource := policy.Resource{
+		Type:       resourceType,
+		Attributes: userAttributes(targetUser),
+	}
+	for key, value := range extra {
+		resource.Attributes[key] = value
+	}
+
+	if !server.Policy.Allowed(subject, action, resource) {
+		return nil, false, c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: "Action not allowed",
+		})
+	}
+
+	return targetUser, true, nil
+}
+
+// policySubject describes the user authenticated by RequireRole to the access
+// policy. When the user cannot be loaded the response has already been written
+// and ok is false.
+func (server *Server) policySubject(c echo.Context) (subject policy.Subject, ok bool, err error) {
+	principal := CurrentPrincipal(c)
+
+	user, err := server.Repository.GetUser(c.Request().Context(), &entity.UserFilter{
+		ID: &principal.UserID,
+	})
+	if err != nil {
+		return subject, false, c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: "Failed to get user",
+			Error:   err.Error(),
+		})
+	}
+	if user == nil {
+		return subject, false, c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: "User not found",
+		})
+	}
+
+	return policy.Subject{
+		Roles:      principal.Roles,
+		Attributes: userAttributes(user),
+	}, true, nil
+}
+
+// userAttributes describes a user to the access policy.
+func userAttributes(user *entity.UserData) map[string]string {
+	attributes := map[string]string{
+		"id": strconv.FormatInt(user.ID, 10),
+	}
+
+	if user.EstateID != nil {
+		attributes["estate_id"] = strconv.FormatInt(*user.EstateID, 10)
+	}
+
+	return attributes
+}
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"github.com/SawitProRecruitment/UserService/repository/entity"
+)
+
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+// GenerateRefreshToken returns an opaque refresh token for the client and the
+// hash of that token that is stored in the database.
+func GenerateRefreshToken() (string, string, error) {
+	token, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	return token, HashToken(token), nil
+}
+
+// HashToken returns the hash under which an opaque token is stored.
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(hash[:])
+}
+
+func randomString(size int) (string, error) {
+	b := make([]byte, size)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// issueRefreshToken stores a new refresh token for the user. An empty familyID
+// starts a new token family, which is what a fresh login does.
+func (server *Server) issueRefreshToken(ctx context.Context, userID int64, familyID string) (string, error) {
+	if familyID == "" {
+		id, err := randomString(16)
+		if err != nil {
+			return "", err
+		}
+		familyID = id
+	}
+
+	token, tokenHash, err := GenerateRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = server.Repository.CreateRefreshToken(ctx, &entity.RefreshToken{
+		UserID:    userID,
+		FamilyID:  familyID,
+		TokenHash: tokenHash,
+		ExpiresAt: time.Now().Add(RefreshTokenTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
@@ -1,42 +1,283 @@
 package handler
 
 import (
+	"time"
+
+	"github.com/SawitProRecruitment/UserService/policy"
 	"github.com/SawitProRecruitment/UserService/repository"
+	"github.com/SawitProRecruitment/UserService/strength"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/labstack/echo/v4"
 )
 
 type Server struct {
 	Repository repository.RepositoryInterface
 	JWT        JWT
+	Policy     *policy.Evaluator
+	// WebAuthn is nil when passkeys are not configured
+	WebAuthn  *webauthn.WebAuthn
+	SMS       SMSSender
+	Notifier  Notifier
+	Passwords *PasswordHasher
+	// PasswordStrength is nil when new passwords are only validated by
+	// their request models
+	PasswordStrength *strength.Checker
+	// AccountLockout and IPLockout never lock logins when their threshold is
+	// zero
+	AccountLockout LockoutPolicy
+	IPLockout      LockoutPolicy
+	// RateLimits is nil when requests are not rate limited
+	RateLimits repository.RateLimitStoreInterface
 }
 
 type NewServerOptions struct {
 	Repository repository.RepositoryInterface
 	JWT        JWT
+	Policy     *policy.Evaluator
+	WebAuthn   *webauthn.WebAuthn
+	// SMS defaults to logging messages when nil
+	SMS SMSSender
+	// Notifier defaults to texting notifications through SMS when nil
+	Notifier Notifier
+	// Passwords defaults to hashing with DefaultArgon2Params when nil
+	Passwords *PasswordHasher
+	// PasswordStrength defaults to an entropy check without a breached
+	// password index when nil
+	PasswordStrength *strength.Checker
+	// AccountLockout and IPLockout default to DefaultAccountLockout and
+	// DefaultIPLockout when zero
+	AccountLockout LockoutPolicy
+	IPLockout      LockoutPolicy
+	// RateLimits defaults to an in-memory store when nil, which only limits
+	// a single instance
+	RateLimits repository.RateLimitStoreInterface
 }
 
 func NewServer(opts NewServerOptions) *Server {
+	sms := opts.SMS
+	if sms == nil {
+		sms = NewLogSMSSender()
+	}
+
+	notifier := opts.Notifier
+	if notifier == nil {
+		notifier = &SMSNotifier{SMS: sms}
+	}
+
+	passwords := opts.Passwords
+	if passwords == nil {
+		passwords = NewPasswordHasher(NewPasswordHasherOptions{})
+	}
+
+	passwordStrength := opts.PasswordStrength
+	if passwordStrength == nil {
+		passwordStrength = strength.NewChecker(strength.NewCheckerOptions{})
+	}
+
+	accountLockout := opts.AccountLockout
+	if accountLockout == (LockoutPolicy{}) {
+		accountLockout = DefaultAccountLockout
+	}
+
+	ipLockout := opts.IPLockout
+	if ipLockout == (LockoutPolicy{}) {
+		ipLockout = DefaultIPLockout
+	}
+
+	rateLimits := opts.RateLimits
+	if rateLimits == nil {
+		rateLimits = repository.NewMemoryRateLimitStore()
+	}
+
 	return &Server{
-		Repository: opts.Repository,
-		JWT:        opts.JWT,
+		Repository:       opts.Repository,
+		JWT:              opts.JWT,
+		Policy:           opts.Policy,
+		WebAuthn:         opts.WebAuthn,
+		SMS:              sms,
+		Notifier:         notifier,
+		Passwords:        passwords,
+		PasswordStrength: passwordStrength,
+		AccountLockout:   accountLockout,
+		IPLockout:        ipLockout,
+		RateLimits:       rateLimits,
 	}
 }
 
-// RegisterHandlers to register all endpoints
+// RegisterHandlers to register all endpoints. Endpoints of the logged in user
+// opt in to Authenticate or RequireRole. Endpoints that check passwords or
+// codes, or send messages, are rate limited per route.
 func (server *Server) RegisterHandlers(e *echo.Echo) {
 	e.POST("/register", func(c echo.Context) error {
 		return server.RegisterUser(c)
-	})
+	}, server.RateLimit("register",
+		RateLimit{Requests: 10, Per: time.Hour, Key: RateLimitByIP},
+	))
 
 	e.POST("/login", func(c echo.Context) error {
 		return server.LoginUser(c)
+	}, server.RateLimit("login",
+		RateLimit{Requests: 30, Per: time.Minute, Key: RateLimitByIP},
+		RateLimit{Requests: 10, Per: time.Minute, Key: RateLimitByPhoneNumber},
+	))
+
+	e.POST("/login/sms/start", func(c echo.Context) error {
+		return server.StartSMSLogin(c)
+	}, server.RateLimit("login_sms_start",
+		RateLimit{Requests: 10, Per: time.Minute, Key: RateLimitByIP},
+		RateLimit{Requests: 3, Per: time.Minute, Key: RateLimitByPhoneNumber},
+	))
+
+	e.POST("/login/sms/confirm", func(c echo.Context) error {
+		return server.ConfirmSMSLogin(c)
+	}, server.RateLimit("login_sms_confirm",
+		RateLimit{Requests: 30, Per: time.Minute, Key: RateLimitByIP},
+		RateLimit{Requests: 10, Per: time.Minute, Key: RateLimitByPhoneNumber},
+	))
+
+	e.POST("/password/forgot", func(c echo.Context) error {
+		return server.ForgotPassword(c)
+	}, server.RateLimit("password_forgot",
+		RateLimit{Requests: 10, Per: time.Minute, Key: RateLimitByIP},
+		RateLimit{Requests: 3, Per: time.Minute, Key: RateLimitByPhoneNumber},
+	))
+
+	e.POST("/password/reset", func(c echo.Context) error {
+		return server.ResetPassword(c)
+	}, server.RateLimit("password_reset",
+		RateLimit{Requests: 30, Per: time.Minute, Key: RateLimitByIP},
+		RateLimit{Requests: 10, Per: time.Minute, Key: RateLimitByPhoneNumber},
+	))
+
+	e.POST("/login/mfa", func(c echo.Context) error {
+		return server.LoginMFA(c)
+	}, server.RateLimit("login_mfa",
+		RateLimit{Requests: 30, Per: time.Minute, Key: RateLimitByIP},
+	))
+
+	if server.WebAuthn != nil {
+		e.POST("/webauthn/login/begin", func(c echo.Context) error {
+			return server.BeginWebAuthnLogin(c)
+		})
+
+		e.POST("/webauthn/login/finish", func(c echo.Context) error {
+			return server.FinishWebAuthnLogin(c)
+		})
+
+		e.POST("/webauthn/register/begin", func(c echo.Context) error {
+			return server.BeginWebAuthnRegistration(c)
+		}, server.Authenticate)
+
+		e.POST("/webauthn/register/finish", func(c echo.Context) error {
+			return server.FinishWebAuthnRegistration(c)
+		}, server.Authenticate)
+	}
+
+	e.POST("/phone/verify/start", func(c echo.Context) error {
+		return server.StartPhoneVerification(c)
+	}, server.Authenticate)
+
+	e.POST("/phone/verify/confirm", func(c echo.Context) error {
+		return server.ConfirmPhoneVerification(c)
+	}, server.Authenticate)
+
+	e.POST("/mfa/totp/enroll", func(c echo.Context) error {
+		return server.EnrollTOTP(c)
+	}, server.Authenticate)
+
+	e.POST("/mfa/totp/confirm", func(c echo.Context) error {
+		return server.ConfirmTOTP(c)
+	}, server.Authenticate)
+
+	e.POST("/token/refresh", func(c echo.Context) error {
+		return server.RefreshToken(c)
+	})
+
+	e.POST("/logout", func(c echo.Context) error {
+		return server.LogoutUser(c)
+	}, server.Authenticate)
+
+	e.GET("/.well-known/jwks.json", func(c echo.Context) error {
+		return server.GetJWKS(c)
 	})
 
+	e.GET("/.well-known/openid-configuration", func(c echo.Context) error {
+		return server.GetOpenIDConfiguration(c)
+	})
+
+	e.GET("/userinfo", func(c echo.Context) error {
+		return server.GetUserinfo(c)
+	}, server.RequireScope("openid"))
+
+	e.POST("/oauth/clients", func(c echo.Context) error {
+		return server.CreateOAuthClient(c)
+	}, server.RequireRole(RoleAdmin))
+
+	e.GET("/authorize", func(c echo.Context) error {
+		return server.Authorize(c)
+	})
+
+	e.POST("/authorize", func(c echo.Context) error {
+		return server.Authorize(c)
+	}, server.RateLimit("authorize",
+		RateLimit{Requests: 30, Per: time.Minute, Key: RateLimitByIP},
+	))
+
+	e.POST("/token", func(c echo.Context) error {
+		return server.Token(c)
+	}, server.RateLimit("token",
+		RateLimit{Requests: 60, Per: time.Minute, Key: RateLimitByIP},
+	))
+
+	e.POST("/introspect", func(c echo.Context) error {
+		return server.Introspect(c)
+	}, server.RateLimit("introspect",
+		RateLimit{Requests: 60, Per: time.Minute, Key: RateLimitByIP},
+	))
+
+	e.GET("/admin/users", func(c echo.Context) error {
+		return server.ListUsers(c)
+	}, server.RequireRole(RoleAdmin))
+
+	e.GET("/admin/users/:id", func(c echo.Context) error {
+		return server.GetAdminUser(c)
+	}, server.RequireRole(RoleAdmin))
+
+	e.POST("/admin/users/:id/disable", func(c echo.Context) error {
+		return server.DisableUser(c)
+	}, server.RequireRole(RoleAdmin))
+
+	e.POST("/admin/users/:id/enable", func(c echo.Context) error {
+		return server.EnableUser(c)
+	}, server.RequireRole(RoleAdmin))
+
+	e.POST("/admin/users/:id/roles", func(c echo.Context) error {
+		return server.AssignUserRole(c)
+	}, server.RequireRole(RoleAdmin, RoleEstateManager))
+
+	e.DELETE("/admin/users/:id/roles/:role", func(c echo.Context) error {
+		return server.RemoveUserRole(c)
+	}, server.RequireRole(RoleAdmin, RoleEstateManager))
+
 	e.GET("/profile", func(c echo.Context) error {
 		return server.GetUserProfile(c)
-	})
+	}, server.Authenticate)
 
 	e.PUT("/profile", func(c echo.Context) error {
 		return server.UpdateUserProfile(c)
-	})
+	}, server.Authenticate)
+
+	e.GET("/sessions", func(c echo.Context) error {
+		return server.GetSessions(c)
+	}, server.Authenticate)
+
+	e.DELETE("/sessions/:id", func(c echo.Context) error {
+		return server.DeleteSession(c)
+	}, server.Authenticate)
+
+	e.PUT("/profile/password", func(c echo.Context) error {
+		return server.ChangePassword(c)
+	}, server.Authenticate, server.RateLimit("change_password",
+		RateLimit{Requests: 10, Per: time.Minute, Key: RateLimitByUser},
+	))
 }
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/SawitProRecruitment/UserService/handler/models"
+	"github.com/SawitProRecruitment/UserService/repository/entity"
+	"github.com/labstack/echo/v4"
+)
+
+// How users logged in, recorded with their sessions. Logins with a second
+// factor are recorded with the factor that completed them.
+const (
+	LoginMethodPassword     = "password"
+	LoginMethodSMS          = "sms"
+	LoginMethodPasskey      = "passkey"
+	LoginMethodTOTP         = "totp"
+	LoginMethodRecoveryCode = "recovery_code"
+)
+
+// maxUserAgentLength fits the user_agent column
+const maxUserAgentLength = 512
+
+// startSession records the login of the user with the method and where it
+// came from.
+func (server *Server) startSession(c echo.Context, userID int64, method string) (*entity.Session, error) {
+	id, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	userAgent := c.Request().UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = strings.ToValidUTF8(userAgent[:maxUserAgentLength], "")
+	}
+
+	session := &entity.Session{
+		ID:        id,
+		UserID:    userID,
+		Method:    method,
+		IPAddress: clientIP(c),
+		UserAgent: userAgent,
+	}
+
+	err = server.Repository.CreateSession(c.Request().Context(), session)
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// revokeUserSessions ends every active session of the user, so the access
+// tokens issued for them stop working before they expire. It has to run
+// before the refresh tokens of the user are revoked, which ends the sessions
+// without revoking their access tokens.
+func (server *Server) revokeUserSessions(ctx context.Context, userID int64) error {
+	sessions, err := server.Repository.ListActiveSessions(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		err = server.JWT.RevokeSession(ctx, session.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetSessions lists where the user of the token is logged in.
+func (server *Server) GetSessions(c echo.Context) error {
+	principal := CurrentPrincipal(c)
+
+	sessions, err := server.Repository.ListActiveSessions(c.Request().Context(), principal.UserID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to list sessions",
+			Error:   err.Error(),
+		})
+	}
+
+	response := models.ListSessionsResponse{
+		Sessions: make([]models.SessionResponse, 0, len(sessions)),
+	}
+	for _, session := range sessions {
+		response.Sessions = append(response.Sessions, models.SessionResponse{
+			ID:         session.ID,
+			Method:     session.Method,
+			IPAddress:  session.IPAddress,
+			UserAgent:  session.UserAgent,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			Current:    session.ID == principal.SessionID,
+		})
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// DeleteSession logs the user of the token out of one of their sessions. Its
+// refresh tokens stop working and its access tokens are revoked.
+func (server *Server) DeleteSession(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := CurrentPrincipal(c).UserID
+
+	session, err := server.Repository.GetSession(ctx, c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get session",
+			Error:   err.Error(),
+		})
+	}
+	// Sessions of other users are not revealed
+	if session == nil || session.UserID != userID {
+		return c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Message: "Session not found",
+		})
+	}
+
+	err = server.Repository.RevokeRefreshTokenFamily(ctx, session.ID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to revoke refresh token",
+			Error:   err.Error(),
+		})
+	}
+
+	err = server.JWT.RevokeSession(ctx, session.ID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to revoke session",
+			Error:   err.Error(),
+		})
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"os"
+)
+
+// SMSSender delivers text messages to phone numbers.
+type SMSSender interface {
+	SendSMS(ctx context.Context, phoneNumber, message string) error
+}
+
+// LogSMSSender only logs messages instead of sending them, for local
+// development and tests.
+type LogSMSSender struct {
+	Logger *log.Logger
+}
+
+// NewLogSMSSender returns a sender logging to stderr.
+func NewLogSMSSender() *LogSMSSender {
+	return &LogSMSSender{
+		Logger: log.New(os.Stderr, "sms: ", log.LstdFlags),
+	}
+}
+
+func (sender *LogSMSSender) SendSMS(ctx context.Context, phoneNumber, message string) error {
+	sender.Logger.Printf("to %s: %s", phoneNumber, message)
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/SawitProRecruitment/UserService/handler/models"
+	"github.com/SawitProRecruitment/UserService/repository/entity"
+	"github.com/labstack/echo/v4"
+)
+
+// StartSMSLogin texts a login code to the phone number. The response is the
+// same whether or not the phone number belongs to a user who can log in, so
+// it cannot be used to find out which numbers are registered.
+func (server *Server) StartSMSLogin(c echo.Context) error {
+	startRequest := &models.SMSLoginStartRequest{}
+
+	err := c.Bind(startRequest)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to read request",
+			Error:   err.Error(),
+		})
+	}
+
+	errs := startRequest.Validate()
+	if len(errs) > 0 {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Invalid request",
+			Error:   errs,
+		})
+	}
+
+	user, err := server.Repository.GetUser(c.Request().Context(), &entity.UserFilter{
+		PhoneNumber: &startRequest.PhoneNumber,
+	})
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get user",
+			Error:   err.Error(),
+		})
+	}
+
+	if user != nil && user.DisabledAt == nil {
+		limited, err := server.otpSendLimited(c, user.PhoneNumber, OTPPurposeLogin)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Message: "Failed to check sent codes",
+				Error:   err.Error(),
+			})
+		}
+
+		// Codes over the limit are dropped without saying so, since only
+		// registered numbers could ever reach it
+		if !limited {
+			ok, err := server.sendOTP(c, user.PhoneNumber, OTPPurposeLogin, "Your "+ServiceName+" login code is %s")
+			if !ok {
+				return err
+			}
+		}
+	}
+
+	return c.JSON(http.StatusAccepted, models.OTPSentResponse{
+		ExpiresIn: int64(OTPTTL.Seconds()),
+	})
+}
+
+// ConfirmSMSLogin logs the user in with the code texted by StartSMSLogin, the
+// same way LoginUser does with a password.
+func (server *Server) ConfirmSMSLogin(c echo.Context) error {
+	ctx := c.Request().Context()
+	confirmRequest := &models.SMSLoginConfirmRequest{}
+
+	err := c.Bind(confirmRequest)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to read request",
+			Error:   err.Error(),
+		})
+	}
+
+	errs := confirmRequest.Validate()
+	if len(errs) > 0 {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Invalid request",
+			Error:   errs,
+		})
+	}
+
+	ok, err := server.verifyOTP(c, confirmRequest.PhoneNumber, OTPPurposeLogin, confirmRequest.Code)
+	if !ok {
+		return err
+	}
+
+	user, err := server.Repository.GetUser(ctx, &entity.UserFilter{
+		PhoneNumber: &confirmRequest.PhoneNumber,
+	})
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get user",
+			Error:   err.Error(),
+		})
+	}
+	if user == nil || user.DisabledAt != nil {
+		return c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: "User not allowed to login",
+		})
+	}
+
+	// Receiving the code proves the user owns the phone number
+	if !user.PhoneVerified {
+		err = server.Repository.SetPhoneVerified(ctx, user.ID)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Message: "Failed to verify phone number",
+				Error:   err.Error(),
+			})
+		}
+		user.PhoneVerified = true
+	}
+
+	return server.loginWithSecondFactor(c, user, LoginMethodSMS)
+}
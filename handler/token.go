@@ -1,82 +1,577 @@
 package handler
 
 import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/SawitProRecruitment/UserService/handler/models"
+	"github.com/SawitProRecruitment/UserService/repository"
+	"github.com/SawitProRecruitment/UserService/repository/entity"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/golang-jwt/jwt"
 )
 
+const (
+	AccessTokenTTL = time.Hour
+	// MFATokenTTL is how long a user has to enter a code after a password check
+	MFATokenTTL = 5 * time.Minute
+	// WebAuthnTokenTTL is how long a user has to complete a WebAuthn ceremony
+	WebAuthnTokenTTL = 5 * time.Minute
+)
+
+// DefaultClockSkew is how far the clocks of this service and its clients may
+// be apart before times in tokens are rejected
+const DefaultClockSkew = 30 * time.Second
+
+// The token_use claim tells challenge tokens apart from access tokens, which
+// have none
+const (
+	mfaTokenUse      = "mfa"
+	webAuthnTokenUse = "webauthn"
+)
+
+// Claims are the claims of the access and challenge tokens this service
+// issues for itself. The subject is the ID of the user, or the client ID for
+// tokens of OAuth2 clients acting on their own behalf.
+type Claims struct {
+	jwt.StandardClaims
+	Roles []string `json:"roles,omitempty"`
+	// Scope is set on tokens issued to OAuth2 clients, space separated
+	Scope    string `json:"scope,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+	// SessionID is set on tokens issued for a login session
+	SessionID string `json:"sid,omitempty"`
+	TokenUse  string `json:"token_use,omitempty"`
+	// Session is the WebAuthn ceremony carried by a WebAuthn challenge token
+	Session *webauthn.SessionData `json:"session,omitempty"`
+}
+
+// UserID returns the ID of the user the token was issued to, failing for
+// tokens without one.
+func (claims *Claims) UserID() (int64, error) {
+	if claims.Subject == "" || (claims.ClientID != "" && claims.Subject == claims.ClientID) {
+		return 0, fmt.Errorf("token has no user")
+	}
+
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid subject")
+	}
+
+	return userID, nil
+}
+
+// Scopes returns the scopes granted to the token. Tokens issued on login
+// carry no scope and are not limited by scopes.
+func (claims *Claims) Scopes() []string {
+	return strings.Fields(claims.Scope)
+}
+
+// idTokenClaims are the claims of OpenID Connect ID tokens, which are issued
+// to clients and never accepted by this service.
+type idTokenClaims struct {
+	jwt.StandardClaims
+	// Name is only given with the profile scope, the phone number claims
+	// only with the phone scope
+	PhoneNumber         string `json:"phone_number,omitempty"`
+	PhoneNumberVerified *bool  `json:"phone_number_verified,omitempty"`
+	Name                string `json:"name,omitempty"`
+}
+
 type JWT struct {
-	privateKey []byte
-	publicKey  []byte
+	issuer   string
+	audience string
+	// tokenAudience is the aud claim of the tokens issued for this service
+	tokenAudience string
+	clockSkew     time.Duration
+	signingKeyID  string
+	signingKey    *rsa.PrivateKey
+	// publicKeys holds every key tokens are verified with, indexed by kid
+	publicKeys  map[string]*rsa.PublicKey
+	revocations repository.RevocationStoreInterface
 }
 
-func NewJWT(privateKey []byte, publicKey []byte) JWT {
+type NewJWTOptions struct {
+	// Issuer is the public base URL of this service, used as iss claim
+	Issuer string
+	// Audience is the aud claim of ID tokens issued on login
+	Audience string
+	// TokenAudience is the aud claim of the access and challenge tokens this
+	// service issues for itself, and only accepts. Defaults to Issuer.
+	TokenAudience string
+	// ClockSkew is allowed when checking the exp, nbf and iat claims.
+	// Defaults to DefaultClockSkew when zero.
+	ClockSkew time.Duration
+	// PrivateKey is the PEM encoded RSA key new tokens are signed with
+	PrivateKey []byte
+	// RetiredPublicKeys are PEM encoded RSA public keys of previous signing
+	// keys, so tokens signed before a rotation stay valid until they expire
+	RetiredPublicKeys [][]byte
+	// Revocations defaults to an in-memory store when nil
+	Revocations repository.RevocationStoreInterface
+}
+
+func NewJWT(opts NewJWTOptions) (JWT, error) {
+	// Tokens are only accepted with the issuer and audience they were issued
+	// with, which must not be left empty by mistake
+	if opts.Issuer == "" {
+		return JWT{}, fmt.Errorf("missing issuer")
+	}
+	if opts.Audience == "" {
+		return JWT{}, fmt.Errorf("missing audience")
+	}
+
+	// Parse private key
+	signingKey, err := jwt.ParseRSAPrivateKeyFromPEM(opts.PrivateKey)
+	if err != nil {
+		return JWT{}, err
+	}
+	signingKeyID := KeyID(&signingKey.PublicKey)
+
+	publicKeys := map[string]*rsa.PublicKey{
+		signingKeyID: &signingKey.PublicKey,
+	}
+	for _, retiredKey := range opts.RetiredPublicKeys {
+		key, err := jwt.ParseRSAPublicKeyFromPEM(retiredKey)
+		if err != nil {
+			return JWT{}, err
+		}
+
+		publicKeys[KeyID(key)] = key
+	}
+
+	revocations := opts.Revocations
+	if revocations == nil {
+		revocations = repository.NewMemoryRevocationStore()
+	}
+
+	tokenAudience := opts.TokenAudience
+	if tokenAudience == "" {
+		tokenAudience = opts.Issuer
+	}
+
+	clockSkew := opts.ClockSkew
+	if clockSkew == 0 {
+		clockSkew = DefaultClockSkew
+	}
+
 	return JWT{
-		privateKey: privateKey,
-		publicKey:  publicKey,
+		issuer:        opts.Issuer,
+		audience:      opts.Audience,
+		tokenAudience: tokenAudience,
+		clockSkew:     clockSkew,
+		signingKeyID:  signingKeyID,
+		signingKey:    signingKey,
+		publicKeys:    publicKeys,
+		revocations:   revocations,
+	}, nil
+}
+
+// KeyID returns the RFC 7638 thumbprint of the key, which is used as kid.
+func KeyID(key *rsa.PublicKey) string {
+	// Members must be in lexicographic order and without whitespace
+	thumbprint := fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`,
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		base64.RawURLEncoding.EncodeToString(key.N.Bytes()))
+	hash := sha256.Sum256([]byte(thumbprint))
+
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// GenerateToken returns an access token for the user logged in with the
+// session, which is revoked together with the session.
+func (j *JWT) GenerateToken(userID int64, roles []string, sessionID string) (string, error) {
+	claims, err := j.accessTokenClaims(userID)
+	if err != nil {
+		return "", err
+	}
+
+	claims.Roles = roles
+	claims.SessionID = sessionID
+
+	return j.sign(claims)
+}
+
+// GenerateClientToken returns an access token issued to an OAuth2 client on
+// behalf of the user, limited to the granted scope.
+func (j *JWT) GenerateClientToken(userID int64, clientID string, scope string) (string, error) {
+	claims, err := j.accessTokenClaims(userID)
+	if err != nil {
+		return "", err
 	}
+
+	claims.ClientID = clientID
+	claims.Scope = scope
+
+	return j.sign(claims)
 }
 
-func (j *JWT) GenerateToken(userID int64) (string, error) {
-	// Parse private key
-	key, err := jwt.ParseRSAPrivateKeyFromPEM(j.privateKey)
+// GenerateServiceToken returns an access token issued to a confidential
+// OAuth2 client acting on its own behalf. It has no user, the client is the
+// subject instead.
+func (j *JWT) GenerateServiceToken(clientID string, scope string) (string, error) {
+	claims, err := j.tokenClaims(clientID, AccessTokenTTL)
+	if err != nil {
+		return "", err
+	}
+
+	claims.ClientID = clientID
+	claims.Scope = scope
+
+	return j.sign(claims)
+}
+
+// GenerateIDToken returns an OpenID Connect ID token describing the user.
+func (j *JWT) GenerateIDToken(user *entity.UserData) (string, error) {
+	return j.sign(j.idTokenClaims(user, j.audience, SupportedScopes))
+}
+
+// GenerateClientIDToken returns an OpenID Connect ID token describing the
+// user to an OAuth2 client, with the claims its scope grants.
+func (j *JWT) GenerateClientIDToken(user *entity.UserData, clientID string, scope string) (string, error) {
+	return j.sign(j.idTokenClaims(user, clientID, strings.Fields(scope)))
+}
+
+// GenerateMFAToken returns a short-lived challenge token proving the user
+// passed the password check. It is not an access token and can only be
+// exchanged for one together with a second factor.
+func (j *JWT) GenerateMFAToken(userID int64) (string, error) {
+	return j.generateChallengeToken(mfaTokenUse, userID, MFATokenTTL, nil)
+}
+
+// GenerateWebAuthnToken returns a short-lived token carrying the session of a
+// WebAuthn ceremony to the client and back, so no server side state is needed
+// between its two steps. userID is 0 for a login where the user is not known
+// until the passkey is presented.
+func (j *JWT) GenerateWebAuthnToken(userID int64, session *webauthn.SessionData) (string, error) {
+	return j.generateChallengeToken(webAuthnTokenUse, userID, WebAuthnTokenTTL, session)
+}
+
+func (j *JWT) generateChallengeToken(use string, userID int64, ttl time.Duration, session *webauthn.SessionData) (string, error) {
+	subject := ""
+	if userID != 0 {
+		subject = strconv.FormatInt(userID, 10)
+	}
+
+	// The token ID lets the token be used only once
+	claims, err := j.tokenClaims(subject, ttl)
 	if err != nil {
 		return "", err
 	}
 
-	// Define token claims
-	claims := jwt.MapClaims{
-		"user_id": userID,
-		"exp":     time.Now().Add(time.Hour).Unix(),
-		"iat":     time.Now().Unix(),
+	claims.TokenUse = use
+	claims.Session = session
+
+	return j.sign(claims)
+}
+
+func (j *JWT) accessTokenClaims(userID int64) (*Claims, error) {
+	return j.tokenClaims(strconv.FormatInt(userID, 10), AccessTokenTTL)
+}
+
+// tokenClaims returns the registered claims of a token issued for this
+// service, with a unique token ID so the token can be revoked individually.
+func (j *JWT) tokenClaims(subject string, ttl time.Duration) (*Claims, error) {
+	jti, err := randomString(16)
+	if err != nil {
+		return nil, err
 	}
 
-	// Create the token object with RS256 algorithm
-	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+	now := time.Now()
+
+	return &Claims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    j.issuer,
+			Subject:   subject,
+			Audience:  j.tokenAudience,
+			Id:        jti,
+			ExpiresAt: now.Add(ttl).Unix(),
+			NotBefore: now.Unix(),
+			IssuedAt:  now.Unix(),
+		},
+	}, nil
+}
+
+func (j *JWT) idTokenClaims(user *entity.UserData, audience string, scopes []string) *idTokenClaims {
+	now := time.Now()
+
+	claims := &idTokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    j.issuer,
+			Subject:   strconv.FormatInt(user.ID, 10),
+			Audience:  audience,
+			ExpiresAt: now.Add(AccessTokenTTL).Unix(),
+			IssuedAt:  now.Unix(),
+		},
+	}
+
+	if containsString(scopes, "profile") {
+		claims.Name = user.FullName
+	}
+	if containsString(scopes, "phone") {
+		phoneVerified := user.PhoneVerified
+		claims.PhoneNumber = user.PhoneNumber
+		claims.PhoneNumberVerified = &phoneVerified
+	}
+
+	return claims
+}
+
+func (j *JWT) Issuer() string {
+	return j.issuer
+}
+
+func (j *JWT) sign(claims jwt.Claims) (string, error) {
+	// Create the token object with RS256 algorithm, tagged with the key it is signed with
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = j.signingKeyID
+
+	signedToken, err := token.SignedString(j.signingKey)
 	if err != nil {
 		return "", err
 	}
 
-	return token, nil
+	return signedToken, nil
 }
 
-func (j *JWT) ValidateToken(headerAuthorization string) (jwt.MapClaims, error) {
+func (j *JWT) ValidateToken(ctx context.Context, headerAuthorization string) (*Claims, error) {
 	// Check token type
-	authorization := strings.Split(headerAuthorization, " ")
-	if len(authorization) == 0 || len(authorization) > 2 {
+	token, ok := strings.CutPrefix(headerAuthorization, "Bearer ")
+	if !ok {
+		return nil, fmt.Errorf("invalid token type")
+	}
+	if token == "" || strings.Contains(token, " ") {
 		return nil, fmt.Errorf("invalid header")
 	}
-	if authorization[0] != "Bearer" {
-		return nil, fmt.Errorf("invalid token type")
+
+	return j.ParseToken(ctx, token)
+}
+
+// ParseToken verifies a raw access token and checks it was not revoked.
+func (j *JWT) ParseToken(ctx context.Context, token string) (*Claims, error) {
+	claims, err := j.parse(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.TokenUse != "" {
+		return nil, fmt.Errorf("not an access token")
+	}
+
+	return claims, nil
+}
+
+// ParseMFAToken verifies a challenge token from GenerateMFAToken and returns
+// the ID of the user it was issued to.
+func (j *JWT) ParseMFAToken(ctx context.Context, token string) (int64, *Claims, error) {
+	claims, err := j.parseChallengeToken(ctx, mfaTokenUse, token)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	userID, err := challengeTokenUserID(claims)
+	if err != nil {
+		return 0, nil, err
+	}
+	if userID == 0 {
+		return 0, nil, fmt.Errorf("missing subject")
+	}
+
+	return userID, claims, nil
+}
+
+// ParseWebAuthnToken verifies a token from GenerateWebAuthnToken and returns
+// the user ID and ceremony session it carries.
+func (j *JWT) ParseWebAuthnToken(ctx context.Context, token string) (int64, *webauthn.SessionData, *Claims, error) {
+	claims, err := j.parseChallengeToken(ctx, webAuthnTokenUse, token)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	userID, err := challengeTokenUserID(claims)
+	if err != nil {
+		return 0, nil, nil, err
 	}
-	token := authorization[1]
 
-	// Parse public key
-	key, err := jwt.ParseRSAPublicKeyFromPEM(j.publicKey)
+	if claims.Session == nil || claims.Session.Challenge == "" {
+		return 0, nil, nil, fmt.Errorf("invalid session")
+	}
+
+	return userID, claims.Session, claims, nil
+}
+
+func (j *JWT) parseChallengeToken(ctx context.Context, use string, token string) (*Claims, error) {
+	claims, err := j.parse(ctx, token)
 	if err != nil {
 		return nil, err
 	}
 
-	// Parse token
-	tok, err := jwt.Parse(token, func(jwtToken *jwt.Token) (interface{}, error) {
+	if claims.TokenUse != use {
+		return nil, fmt.Errorf("unexpected token use, expected %s", use)
+	}
+
+	return claims, nil
+}
+
+// challengeTokenUserID returns the user ID in the sub claim, or 0 if there is
+// none.
+func challengeTokenUserID(claims *Claims) (int64, error) {
+	if claims.Subject == "" {
+		return 0, nil
+	}
+
+	return claims.UserID()
+}
+
+func (j *JWT) parse(ctx context.Context, token string) (*Claims, error) {
+	// The registered claims are checked by validateClaims, with clock skew
+	parser := jwt.Parser{SkipClaimsValidation: true}
+
+	claims := new(Claims)
+	tok, err := parser.ParseWithClaims(token, claims, func(jwtToken *jwt.Token) (interface{}, error) {
 		if _, ok := jwtToken.Method.(*jwt.SigningMethodRSA); !ok {
 			return nil, fmt.Errorf("unexpected method: %s", jwtToken.Header["alg"])
 		}
 
+		// Tokens issued before kid was introduced are signed with the active key
+		kid, ok := jwtToken.Header["kid"].(string)
+		if !ok {
+			return &j.signingKey.PublicKey, nil
+		}
+
+		key, ok := j.publicKeys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key: %s", kid)
+		}
+
 		return key, nil
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	// Extract the token claims
-	claims, ok := tok.Claims.(jwt.MapClaims)
-	if !ok || !tok.Valid {
+	if !tok.Valid {
 		return nil, fmt.Errorf("invalid token")
 	}
 
+	err = j.validateClaims(claims, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	// Reject tokens that were revoked before they expired
+	if claims.Id == "" {
+		return nil, fmt.Errorf("missing token ID")
+	}
+
+	revoked, err := j.revocations.IsRevoked(ctx, claims.Id)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, fmt.Errorf("token has been revoked")
+	}
+
+	// Tokens issued before sessions were introduced have none
+	if claims.SessionID != "" {
+		revoked, err = j.revocations.IsRevoked(ctx, sessionRevocationID(claims.SessionID))
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, fmt.Errorf("session has been revoked")
+		}
+	}
+
 	return claims, nil
 }
+
+// validateClaims checks that the token was issued by and for this service and
+// is valid at now, give or take the clock skew. Every token issued for the
+// service has an expiry.
+func (j *JWT) validateClaims(claims *Claims, now time.Time) error {
+	if claims.Issuer != j.issuer {
+		return fmt.Errorf("unexpected issuer: %s", claims.Issuer)
+	}
+
+	if claims.Audience != j.tokenAudience {
+		return fmt.Errorf("unexpected audience: %s", claims.Audience)
+	}
+
+	if claims.ExpiresAt == 0 {
+		return fmt.Errorf("missing token expiry")
+	}
+
+	if now.Add(-j.clockSkew).After(time.Unix(claims.ExpiresAt, 0)) {
+		return fmt.Errorf("token is expired")
+	}
+
+	if claims.NotBefore != 0 && now.Add(j.clockSkew).Before(time.Unix(claims.NotBefore, 0)) {
+		return fmt.Errorf("token is not valid yet")
+	}
+
+	if claims.IssuedAt != 0 && now.Add(j.clockSkew).Before(time.Unix(claims.IssuedAt, 0)) {
+		return fmt.Errorf("token used before issued")
+	}
+
+	return nil
+}
+
+// RevokeToken revokes a validated token until it expires. Expired tokens are
+// still accepted within the clock skew, so the revocation is kept that much
+// longer.
+func (j *JWT) RevokeToken(ctx context.Context, claims *Claims) error {
+	if claims.Id == "" {
+		return fmt.Errorf("missing token ID")
+	}
+
+	return j.revocations.Revoke(ctx, claims.Id, time.Unix(claims.ExpiresAt, 0).Add(j.clockSkew))
+}
+
+// RevokeSession revokes every access token issued for the session. They all
+// expire within AccessTokenTTL and the clock skew, so the revocation is kept
+// that long.
+func (j *JWT) RevokeSession(ctx context.Context, sessionID string) error {
+	return j.revocations.Revoke(ctx, sessionRevocationID(sessionID), time.Now().Add(AccessTokenTTL+j.clockSkew))
+}
+
+// sessionRevocationID is the ID a session is revoked under, kept apart from
+// token IDs.
+func sessionRevocationID(sessionID string) string {
+	return "session:" + sessionID
+}
+
+// JWKS returns every verification key as a JSON Web Key Set.
+func (j *JWT) JWKS() models.JWKSResponse {
+	keyIDs := make([]string, 0, len(j.publicKeys))
+	for kid := range j.publicKeys {
+		keyIDs = append(keyIDs, kid)
+	}
+	sort.Strings(keyIDs)
+
+	jwks := models.JWKSResponse{
+		Keys: make([]models.JSONWebKey, 0, len(keyIDs)),
+	}
+	for _, kid := range keyIDs {
+		key := j.publicKeys[kid]
+
+		jwks.Keys = append(jwks.Keys, models.JSONWebKey{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: jwt.SigningMethodRS256.Alg(),
+			Kid: kid,
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+
+	return jwks
+}
@@ -0,0 +1,363 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/SawitProRecruitment/UserService/handler/models"
+	"github.com/SawitProRecruitment/UserService/repository/entity"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/labstack/echo/v4"
+)
+
+// BeginWebAuthnRegistration starts registering a passkey for the
+// authenticated user.
+func (server *Server) BeginWebAuthnRegistration(c echo.Context) error {
+	userID := CurrentPrincipal(c).UserID
+
+	user, ok, err := server.webAuthnUser(c, userID)
+	if !ok {
+		return err
+	}
+
+	// Passkeys are discoverable credentials that verify the user themselves,
+	// so they can replace both the phone number and the password
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(user.credentials))
+	for _, credential := range user.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+
+	options, session, err := server.WebAuthn.BeginRegistration(user,
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationRequired,
+		}),
+		webauthn.WithExclusions(exclusions),
+	)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to begin registration",
+			Error:   err.Error(),
+		})
+	}
+
+	sessionToken, err := server.JWT.GenerateWebAuthnToken(userID, session)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to generate session token",
+			Error:   err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, models.WebAuthnRegistrationOptionsResponse{
+		Options:      options,
+		SessionToken: sessionToken,
+	})
+}
+
+// FinishWebAuthnRegistration verifies the new credential created by the
+// browser and stores it for the authenticated user.
+func (server *Server) FinishWebAuthnRegistration(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := CurrentPrincipal(c).UserID
+
+	finishRequest, ok, err := bindWebAuthnFinishRequest(c)
+	if !ok {
+		return err
+	}
+
+	sessionUserID, session, claims, err := server.JWT.ParseWebAuthnToken(ctx, finishRequest.SessionToken)
+	if err != nil || sessionUserID != userID {
+		return c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: "Invalid session token",
+		})
+	}
+
+	user, ok, err := server.webAuthnUser(c, userID)
+	if !ok {
+		return err
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(finishRequest.Credential))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Invalid credential",
+			Error:   webAuthnError(err),
+		})
+	}
+
+	credential, err := server.WebAuthn.CreateCredential(user, *session, parsed)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to verify credential",
+			Error:   webAuthnError(err),
+		})
+	}
+
+	// The session token can only be used once
+	err = server.JWT.RevokeToken(ctx, claims)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to revoke session token",
+			Error:   err.Error(),
+		})
+	}
+
+	stored := &entity.WebAuthnCredential{
+		UserID:          userID,
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+	}
+	for _, transport := range credential.Transport {
+		stored.Transports = append(stored.Transports, string(transport))
+	}
+
+	err = server.Repository.CreateWebAuthnCredential(ctx, stored)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to save credential",
+			Error:   err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusCreated, models.WebAuthnCredentialResponse{
+		ID: stored.ID,
+	})
+}
+
+// BeginWebAuthnLogin starts a passkey login. The user is not known yet, the
+// browser lets them pick one of their passkeys for this site.
+func (server *Server) BeginWebAuthnLogin(c echo.Context) error {
+	options, session, err := server.WebAuthn.BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+	)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to begin login",
+			Error:   err.Error(),
+		})
+	}
+
+	sessionToken, err := server.JWT.GenerateWebAuthnToken(0, session)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to generate session token",
+			Error:   err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, models.WebAuthnLoginOptionsResponse{
+		Options:      options,
+		SessionToken: sessionToken,
+	})
+}
+
+// FinishWebAuthnLogin verifies the passkey assertion and logs the user in the
+// same way LoginUser does. Passkeys verify the user on the device, so no
+// second factor is asked for.
+func (server *Server) FinishWebAuthnLogin(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	finishRequest, ok, err := bindWebAuthnFinishRequest(c)
+	if !ok {
+		return err
+	}
+
+	// A registration session carries a user and cannot be used to log in
+	sessionUserID, session, claims, err := server.JWT.ParseWebAuthnToken(ctx, finishRequest.SessionToken)
+	if err != nil || sessionUserID != 0 {
+		return c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: "Invalid session token",
+		})
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(finishRequest.Credential))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Invalid credential",
+			Error:   webAuthnError(err),
+		})
+	}
+
+	var user *webAuthnUser
+	credential, err := server.WebAuthn.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		userID, err := strconv.ParseInt(string(userHandle), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user handle")
+		}
+
+		user, err = server.loadWebAuthnUser(c, userID)
+		if err != nil {
+			return nil, err
+		}
+
+		return user, nil
+	}, *session, parsed)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: "Passkey verification failed",
+			Error:   webAuthnError(err),
+		})
+	}
+
+	// A signature counter going backwards means the authenticator was cloned
+	if credential.Authenticator.CloneWarning {
+		return c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: "Passkey verification failed",
+			Error:   "signature counter did not increase",
+		})
+	}
+
+	if user.user.DisabledAt != nil {
+		return c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Message: "User is disabled",
+		})
+	}
+
+	// The session token can only be used once
+	err = server.JWT.RevokeToken(ctx, claims)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to revoke session token",
+			Error:   err.Error(),
+		})
+	}
+
+	err = server.Repository.UpdateWebAuthnCredentialSignCount(ctx, credential.ID, credential.Authenticator.SignCount)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to update credential",
+			Error:   err.Error(),
+		})
+	}
+
+	return server.completeLogin(c, user.user, LoginMethodPasskey)
+}
+
+func bindWebAuthnFinishRequest(c echo.Context) (finishRequest *models.WebAuthnFinishRequest, ok bool, err error) {
+	finishRequest = &models.WebAuthnFinishRequest{}
+
+	err = c.Bind(finishRequest)
+	if err != nil {
+		return nil, false, c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to read request",
+			Error:   err.Error(),
+		})
+	}
+
+	errs := finishRequest.Validate()
+	if len(errs) > 0 {
+		return nil, false, c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Invalid request",
+			Error:   errs,
+		})
+	}
+
+	return finishRequest, true, nil
+}
+
+// webAuthnUser loads the user with their credentials. When the user cannot
+// be loaded the response has already been written and ok is false.
+func (server *Server) webAuthnUser(c echo.Context, userID int64) (user *webAuthnUser, ok bool, err error) {
+	user, err = server.loadWebAuthnUser(c, userID)
+	if err != nil {
+		return nil, false, c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Message: "Failed to get user",
+			Error:   err.Error(),
+		})
+	}
+
+	return user, true, nil
+}
+
+func (server *Server) loadWebAuthnUser(c echo.Context, userID int64) (*webAuthnUser, error) {
+	ctx := c.Request().Context()
+
+	user, err := server.Repository.GetUser(ctx, &entity.UserFilter{
+		ID: &userID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("user not found")
+	}
+
+	credentials, err := server.Repository.ListWebAuthnCredentials(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webAuthnUser{
+		user:        user,
+		credentials: credentials,
+	}, nil
+}
+
+// webAuthnError includes the details of WebAuthn protocol errors, which are
+// more helpful than their generic message.
+func webAuthnError(err error) string {
+	protocolErr, ok := err.(*protocol.Error)
+	if !ok || protocolErr.Details == "" {
+		return err.Error()
+	}
+
+	if protocolErr.DevInfo != "" {
+		return protocolErr.Details + ": " + protocolErr.DevInfo
+	}
+
+	return protocolErr.Details
+}
+
+// webAuthnUser adapts a user and their stored credentials to webauthn.User.
+type webAuthnUser struct {
+	user        *entity.UserData
+	credentials []*entity.WebAuthnCredential
+}
+
+// WebAuthnID is the user handle stored in the passkey, which identifies the
+// user on a discoverable login.
+func (u *webAuthnUser) WebAuthnID() []byte {
+	return []byte(strconv.FormatInt(u.user.ID, 10))
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.user.PhoneNumber
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	return u.user.FullName
+}
+
+func (u *webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.credentials))
+	for _, stored := range u.credentials {
+		credential := webauthn.Credential{
+			ID:              stored.CredentialID,
+			PublicKey:       stored.PublicKey,
+			AttestationType: stored.AttestationType,
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    stored.AAGUID,
+				SignCount: stored.SignCount,
+			},
+		}
+		for _, transport := range stored.Transports {
+			credential.Transport = append(credential.Transport, protocol.AuthenticatorTransport(transport))
+		}
+
+		credentials = append(credentials, credential)
+	}
+
+	return credentials
+}
@@ -0,0 +1,249 @@
+// Package policy decides whether a subject may perform an action on a
+// resource. Permissions are granted by rules of (roles, resource, actions,
+// conditions) that are loaded from a policy file, so they can be changed
+// without touching the handlers and tested without a database.
+package policy
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Wildcard matches any role, resource or action in a rule
+const Wildcard = "*"
+
+type Rule struct {
+	Roles    []string `yaml:"roles"`
+	Resource string   `yaml:"resource"`
+	Actions  []string `yaml:"actions"`
+	// Conditions must all hold for the rule to apply, see parseCondition
+	Conditions []string `yaml:"conditions"`
+}
+
+type Policy struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Subject is the user performing an action.
+type Subject struct {
+	Roles      []string
+	Attributes map[string]string
+}
+
+// Resource is what an action is performed on.
+type Resource struct {
+	Type       string
+	Attributes map[string]string
+}
+
+// Evaluator checks actions against a compiled policy. A nil Evaluator denies
+// everything.
+type Evaluator struct {
+	rules []compiledRule
+}
+
+type compiledRule struct {
+	Rule
+	conditions []condition
+}
+
+// Load reads a YAML policy file and compiles it.
+func Load(path string) (*Evaluator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(data)
+}
+
+// Parse compiles a YAML policy.
+func Parse(data []byte) (*Evaluator, error) {
+	var p Policy
+
+	err := yaml.Unmarshal(data, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(p)
+}
+
+// New compiles a policy, failing on conditions that cannot be parsed.
+func New(p Policy) (*Evaluator, error) {
+	evaluator := &Evaluator{
+		rules: make([]compiledRule, 0, len(p.Rules)),
+	}
+
+	for i, rule := range p.Rules {
+		if rule.Resource == "" || len(rule.Actions) == 0 || len(rule.Roles) == 0 {
+			return nil, fmt.Errorf("rule %d: roles, resource and actions are required", i)
+		}
+
+		compiled := compiledRule{
+			Rule: rule,
+		}
+
+		for _, expression := range rule.Conditions {
+			cond, err := parseCondition(expression)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i, err)
+			}
+
+			compiled.conditions = append(compiled.conditions, cond)
+		}
+
+		evaluator.rules = append(evaluator.rules, compiled)
+	}
+
+	return evaluator, nil
+}
+
+// Allowed reports whether any rule grants the action on the resource to the
+// subject. Access is denied unless a rule explicitly allows it.
+func (e *Evaluator) Allowed(subject Subject, action string, resource Resource) bool {
+	if e == nil {
+		return false
+	}
+
+	for _, rule := range e.rules {
+		if rule.matches(subject, action, resource) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rule *compiledRule) matches(subject Subject, action string, resource Resource) bool {
+	if rule.Resource != Wildcard && rule.Resource != resource.Type {
+		return false
+	}
+
+	if !contains(rule.Actions, action) {
+		return false
+	}
+
+	hasRole := contains(rule.Roles, Wildcard)
+	for _, role := range subject.Roles {
+		if contains(rule.Roles, role) {
+			hasRole = true
+			break
+		}
+	}
+	if !hasRole {
+		return false
+	}
+
+	for _, cond := range rule.conditions {
+		if !cond.holds(subject, resource) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// condition compares two operands with == or !=.
+type condition struct {
+	left     operand
+	right    operand
+	negative bool
+}
+
+// operand is either an attribute of the subject or resource, or a literal.
+type operand struct {
+	source  string
+	name    string
+	literal string
+}
+
+// parseCondition parses expressions like
+//
+//	subject.estate_id == resource.estate_id
+//	resource.role != 'admin'
+//
+// An attribute that is not set never equals anything, so a condition on a
+// missing attribute can only hold with !=.
+func parseCondition(expression string) (condition, error) {
+	operator := "=="
+	negative := false
+	if strings.Contains(expression, "!=") {
+		operator = "!="
+		negative = true
+	}
+
+	parts := strings.Split(expression, operator)
+	if len(parts) != 2 {
+		return condition{}, fmt.Errorf("invalid condition %q: expected a single == or != comparison", expression)
+	}
+
+	left, err := parseOperand(parts[0])
+	if err != nil {
+		return condition{}, fmt.Errorf("invalid condition %q: %w", expression, err)
+	}
+
+	right, err := parseOperand(parts[1])
+	if err != nil {
+		return condition{}, fmt.Errorf("invalid condition %q: %w", expression, err)
+	}
+
+	return condition{
+		left:     left,
+		right:    right,
+		negative: negative,
+	}, nil
+}
+
+func parseOperand(text string) (operand, error) {
+	text = strings.TrimSpace(text)
+
+	if len(text) >= 2 && strings.HasPrefix(text, "'") && strings.HasSuffix(text, "'") {
+		return operand{literal: text[1 : len(text)-1]}, nil
+	}
+
+	source, name, found := strings.Cut(text, ".")
+	if !found || name == "" || (source != "subject" && source != "resource") {
+		return operand{}, fmt.Errorf("operand %q must be subject.<attribute>, resource.<attribute> or a quoted literal", text)
+	}
+
+	return operand{source: source, name: name}, nil
+}
+
+func (o operand) value(subject Subject, resource Resource) (string, bool) {
+	switch o.source {
+	case "subject":
+		value, ok := subject.Attributes[o.name]
+		return value, ok && value != ""
+	case "resource":
+		value, ok := resource.Attributes[o.name]
+		return value, ok && value != ""
+	default:
+		return o.literal, true
+	}
+}
+
+func (c condition) holds(subject Subject, resource Resource) bool {
+	left, leftOK := c.left.value(subject, resource)
+	right, rightOK := c.right.value(subject, resource)
+
+	equal := leftOK && rightOK && left == right
+	if c.negative {
+		return !equal
+	}
+
+	return equal
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == Wildcard || v == value {
+			return true
+		}
+	}
+
+	return false
+}
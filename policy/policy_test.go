@@ -0,0 +1,205 @@
+package policy_test
+
+import (
+	"testing"
+
+	"github.com/SawitProRecruitment/UserService/policy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPolicy = `
+rules:
+  - roles: [admin]
+    resource: "*"
+    actions: ["*"]
+  - roles: [estate_manager]
+    resource: user
+    actions: [read, disable]
+    conditions:
+      - subject.estate_id == resource.estate_id
+  - roles: ["*"]
+    resource: profile
+    actions: [update]
+    conditions:
+      - subject.id == resource.id
+      - resource.status != 'disabled'
+`
+
+func TestAllowed(t *testing.T) {
+	evaluator, err := policy.Parse([]byte(testPolicy))
+	require.NoError(t, err)
+
+	admin := policy.Subject{
+		Roles:      []string{"admin"},
+		Attributes: map[string]string{"id": "1"},
+	}
+	manager := policy.Subject{
+		Roles:      []string{"estate_manager"},
+		Attributes: map[string]string{"id": "2", "estate_id": "10"},
+	}
+	managerWithoutEstate := policy.Subject{
+		Roles:      []string{"estate_manager"},
+		Attributes: map[string]string{"id": "3"},
+	}
+	farmer := policy.Subject{
+		Roles:      []string{"farmer"},
+		Attributes: map[string]string{"id": "4", "estate_id": "10"},
+	}
+
+	userInEstate := policy.Resource{
+		Type:       "user",
+		Attributes: map[string]string{"id": "4", "estate_id": "10"},
+	}
+	userInOtherEstate := policy.Resource{
+		Type:       "user",
+		Attributes: map[string]string{"id": "5", "estate_id": "20"},
+	}
+	userWithoutEstate := policy.Resource{
+		Type:       "user",
+		Attributes: map[string]string{"id": "6"},
+	}
+
+	tests := []struct {
+		name     string
+		subject  policy.Subject
+		action   string
+		resource policy.Resource
+		allowed  bool
+	}{
+		{
+			name:     "Admin Can Do Anything",
+			subject:  admin,
+			action:   "delete",
+			resource: userInOtherEstate,
+			allowed:  true,
+		},
+		{
+			name:     "Estate Manager In Own Estate",
+			subject:  manager,
+			action:   "disable",
+			resource: userInEstate,
+			allowed:  true,
+		},
+		{
+			name:     "Estate Manager In Other Estate",
+			subject:  manager,
+			action:   "disable",
+			resource: userInOtherEstate,
+			allowed:  false,
+		},
+		{
+			name:     "Estate Manager Action Not Granted",
+			subject:  manager,
+			action:   "delete",
+			resource: userInEstate,
+			allowed:  false,
+		},
+		{
+			name:     "Missing Attributes Never Match",
+			subject:  managerWithoutEstate,
+			action:   "read",
+			resource: userWithoutEstate,
+			allowed:  false,
+		},
+		{
+			name:     "Role Not Granted",
+			subject:  farmer,
+			action:   "read",
+			resource: userInEstate,
+			allowed:  false,
+		},
+		{
+			name:    "Any Role On Own Profile",
+			subject: farmer,
+			action:  "update",
+			resource: policy.Resource{
+				Type:       "profile",
+				Attributes: map[string]string{"id": "4"},
+			},
+			allowed: true,
+		},
+		{
+			name:    "Literal Condition",
+			subject: farmer,
+			action:  "update",
+			resource: policy.Resource{
+				Type:       "profile",
+				Attributes: map[string]string{"id": "4", "status": "disabled"},
+			},
+			allowed: false,
+		},
+		{
+			name:    "Other Profile",
+			subject: farmer,
+			action:  "update",
+			resource: policy.Resource{
+				Type:       "profile",
+				Attributes: map[string]string{"id": "5"},
+			},
+			allowed: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.allowed, evaluator.Allowed(tt.subject, tt.action, tt.resource))
+		})
+	}
+}
+
+func TestNilEvaluatorDenies(t *testing.T) {
+	var evaluator *policy.Evaluator
+
+	assert.False(t, evaluator.Allowed(policy.Subject{Roles: []string{"admin"}}, "read", policy.Resource{Type: "user"}))
+}
+
+func TestParseInvalidPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+	}{
+		{
+			name: "Missing Actions",
+			policy: `
+rules:
+  - roles: [admin]
+    resource: user
+`,
+		},
+		{
+			name: "Unknown Operator",
+			policy: `
+rules:
+  - roles: [admin]
+    resource: user
+    actions: [read]
+    conditions:
+      - subject.id < resource.id
+`,
+		},
+		{
+			name: "Unknown Operand",
+			policy: `
+rules:
+  - roles: [admin]
+    resource: user
+    actions: [read]
+    conditions:
+      - owner.id == resource.id
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := policy.Parse([]byte(tt.policy))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLoadShippedPolicy(t *testing.T) {
+	_, err := policy.Load("../policy.yml")
+	require.NoError(t, err)
+}
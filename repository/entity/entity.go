@@ -1,13 +1,117 @@
 package entity
 
+import "time"
+
 type UserData struct {
+	ID            int64
+	PhoneNumber   string
+	PhoneVerified bool
+	FullName      string
+	Password      string
+	// LegacyPasswordSalt is the phone number an old password hash was salted
+	// with, empty for current hashes
+	LegacyPasswordSalt string
+	EstateID           *int64
+	CreatedAt          time.Time
+	DisabledAt         *time.Time
+}
+
+type UserFilter struct {
+	ID                *int64
+	PhoneNumber       *string
+	PhoneNumberPrefix *string
+	FullNameContains  *string
+	EstateID          *int64
+	// CreatedFrom is inclusive, CreatedTo is exclusive
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+}
+
+type RefreshToken struct {
+	ID        int64
+	UserID    int64
+	FamilyID  string
+	TokenHash string
+	ExpiresAt time.Time
+	RevokedAt *time.Time
+}
+
+// Session is a login, whose ID is the family of the refresh tokens it
+// started.
+type Session struct {
+	ID     string
+	UserID int64
+	// Method is how the user logged in, like password or passkey
+	Method    string
+	IPAddress string
+	UserAgent string
+	CreatedAt time.Time
+	// LastUsedAt is when the session last refreshed its tokens
+	LastUsedAt time.Time
+}
+
+type OAuthClient struct {
+	ID           int64
+	ClientID     string
+	Name         string
+	RedirectURIs []string
+	// ClientSecretHash is only set for confidential clients
+	ClientSecretHash string
+	// Scopes a confidential client may request for itself
+	Scopes    []string
+	CreatedBy int64
+}
+
+type AuthorizationCode struct {
+	CodeHash      string
+	ClientID      string
+	UserID        int64
+	RedirectURI   string
+	Scope         string
+	CodeChallenge string
+	ExpiresAt     time.Time
+}
+
+type TOTP struct {
+	UserID int64
+	Secret string
+	// ConfirmedAt is nil until enrollment is confirmed with a first code
+	ConfirmedAt *time.Time
+	// LastUsedStep is the time step of the last accepted code
+	LastUsedStep int64
+}
+
+type WebAuthnCredential struct {
+	ID              int64
+	UserID          int64
+	CredentialID    []byte
+	PublicKey       []byte
+	AttestationType string
+	AAGUID          []byte
+	// SignCount is the last signature counter seen, used to detect cloned authenticators
+	SignCount  uint32
+	Transports []string
+}
+
+// OTP is a one-time code sent by SMS to prove ownership of a phone number.
+type OTP struct {
 	ID          int64
 	PhoneNumber string
-	FullName    string
-	Password    string
+	// Purpose keeps codes sent for different flows apart
+	Purpose  string
+	CodeHash string
+	// IPAddress the code was requested from
+	IPAddress string
+	Attempts  int
+	ExpiresAt time.Time
 }
 
-type UserFilter struct {
-	ID          *int64
-	PhoneNumber *string
+// LoginFailures counts the failed logins of an account or IP address.
+type LoginFailures struct {
+	Scope          string
+	Key            string
+	FailedAttempts int
+	LastFailedAt   time.Time
+	// LockedUntil is set when too many logins failed
+	LockedUntil *time.Time
 }
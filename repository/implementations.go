@@ -6,9 +6,16 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/SawitProRecruitment/UserService/handler/models"
 	"github.com/SawitProRecruitment/UserService/repository/entity"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrRefreshTokenRevoked = errors.New("refresh token already revoked")
+	ErrTOTPCodeUsed        = errors.New("TOTP code already used")
 )
 
 func (r *Repository) CreateUser(ctx context.Context, req *models.RegisterUserRequest) (int64, error) {
@@ -25,30 +32,156 @@ func (r *Repository) CreateUser(ctx context.Context, req *models.RegisterUserReq
 	return lastInsertID, nil
 }
 
+const userColumns = "id, phone_number, phone_verified, full_name, password, legacy_password_salt, estate_id, created_at, disabled_at"
+
 func (r *Repository) GetUser(ctx context.Context, filter *entity.UserFilter) (*entity.UserData, error) {
-	user := new(entity.UserData)
+	where, args := userConditions(filter)
+	query := "SELECT " + userColumns + " FROM users" + where
+
+	user, err := scanUser(r.Db.QueryRowContext(ctx, query, args...))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// ListUsers returns a page of the users matching the filter, ordered by ID,
+// together with the total number of matching users.
+func (r *Repository) ListUsers(ctx context.Context, filter *entity.UserFilter, limit, offset int) ([]*entity.UserData, int64, error) {
+	where, args := userConditions(filter)
+
+	var total int64
+	err := r.Db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users"+where, args...).
+		Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM users%s ORDER BY id LIMIT $%d OFFSET $%d",
+		userColumns, where, len(args)+1, len(args)+2)
+
+	rows, err := r.Db.QueryContext(ctx, query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []*entity.UserData{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		users = append(users, user)
+	}
+
+	return users, total, rows.Err()
+}
 
-	var condition []string
-	query := "SELECT id, phone_number, full_name, password FROM users"
+func (r *Repository) SetUserDisabled(ctx context.Context, userID int64, disabled bool) error {
+	query := "UPDATE users SET disabled_at = NULL WHERE id = $1"
+	if disabled {
+		// Keep the original time when disabling an already disabled user
+		query = "UPDATE users SET disabled_at = COALESCE(disabled_at, NOW()) WHERE id = $1"
+	}
+
+	result, err := r.Db.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("user with ID %d not found", userID)
+	}
+
+	return nil
+}
+
+// userConditions builds the WHERE clause and its arguments for a user filter.
+func userConditions(filter *entity.UserFilter) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
 
 	if filter.ID != nil {
-		condition = append(condition, fmt.Sprintf(" WHERE id = %d", *filter.ID))
+		addCondition("id = $%d", *filter.ID)
 	}
 
 	if filter.PhoneNumber != nil {
-		condition = append(condition, fmt.Sprintf(" WHERE phone_number = '%s'", *filter.PhoneNumber))
+		addCondition("phone_number = $%d", *filter.PhoneNumber)
+	}
+
+	if filter.PhoneNumberPrefix != nil {
+		addCondition("phone_number LIKE $%d", escapeLike(*filter.PhoneNumberPrefix)+"%")
 	}
 
-	query += strings.Join(condition, " AND ")
+	if filter.FullNameContains != nil {
+		addCondition("full_name ILIKE $%d", "%"+escapeLike(*filter.FullNameContains)+"%")
+	}
+
+	if filter.EstateID != nil {
+		addCondition("estate_id = $%d", *filter.EstateID)
+	}
+
+	if filter.CreatedFrom != nil {
+		addCondition("created_at >= $%d", *filter.CreatedFrom)
+	}
+
+	if filter.CreatedTo != nil {
+		addCondition("created_at < $%d", *filter.CreatedTo)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
 
-	err := r.Db.QueryRowContext(ctx, query).
-		Scan(&user.ID, &user.PhoneNumber, &user.FullName, &user.Password)
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanUser reads a row selected with userColumns.
+func scanUser(row rowScanner) (*entity.UserData, error) {
+	user := new(entity.UserData)
+
+	var legacyPasswordSalt sql.NullString
+	var estateID sql.NullInt64
+	var disabledAt sql.NullTime
+	err := row.Scan(&user.ID, &user.PhoneNumber, &user.PhoneVerified, &user.FullName, &user.Password, &legacyPasswordSalt, &estateID, &user.CreatedAt, &disabledAt)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
-		}
+		return nil, err
+	}
+
+	user.LegacyPasswordSalt = legacyPasswordSalt.String
 
-		return user, err
+	if estateID.Valid {
+		user.EstateID = &estateID.Int64
+	}
+
+	if disabledAt.Valid {
+		user.DisabledAt = &disabledAt.Time
 	}
 
 	return user, nil
@@ -59,21 +192,27 @@ func (r *Repository) UpdateProfile(ctx context.Context, userID int64, req *model
 		return nil
 	}
 
-	query := "UPDATE users SET"
+	var assignments []string
+	args := []interface{}{userID}
+
+	addAssignment := func(assignment string, arg interface{}) {
+		args = append(args, arg)
+		assignments = append(assignments, fmt.Sprintf(assignment, len(args)))
+	}
 
 	if req.FullName != nil {
-		query += fmt.Sprintf(" full_name = '%s',", *req.FullName)
+		addAssignment("full_name = $%d", *req.FullName)
 	}
 
+	// A new phone number has to be verified again
 	if req.PhoneNumber != nil {
-		query += fmt.Sprintf(" phone_number = '%s',", *req.PhoneNumber)
+		addAssignment("phone_number = $%d", *req.PhoneNumber)
+		assignments = append(assignments, "phone_verified = FALSE")
 	}
 
-	query = query[:len(query)-1]
-
-	query += fmt.Sprintf(" WHERE id = %d", userID)
+	query := "UPDATE users SET " + strings.Join(assignments, ", ") + " WHERE id = $1"
 
-	result, err := r.Db.ExecContext(ctx, query)
+	result, err := r.Db.ExecContext(ctx, query, args...)
 	if err != nil {
 		return err
 	}
@@ -90,6 +229,24 @@ func (r *Repository) UpdateProfile(ctx context.Context, userID int64, req *model
 	return nil
 }
 
+func (r *Repository) UpdatePassword(ctx context.Context, userID int64, hashedPassword string) error {
+	result, err := r.Db.ExecContext(ctx, "UPDATE users SET password = $2, legacy_password_salt = NULL WHERE id = $1", userID, hashedPassword)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("user %d not found", userID)
+	}
+
+	return nil
+}
+
 func (r *Repository) IncLogin(ctx context.Context, userID int64) error {
 	_, err := r.Db.ExecContext(ctx,
 		"UPDATE users SET successful_login = successful_login + 1 WHERE id = $1",
@@ -97,3 +254,606 @@ func (r *Repository) IncLogin(ctx context.Context, userID int64) error {
 
 	return err
 }
+
+func (r *Repository) CreateRefreshToken(ctx context.Context, token *entity.RefreshToken) error {
+	return r.Db.QueryRowContext(ctx,
+		"INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at) VALUES ($1, $2, $3, $4) RETURNING id",
+		token.UserID, token.FamilyID, token.TokenHash, token.ExpiresAt).
+		Scan(&token.ID)
+}
+
+func (r *Repository) GetRefreshToken(ctx context.Context, tokenHash string) (*entity.RefreshToken, error) {
+	token := new(entity.RefreshToken)
+
+	var revokedAt sql.NullTime
+	err := r.Db.QueryRowContext(ctx,
+		"SELECT id, user_id, family_id, token_hash, expires_at, revoked_at FROM refresh_tokens WHERE token_hash = $1",
+		tokenHash).
+		Scan(&token.ID, &token.UserID, &token.FamilyID, &token.TokenHash, &token.ExpiresAt, &revokedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	if revokedAt.Valid {
+		token.RevokedAt = &revokedAt.Time
+	}
+
+	return token, nil
+}
+
+// RotateRefreshToken revokes the refresh token with oldID and stores newToken
+// in a single transaction. It returns ErrRefreshTokenRevoked when the old token
+// was already revoked, e.g. by a concurrent rotation.
+func (r *Repository) RotateRefreshToken(ctx context.Context, oldID int64, newToken *entity.RefreshToken) error {
+	tx, err := r.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx,
+		"UPDATE refresh_tokens SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL",
+		oldID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRefreshTokenRevoked
+	}
+
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at) VALUES ($1, $2, $3, $4) RETURNING id",
+		newToken.UserID, newToken.FamilyID, newToken.TokenHash, newToken.ExpiresAt).
+		Scan(&newToken.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *Repository) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	_, err := r.Db.ExecContext(ctx,
+		"UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL",
+		familyID)
+	return err
+}
+
+func (r *Repository) CreateOAuthClient(ctx context.Context, client *entity.OAuthClient) error {
+	var clientSecretHash sql.NullString
+	if client.ClientSecretHash != "" {
+		clientSecretHash = sql.NullString{String: client.ClientSecretHash, Valid: true}
+	}
+
+	return r.Db.QueryRowContext(ctx,
+		"INSERT INTO oauth_clients (client_id, name, redirect_uris, client_secret_hash, scopes, created_by) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		client.ClientID, client.Name, pq.Array(client.RedirectURIs), clientSecretHash, pq.Array(client.Scopes), client.CreatedBy).
+		Scan(&client.ID)
+}
+
+func (r *Repository) GetOAuthClient(ctx context.Context, clientID string) (*entity.OAuthClient, error) {
+	client := new(entity.OAuthClient)
+
+	var clientSecretHash sql.NullString
+	var createdBy sql.NullInt64
+	err := r.Db.QueryRowContext(ctx,
+		"SELECT id, client_id, name, redirect_uris, client_secret_hash, scopes, created_by FROM oauth_clients WHERE client_id = $1",
+		clientID).
+		Scan(&client.ID, &client.ClientID, &client.Name, pq.Array(&client.RedirectURIs), &clientSecretHash, pq.Array(&client.Scopes), &createdBy)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	client.ClientSecretHash = clientSecretHash.String
+	client.CreatedBy = createdBy.Int64
+
+	return client, nil
+}
+
+func (r *Repository) CreateAuthorizationCode(ctx context.Context, code *entity.AuthorizationCode) error {
+	_, err := r.Db.ExecContext(ctx,
+		"INSERT INTO oauth_authorization_codes (code_hash, client_id, user_id, redirect_uri, scope, code_challenge, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		code.CodeHash, code.ClientID, code.UserID, code.RedirectURI, code.Scope, code.CodeChallenge, code.ExpiresAt)
+	return err
+}
+
+// ConsumeAuthorizationCode marks an unused, unexpired authorization code as
+// used and returns it. It returns nil when there is no such code, so a code
+// can only ever be exchanged once.
+func (r *Repository) ConsumeAuthorizationCode(ctx context.Context, codeHash string) (*entity.AuthorizationCode, error) {
+	code := new(entity.AuthorizationCode)
+
+	err := r.Db.QueryRowContext(ctx,
+		"UPDATE oauth_authorization_codes SET used_at = NOW() WHERE code_hash = $1 AND used_at IS NULL AND expires_at > NOW() "+
+			"RETURNING code_hash, client_id, user_id, redirect_uri, scope, code_challenge, expires_at",
+		codeHash).
+		Scan(&code.CodeHash, &code.ClientID, &code.UserID, &code.RedirectURI, &code.Scope, &code.CodeChallenge, &code.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return code, nil
+}
+
+func (r *Repository) GetUserRoles(ctx context.Context, userID int64) ([]string, error) {
+	rows, err := r.Db.QueryContext(ctx,
+		"SELECT roles.name FROM user_roles JOIN roles ON roles.id = user_roles.role_id WHERE user_roles.user_id = $1 ORDER BY roles.name",
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []string
+	for rows.Next() {
+		var role string
+
+		err = rows.Scan(&role)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, role)
+	}
+
+	return roles, rows.Err()
+}
+
+func (r *Repository) AssignRole(ctx context.Context, userID int64, role string) error {
+	_, err := r.Db.ExecContext(ctx,
+		"INSERT INTO user_roles (user_id, role_id) SELECT $1, id FROM roles WHERE name = $2 ON CONFLICT DO NOTHING",
+		userID, role)
+	return err
+}
+
+func (r *Repository) RemoveRole(ctx context.Context, userID int64, role string) error {
+	_, err := r.Db.ExecContext(ctx,
+		"DELETE FROM user_roles USING roles WHERE user_roles.role_id = roles.id AND user_roles.user_id = $1 AND roles.name = $2",
+		userID, role)
+	return err
+}
+
+func (r *Repository) RevokeUserRefreshTokens(ctx context.Context, userID int64) error {
+	_, err := r.Db.ExecContext(ctx,
+		"UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL",
+		userID)
+	return err
+}
+
+func (r *Repository) CreateSession(ctx context.Context, session *entity.Session) error {
+	return r.Db.QueryRowContext(ctx,
+		"INSERT INTO sessions (id, user_id, method, ip_address, user_agent) VALUES ($1, $2, $3, $4, $5) RETURNING created_at, last_used_at",
+		session.ID, session.UserID, session.Method, session.IPAddress, session.UserAgent).
+		Scan(&session.CreatedAt, &session.LastUsedAt)
+}
+
+const sessionColumns = "id, user_id, method, ip_address, user_agent, created_at, last_used_at"
+
+// scanSession reads a row selected with sessionColumns.
+func scanSession(row rowScanner) (*entity.Session, error) {
+	session := new(entity.Session)
+
+	err := row.Scan(&session.ID, &session.UserID, &session.Method, &session.IPAddress, &session.UserAgent,
+		&session.CreatedAt, &session.LastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func (r *Repository) GetSession(ctx context.Context, id string) (*entity.Session, error) {
+	session, err := scanSession(r.Db.QueryRowContext(ctx,
+		"SELECT "+sessionColumns+" FROM sessions WHERE id = $1",
+		id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return session, err
+}
+
+// ListActiveSessions returns the sessions of the user that still have a
+// valid refresh token, most recently used first. Sessions end when their
+// refresh token family is revoked, whichever way that happens.
+func (r *Repository) ListActiveSessions(ctx context.Context, userID int64) ([]*entity.Session, error) {
+	rows, err := r.Db.QueryContext(ctx,
+		"SELECT "+sessionColumns+" FROM sessions WHERE user_id = $1 AND EXISTS ("+
+			"SELECT 1 FROM refresh_tokens WHERE family_id = sessions.id AND revoked_at IS NULL AND expires_at > NOW()"+
+			") ORDER BY last_used_at DESC",
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*entity.Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (r *Repository) TouchSession(ctx context.Context, id string) error {
+	_, err := r.Db.ExecContext(ctx,
+		"UPDATE sessions SET last_used_at = NOW() WHERE id = $1",
+		id)
+	return err
+}
+
+// ResetPassword replaces the password of the user and revokes all their
+// refresh tokens, so sessions started with the old password end.
+func (r *Repository) ResetPassword(ctx context.Context, userID int64, hashedPassword string) error {
+	tx, err := r.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "UPDATE users SET password = $2, legacy_password_salt = NULL WHERE id = $1", userID, hashedPassword)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("user %d not found", userID)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL",
+		userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *Repository) GetTOTP(ctx context.Context, userID int64) (*entity.TOTP, error) {
+	totp := new(entity.TOTP)
+
+	var confirmedAt sql.NullTime
+	err := r.Db.QueryRowContext(ctx,
+		"SELECT user_id, secret, confirmed_at, last_used_step FROM user_totp WHERE user_id = $1",
+		userID).
+		Scan(&totp.UserID, &totp.Secret, &confirmedAt, &totp.LastUsedStep)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	if confirmedAt.Valid {
+		totp.ConfirmedAt = &confirmedAt.Time
+	}
+
+	return totp, nil
+}
+
+// SetTOTPSecret starts a new enrollment with the secret, replacing an earlier
+// unconfirmed one. A confirmed enrollment is left untouched.
+func (r *Repository) SetTOTPSecret(ctx context.Context, userID int64, secret string) error {
+	_, err := r.Db.ExecContext(ctx,
+		"INSERT INTO user_totp (user_id, secret) VALUES ($1, $2) "+
+			"ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, last_used_step = 0 WHERE user_totp.confirmed_at IS NULL",
+		userID, secret)
+	return err
+}
+
+// ConfirmTOTP completes the enrollment with the step of the first code and
+// replaces the recovery codes of the user in a single transaction.
+func (r *Repository) ConfirmTOTP(ctx context.Context, userID int64, step int64, recoveryCodeHashes []string) error {
+	tx, err := r.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx,
+		"UPDATE user_totp SET confirmed_at = NOW(), last_used_step = $2 WHERE user_id = $1 AND confirmed_at IS NULL",
+		userID, step)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("no pending TOTP enrollment for user %d", userID)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO recovery_codes (user_id, code_hash) SELECT $1, UNNEST($2::VARCHAR[])",
+		userID, pq.Array(recoveryCodeHashes))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records the step of an accepted code. It returns ErrTOTPCodeUsed
+// when a code of the same or a later step was already accepted, so every code
+// can only be used once.
+func (r *Repository) UseTOTPStep(ctx context.Context, userID int64, step int64) error {
+	result, err := r.Db.ExecContext(ctx,
+		"UPDATE user_totp SET last_used_step = $2 WHERE user_id = $1 AND confirmed_at IS NOT NULL AND last_used_step < $2",
+		userID, step)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrTOTPCodeUsed
+	}
+
+	return nil
+}
+
+// ConsumeRecoveryCode marks an unused recovery code of the user as used and
+// reports whether there was one.
+func (r *Repository) ConsumeRecoveryCode(ctx context.Context, userID int64, codeHash string) (bool, error) {
+	result, err := r.Db.ExecContext(ctx,
+		"UPDATE recovery_codes SET used_at = NOW() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL",
+		userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+func (r *Repository) CreateWebAuthnCredential(ctx context.Context, credential *entity.WebAuthnCredential) error {
+	return r.Db.QueryRowContext(ctx,
+		"INSERT INTO webauthn_credentials (user_id, credential_id, public_key, attestation_type, aaguid, sign_count, transports) "+
+			"VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id",
+		credential.UserID, credential.CredentialID, credential.PublicKey, credential.AttestationType,
+		credential.AAGUID, credential.SignCount, pq.Array(credential.Transports)).
+		Scan(&credential.ID)
+}
+
+func (r *Repository) ListWebAuthnCredentials(ctx context.Context, userID int64) ([]*entity.WebAuthnCredential, error) {
+	rows, err := r.Db.QueryContext(ctx,
+		"SELECT id, user_id, credential_id, public_key, attestation_type, aaguid, sign_count, transports "+
+			"FROM webauthn_credentials WHERE user_id = $1 ORDER BY id",
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var credentials []*entity.WebAuthnCredential
+	for rows.Next() {
+		credential := new(entity.WebAuthnCredential)
+
+		err = rows.Scan(&credential.ID, &credential.UserID, &credential.CredentialID, &credential.PublicKey,
+			&credential.AttestationType, &credential.AAGUID, &credential.SignCount, pq.Array(&credential.Transports))
+		if err != nil {
+			return nil, err
+		}
+
+		credentials = append(credentials, credential)
+	}
+
+	return credentials, rows.Err()
+}
+
+func (r *Repository) UpdateWebAuthnCredentialSignCount(ctx context.Context, credentialID []byte, signCount uint32) error {
+	_, err := r.Db.ExecContext(ctx,
+		"UPDATE webauthn_credentials SET sign_count = $2, last_used_at = NOW() WHERE credential_id = $1",
+		credentialID, signCount)
+	return err
+}
+
+func (r *Repository) SetPhoneVerified(ctx context.Context, userID int64) error {
+	_, err := r.Db.ExecContext(ctx,
+		"UPDATE users SET phone_verified = TRUE WHERE id = $1",
+		userID)
+	return err
+}
+
+func (r *Repository) CreateOTP(ctx context.Context, otp *entity.OTP) error {
+	return r.Db.QueryRowContext(ctx,
+		"INSERT INTO phone_otps (phone_number, purpose, code_hash, ip_address, expires_at) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		otp.PhoneNumber, otp.Purpose, otp.CodeHash, otp.IPAddress, otp.ExpiresAt).
+		Scan(&otp.ID)
+}
+
+// CountOTPs returns how many codes were sent to the phone number for the
+// purpose since the given time.
+func (r *Repository) CountOTPs(ctx context.Context, phoneNumber, purpose string, since time.Time) (int, error) {
+	var count int
+
+	err := r.Db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM phone_otps WHERE phone_number = $1 AND purpose = $2 AND created_at > $3",
+		phoneNumber, purpose, since).
+		Scan(&count)
+
+	return count, err
+}
+
+// CountOTPsByIP returns how many codes were requested from the IP address for
+// the purpose since the given time.
+func (r *Repository) CountOTPsByIP(ctx context.Context, ipAddress, purpose string, since time.Time) (int, error) {
+	var count int
+
+	err := r.Db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM phone_otps WHERE ip_address = $1 AND purpose = $2 AND created_at > $3",
+		ipAddress, purpose, since).
+		Scan(&count)
+
+	return count, err
+}
+
+// GetActiveOTP returns the latest unused, unexpired code sent to the phone
+// number for the purpose, or nil if there is none. Sending a new code makes
+// earlier ones inactive.
+func (r *Repository) GetActiveOTP(ctx context.Context, phoneNumber, purpose string) (*entity.OTP, error) {
+	otp := new(entity.OTP)
+
+	err := r.Db.QueryRowContext(ctx,
+		"SELECT id, phone_number, purpose, code_hash, ip_address, attempts, expires_at FROM phone_otps "+
+			"WHERE phone_number = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > NOW() "+
+			"AND id = (SELECT MAX(id) FROM phone_otps WHERE phone_number = $1 AND purpose = $2)",
+		phoneNumber, purpose).
+		Scan(&otp.ID, &otp.PhoneNumber, &otp.Purpose, &otp.CodeHash, &otp.IPAddress, &otp.Attempts, &otp.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return otp, nil
+}
+
+// UseOTPAttempt counts a guess at the code and reports whether it was still
+// allowed, so concurrent guesses cannot get past maxAttempts.
+func (r *Repository) UseOTPAttempt(ctx context.Context, otpID int64, maxAttempts int) (bool, error) {
+	var attempts int
+
+	err := r.Db.QueryRowContext(ctx,
+		"UPDATE phone_otps SET attempts = attempts + 1 WHERE id = $1 AND attempts < $2 RETURNING attempts",
+		otpID, maxAttempts).
+		Scan(&attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ConsumeOTP marks the code as used and reports whether it was still unused,
+// so a code can only be used once even by concurrent requests.
+func (r *Repository) ConsumeOTP(ctx context.Context, otpID int64) (bool, error) {
+	result, err := r.Db.ExecContext(ctx,
+		"UPDATE phone_otps SET used_at = NOW() WHERE id = $1 AND used_at IS NULL",
+		otpID)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+func (r *Repository) GetLoginFailures(ctx context.Context, scope, key string) (*entity.LoginFailures, error) {
+	failures := new(entity.LoginFailures)
+
+	var lockedUntil sql.NullTime
+	err := r.Db.QueryRowContext(ctx,
+		"SELECT scope, key, failed_attempts, last_failed_at, locked_until FROM login_failures WHERE scope = $1 AND key = $2",
+		scope, key).
+		Scan(&failures.Scope, &failures.Key, &failures.FailedAttempts, &failures.LastFailedAt, &lockedUntil)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	if lockedUntil.Valid {
+		failures.LockedUntil = &lockedUntil.Time
+	}
+
+	return failures, nil
+}
+
+// RecordLoginFailure counts a failed login and returns how many failed in a
+// row. Failures before the given time are forgotten, so the count starts
+// over after a quiet period.
+func (r *Repository) RecordLoginFailure(ctx context.Context, scope, key string, since time.Time) (int, error) {
+	var failedAttempts int
+
+	err := r.Db.QueryRowContext(ctx,
+		"INSERT INTO login_failures (scope, key, failed_attempts) VALUES ($1, $2, 1) "+
+			"ON CONFLICT (scope, key) DO UPDATE SET "+
+			"failed_attempts = CASE WHEN login_failures.last_failed_at < $3 THEN 1 ELSE login_failures.failed_attempts + 1 END, "+
+			"last_failed_at = NOW() "+
+			"RETURNING failed_attempts",
+		scope, key, since).
+		Scan(&failedAttempts)
+
+	return failedAttempts, err
+}
+
+func (r *Repository) LockLogin(ctx context.Context, scope, key string, until time.Time) error {
+	_, err := r.Db.ExecContext(ctx,
+		"UPDATE login_failures SET locked_until = $3 WHERE scope = $1 AND key = $2",
+		scope, key, until)
+	return err
+}
+
+func (r *Repository) ClearLoginFailures(ctx context.Context, scope, key string) error {
+	_, err := r.Db.ExecContext(ctx,
+		"DELETE FROM login_failures WHERE scope = $1 AND key = $2",
+		scope, key)
+	return err
+}
+
+// PruneLoginFailures deletes the failures last counted before the given
+// time, unless they still hold a lock.
+func (r *Repository) PruneLoginFailures(ctx context.Context, before time.Time) error {
+	_, err := r.Db.ExecContext(ctx,
+		"DELETE FROM login_failures WHERE last_failed_at < $1 AND (locked_until IS NULL OR locked_until < NOW())",
+		before)
+	return err
+}
@@ -6,6 +6,7 @@ package repository
 
 import (
 	"context"
+	"time"
 
 	"github.com/SawitProRecruitment/UserService/handler/models"
 	"github.com/SawitProRecruitment/UserService/repository/entity"
@@ -14,6 +15,59 @@ import (
 type RepositoryInterface interface {
 	CreateUser(ctx context.Context, req *models.RegisterUserRequest) (int64, error)
 	GetUser(ctx context.Context, filter *entity.UserFilter) (*entity.UserData, error)
+	ListUsers(ctx context.Context, filter *entity.UserFilter, limit, offset int) ([]*entity.UserData, int64, error)
+	SetUserDisabled(ctx context.Context, userID int64, disabled bool) error
 	UpdateProfile(ctx context.Context, userID int64, req *models.UpdateUserProfileRequest) error
+	UpdatePassword(ctx context.Context, userID int64, hashedPassword string) error
 	IncLogin(ctx context.Context, userID int64) error
+	CreateRefreshToken(ctx context.Context, token *entity.RefreshToken) error
+	GetRefreshToken(ctx context.Context, tokenHash string) (*entity.RefreshToken, error)
+	RotateRefreshToken(ctx context.Context, oldID int64, newToken *entity.RefreshToken) error
+	RevokeRefreshTokenFamily(ctx context.Context, familyID string) error
+	RevokeUserRefreshTokens(ctx context.Context, userID int64) error
+	CreateSession(ctx context.Context, session *entity.Session) error
+	GetSession(ctx context.Context, id string) (*entity.Session, error)
+	ListActiveSessions(ctx context.Context, userID int64) ([]*entity.Session, error)
+	TouchSession(ctx context.Context, id string) error
+	ResetPassword(ctx context.Context, userID int64, hashedPassword string) error
+	CreateOAuthClient(ctx context.Context, client *entity.OAuthClient) error
+	GetOAuthClient(ctx context.Context, clientID string) (*entity.OAuthClient, error)
+	CreateAuthorizationCode(ctx context.Context, code *entity.AuthorizationCode) error
+	ConsumeAuthorizationCode(ctx context.Context, codeHash string) (*entity.AuthorizationCode, error)
+	GetUserRoles(ctx context.Context, userID int64) ([]string, error)
+	AssignRole(ctx context.Context, userID int64, role string) error
+	RemoveRole(ctx context.Context, userID int64, role string) error
+	GetTOTP(ctx context.Context, userID int64) (*entity.TOTP, error)
+	SetTOTPSecret(ctx context.Context, userID int64, secret string) error
+	ConfirmTOTP(ctx context.Context, userID int64, step int64, recoveryCodeHashes []string) error
+	UseTOTPStep(ctx context.Context, userID int64, step int64) error
+	ConsumeRecoveryCode(ctx context.Context, userID int64, codeHash string) (bool, error)
+	CreateWebAuthnCredential(ctx context.Context, credential *entity.WebAuthnCredential) error
+	ListWebAuthnCredentials(ctx context.Context, userID int64) ([]*entity.WebAuthnCredential, error)
+	UpdateWebAuthnCredentialSignCount(ctx context.Context, credentialID []byte, signCount uint32) error
+	SetPhoneVerified(ctx context.Context, userID int64) error
+	CreateOTP(ctx context.Context, otp *entity.OTP) error
+	CountOTPs(ctx context.Context, phoneNumber, purpose string, since time.Time) (int, error)
+	CountOTPsByIP(ctx context.Context, ipAddress, purpose string, since time.Time) (int, error)
+	GetActiveOTP(ctx context.Context, phoneNumber, purpose string) (*entity.OTP, error)
+	UseOTPAttempt(ctx context.Context, otpID int64, maxAttempts int) (bool, error)
+	ConsumeOTP(ctx context.Context, otpID int64) (bool, error)
+	GetLoginFailures(ctx context.Context, scope, key string) (*entity.LoginFailures, error)
+	RecordLoginFailure(ctx context.Context, scope, key string, since time.Time) (int, error)
+	LockLogin(ctx context.Context, scope, key string, until time.Time) error
+	ClearLoginFailures(ctx context.Context, scope, key string) error
+}
+
+// RevocationStoreInterface keeps track of access tokens that were revoked
+// before they expired, identified by their jti claim.
+type RevocationStoreInterface interface {
+	Revoke(ctx context.Context, jti string, expiresAt time.Time) error
+	IsRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+// RateLimitStoreInterface keeps token buckets by key. Take refills the bucket
+// to at most capacity tokens, gaining one every refillEvery, and takes a token
+// when there is one.
+type RateLimitStoreInterface interface {
+	Take(ctx context.Context, key string, capacity int, refillEvery time.Duration) (allowed bool, remaining float64, err error)
 }
@@ -7,6 +7,7 @@ package repository
 import (
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	models "github.com/SawitProRecruitment/UserService/handler/models"
 	entity "github.com/SawitProRecruitment/UserService/repository/entity"
@@ -36,6 +37,193 @@ func (m *MockRepositoryInterface) EXPECT() *MockRepositoryInterfaceMockRecorder
 	return m.recorder
 }
 
+// AssignRole mocks base method.
+func (m *MockRepositoryInterface) AssignRole(ctx context.Context, userID int64, role string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AssignRole", ctx, userID, role)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AssignRole indicates an expected call of AssignRole.
+func (mr *MockRepositoryInterfaceMockRecorder) AssignRole(ctx, userID, role interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AssignRole", reflect.TypeOf((*MockRepositoryInterface)(nil).AssignRole), ctx, userID, role)
+}
+
+// ClearLoginFailures mocks base method.
+func (m *MockRepositoryInterface) ClearLoginFailures(ctx context.Context, scope, key string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClearLoginFailures", ctx, scope, key)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ClearLoginFailures indicates an expected call of ClearLoginFailures.
+func (mr *MockRepositoryInterfaceMockRecorder) ClearLoginFailures(ctx, scope, key interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClearLoginFailures", reflect.TypeOf((*MockRepositoryInterface)(nil).ClearLoginFailures), ctx, scope, key)
+}
+
+// ConfirmTOTP mocks base method.
+func (m *MockRepositoryInterface) ConfirmTOTP(ctx context.Context, userID, step int64, recoveryCodeHashes []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConfirmTOTP", ctx, userID, step, recoveryCodeHashes)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ConfirmTOTP indicates an expected call of ConfirmTOTP.
+func (mr *MockRepositoryInterfaceMockRecorder) ConfirmTOTP(ctx, userID, step, recoveryCodeHashes interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConfirmTOTP", reflect.TypeOf((*MockRepositoryInterface)(nil).ConfirmTOTP), ctx, userID, step, recoveryCodeHashes)
+}
+
+// ConsumeAuthorizationCode mocks base method.
+func (m *MockRepositoryInterface) ConsumeAuthorizationCode(ctx context.Context, codeHash string) (*entity.AuthorizationCode, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConsumeAuthorizationCode", ctx, codeHash)
+	ret0, _ := ret[0].(*entity.AuthorizationCode)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ConsumeAuthorizationCode indicates an expected call of ConsumeAuthorizationCode.
+func (mr *MockRepositoryInterfaceMockRecorder) ConsumeAuthorizationCode(ctx, codeHash interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConsumeAuthorizationCode", reflect.TypeOf((*MockRepositoryInterface)(nil).ConsumeAuthorizationCode), ctx, codeHash)
+}
+
+// ConsumeOTP mocks base method.
+func (m *MockRepositoryInterface) ConsumeOTP(ctx context.Context, otpID int64) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConsumeOTP", ctx, otpID)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ConsumeOTP indicates an expected call of ConsumeOTP.
+func (mr *MockRepositoryInterfaceMockRecorder) ConsumeOTP(ctx, otpID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConsumeOTP", reflect.TypeOf((*MockRepositoryInterface)(nil).ConsumeOTP), ctx, otpID)
+}
+
+// ConsumeRecoveryCode mocks base method.
+func (m *MockRepositoryInterface) ConsumeRecoveryCode(ctx context.Context, userID int64, codeHash string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConsumeRecoveryCode", ctx, userID, codeHash)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ConsumeRecoveryCode indicates an expected call of ConsumeRecoveryCode.
+func (mr *MockRepositoryInterfaceMockRecorder) ConsumeRecoveryCode(ctx, userID, codeHash interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConsumeRecoveryCode", reflect.TypeOf((*MockRepositoryInterface)(nil).ConsumeRecoveryCode), ctx, userID, codeHash)
+}
+
+// CountOTPs mocks base method.
+func (m *MockRepositoryInterface) CountOTPs(ctx context.Context, phoneNumber, purpose string, since time.Time) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CountOTPs", ctx, phoneNumber, purpose, since)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CountOTPs indicates an expected call of CountOTPs.
+func (mr *MockRepositoryInterfaceMockRecorder) CountOTPs(ctx, phoneNumber, purpose, since interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountOTPs", reflect.TypeOf((*MockRepositoryInterface)(nil).CountOTPs), ctx, phoneNumber, purpose, since)
+}
+
+// CountOTPsByIP mocks base method.
+func (m *MockRepositoryInterface) CountOTPsByIP(ctx context.Context, ipAddress, purpose string, since time.Time) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CountOTPsByIP", ctx, ipAddress, purpose, since)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CountOTPsByIP indicates an expected call of CountOTPsByIP.
+func (mr *MockRepositoryInterfaceMockRecorder) CountOTPsByIP(ctx, ipAddress, purpose, since interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountOTPsByIP", reflect.TypeOf((*MockRepositoryInterface)(nil).CountOTPsByIP), ctx, ipAddress, purpose, since)
+}
+
+// CreateAuthorizationCode mocks base method.
+func (m *MockRepositoryInterface) CreateAuthorizationCode(ctx context.Context, code *entity.AuthorizationCode) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateAuthorizationCode", ctx, code)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateAuthorizationCode indicates an expected call of CreateAuthorizationCode.
+func (mr *MockRepositoryInterfaceMockRecorder) CreateAuthorizationCode(ctx, code interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateAuthorizationCode", reflect.TypeOf((*MockRepositoryInterface)(nil).CreateAuthorizationCode), ctx, code)
+}
+
+// CreateOAuthClient mocks base method.
+func (m *MockRepositoryInterface) CreateOAuthClient(ctx context.Context, client *entity.OAuthClient) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateOAuthClient", ctx, client)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateOAuthClient indicates an expected call of CreateOAuthClient.
+func (mr *MockRepositoryInterfaceMockRecorder) CreateOAuthClient(ctx, client interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateOAuthClient", reflect.TypeOf((*MockRepositoryInterface)(nil).CreateOAuthClient), ctx, client)
+}
+
+// CreateOTP mocks base method.
+func (m *MockRepositoryInterface) CreateOTP(ctx context.Context, otp *entity.OTP) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateOTP", ctx, otp)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateOTP indicates an expected call of CreateOTP.
+func (mr *MockRepositoryInterfaceMockRecorder) CreateOTP(ctx, otp interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateOTP", reflect.TypeOf((*MockRepositoryInterface)(nil).CreateOTP), ctx, otp)
+}
+
+// CreateRefreshToken mocks base method.
+func (m *MockRepositoryInterface) CreateRefreshToken(ctx context.Context, token *entity.RefreshToken) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateRefreshToken", ctx, token)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateRefreshToken indicates an expected call of CreateRefreshToken.
+func (mr *MockRepositoryInterfaceMockRecorder) CreateRefreshToken(ctx, token interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateRefreshToken", reflect.TypeOf((*MockRepositoryInterface)(nil).CreateRefreshToken), ctx, token)
+}
+
+// CreateSession mocks base method.
+func (m *MockRepositoryInterface) CreateSession(ctx context.Context, session *entity.Session) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateSession", ctx, session)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateSession indicates an expected call of CreateSession.
+func (mr *MockRepositoryInterfaceMockRecorder) CreateSession(ctx, session interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateSession", reflect.TypeOf((*MockRepositoryInterface)(nil).CreateSession), ctx, session)
+}
+
 // CreateUser mocks base method.
 func (m *MockRepositoryInterface) CreateUser(ctx context.Context, req *models.RegisterUserRequest) (int64, error) {
 	m.ctrl.T.Helper()
@@ -51,6 +239,110 @@ func (mr *MockRepositoryInterfaceMockRecorder) CreateUser(ctx, req interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUser", reflect.TypeOf((*MockRepositoryInterface)(nil).CreateUser), ctx, req)
 }
 
+// CreateWebAuthnCredential mocks base method.
+func (m *MockRepositoryInterface) CreateWebAuthnCredential(ctx context.Context, credential *entity.WebAuthnCredential) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateWebAuthnCredential", ctx, credential)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateWebAuthnCredential indicates an expected call of CreateWebAuthnCredential.
+func (mr *MockRepositoryInterfaceMockRecorder) CreateWebAuthnCredential(ctx, credential interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateWebAuthnCredential", reflect.TypeOf((*MockRepositoryInterface)(nil).CreateWebAuthnCredential), ctx, credential)
+}
+
+// GetActiveOTP mocks base method.
+func (m *MockRepositoryInterface) GetActiveOTP(ctx context.Context, phoneNumber, purpose string) (*entity.OTP, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetActiveOTP", ctx, phoneNumber, purpose)
+	ret0, _ := ret[0].(*entity.OTP)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetActiveOTP indicates an expected call of GetActiveOTP.
+func (mr *MockRepositoryInterfaceMockRecorder) GetActiveOTP(ctx, phoneNumber, purpose interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetActiveOTP", reflect.TypeOf((*MockRepositoryInterface)(nil).GetActiveOTP), ctx, phoneNumber, purpose)
+}
+
+// GetLoginFailures mocks base method.
+func (m *MockRepositoryInterface) GetLoginFailures(ctx context.Context, scope, key string) (*entity.LoginFailures, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetLoginFailures", ctx, scope, key)
+	ret0, _ := ret[0].(*entity.LoginFailures)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetLoginFailures indicates an expected call of GetLoginFailures.
+func (mr *MockRepositoryInterfaceMockRecorder) GetLoginFailures(ctx, scope, key interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLoginFailures", reflect.TypeOf((*MockRepositoryInterface)(nil).GetLoginFailures), ctx, scope, key)
+}
+
+// GetOAuthClient mocks base method.
+func (m *MockRepositoryInterface) GetOAuthClient(ctx context.Context, clientID string) (*entity.OAuthClient, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetOAuthClient", ctx, clientID)
+	ret0, _ := ret[0].(*entity.OAuthClient)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetOAuthClient indicates an expected call of GetOAuthClient.
+func (mr *MockRepositoryInterfaceMockRecorder) GetOAuthClient(ctx, clientID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOAuthClient", reflect.TypeOf((*MockRepositoryInterface)(nil).GetOAuthClient), ctx, clientID)
+}
+
+// GetRefreshToken mocks base method.
+func (m *MockRepositoryInterface) GetRefreshToken(ctx context.Context, tokenHash string) (*entity.RefreshToken, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRefreshToken", ctx, tokenHash)
+	ret0, _ := ret[0].(*entity.RefreshToken)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetRefreshToken indicates an expected call of GetRefreshToken.
+func (mr *MockRepositoryInterfaceMockRecorder) GetRefreshToken(ctx, tokenHash interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRefreshToken", reflect.TypeOf((*MockRepositoryInterface)(nil).GetRefreshToken), ctx, tokenHash)
+}
+
+// GetSession mocks base method.
+func (m *MockRepositoryInterface) GetSession(ctx context.Context, id string) (*entity.Session, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSession", ctx, id)
+	ret0, _ := ret[0].(*entity.Session)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSession indicates an expected call of GetSession.
+func (mr *MockRepositoryInterfaceMockRecorder) GetSession(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSession", reflect.TypeOf((*MockRepositoryInterface)(nil).GetSession), ctx, id)
+}
+
+// GetTOTP mocks base method.
+func (m *MockRepositoryInterface) GetTOTP(ctx context.Context, userID int64) (*entity.TOTP, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetTOTP", ctx, userID)
+	ret0, _ := ret[0].(*entity.TOTP)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetTOTP indicates an expected call of GetTOTP.
+func (mr *MockRepositoryInterfaceMockRecorder) GetTOTP(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTOTP", reflect.TypeOf((*MockRepositoryInterface)(nil).GetTOTP), ctx, userID)
+}
+
 // GetUser mocks base method.
 func (m *MockRepositoryInterface) GetUser(ctx context.Context, filter *entity.UserFilter) (*entity.UserData, error) {
 	m.ctrl.T.Helper()
@@ -66,6 +358,21 @@ func (mr *MockRepositoryInterfaceMockRecorder) GetUser(ctx, filter interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUser", reflect.TypeOf((*MockRepositoryInterface)(nil).GetUser), ctx, filter)
 }
 
+// GetUserRoles mocks base method.
+func (m *MockRepositoryInterface) GetUserRoles(ctx context.Context, userID int64) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserRoles", ctx, userID)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserRoles indicates an expected call of GetUserRoles.
+func (mr *MockRepositoryInterfaceMockRecorder) GetUserRoles(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserRoles", reflect.TypeOf((*MockRepositoryInterface)(nil).GetUserRoles), ctx, userID)
+}
+
 // IncLogin mocks base method.
 func (m *MockRepositoryInterface) IncLogin(ctx context.Context, userID int64) error {
 	m.ctrl.T.Helper()
@@ -80,6 +387,221 @@ func (mr *MockRepositoryInterfaceMockRecorder) IncLogin(ctx, userID interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IncLogin", reflect.TypeOf((*MockRepositoryInterface)(nil).IncLogin), ctx, userID)
 }
 
+// ListActiveSessions mocks base method.
+func (m *MockRepositoryInterface) ListActiveSessions(ctx context.Context, userID int64) ([]*entity.Session, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListActiveSessions", ctx, userID)
+	ret0, _ := ret[0].([]*entity.Session)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListActiveSessions indicates an expected call of ListActiveSessions.
+func (mr *MockRepositoryInterfaceMockRecorder) ListActiveSessions(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListActiveSessions", reflect.TypeOf((*MockRepositoryInterface)(nil).ListActiveSessions), ctx, userID)
+}
+
+// ListUsers mocks base method.
+func (m *MockRepositoryInterface) ListUsers(ctx context.Context, filter *entity.UserFilter, limit, offset int) ([]*entity.UserData, int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListUsers", ctx, filter, limit, offset)
+	ret0, _ := ret[0].([]*entity.UserData)
+	ret1, _ := ret[1].(int64)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// ListUsers indicates an expected call of ListUsers.
+func (mr *MockRepositoryInterfaceMockRecorder) ListUsers(ctx, filter, limit, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListUsers", reflect.TypeOf((*MockRepositoryInterface)(nil).ListUsers), ctx, filter, limit, offset)
+}
+
+// ListWebAuthnCredentials mocks base method.
+func (m *MockRepositoryInterface) ListWebAuthnCredentials(ctx context.Context, userID int64) ([]*entity.WebAuthnCredential, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListWebAuthnCredentials", ctx, userID)
+	ret0, _ := ret[0].([]*entity.WebAuthnCredential)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListWebAuthnCredentials indicates an expected call of ListWebAuthnCredentials.
+func (mr *MockRepositoryInterfaceMockRecorder) ListWebAuthnCredentials(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListWebAuthnCredentials", reflect.TypeOf((*MockRepositoryInterface)(nil).ListWebAuthnCredentials), ctx, userID)
+}
+
+// LockLogin mocks base method.
+func (m *MockRepositoryInterface) LockLogin(ctx context.Context, scope, key string, until time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LockLogin", ctx, scope, key, until)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// LockLogin indicates an expected call of LockLogin.
+func (mr *MockRepositoryInterfaceMockRecorder) LockLogin(ctx, scope, key, until interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LockLogin", reflect.TypeOf((*MockRepositoryInterface)(nil).LockLogin), ctx, scope, key, until)
+}
+
+// RecordLoginFailure mocks base method.
+func (m *MockRepositoryInterface) RecordLoginFailure(ctx context.Context, scope, key string, since time.Time) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecordLoginFailure", ctx, scope, key, since)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RecordLoginFailure indicates an expected call of RecordLoginFailure.
+func (mr *MockRepositoryInterfaceMockRecorder) RecordLoginFailure(ctx, scope, key, since interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecordLoginFailure", reflect.TypeOf((*MockRepositoryInterface)(nil).RecordLoginFailure), ctx, scope, key, since)
+}
+
+// RemoveRole mocks base method.
+func (m *MockRepositoryInterface) RemoveRole(ctx context.Context, userID int64, role string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemoveRole", ctx, userID, role)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RemoveRole indicates an expected call of RemoveRole.
+func (mr *MockRepositoryInterfaceMockRecorder) RemoveRole(ctx, userID, role interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveRole", reflect.TypeOf((*MockRepositoryInterface)(nil).RemoveRole), ctx, userID, role)
+}
+
+// ResetPassword mocks base method.
+func (m *MockRepositoryInterface) ResetPassword(ctx context.Context, userID int64, hashedPassword string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResetPassword", ctx, userID, hashedPassword)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ResetPassword indicates an expected call of ResetPassword.
+func (mr *MockRepositoryInterfaceMockRecorder) ResetPassword(ctx, userID, hashedPassword interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResetPassword", reflect.TypeOf((*MockRepositoryInterface)(nil).ResetPassword), ctx, userID, hashedPassword)
+}
+
+// RevokeRefreshTokenFamily mocks base method.
+func (m *MockRepositoryInterface) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RevokeRefreshTokenFamily", ctx, familyID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RevokeRefreshTokenFamily indicates an expected call of RevokeRefreshTokenFamily.
+func (mr *MockRepositoryInterfaceMockRecorder) RevokeRefreshTokenFamily(ctx, familyID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RevokeRefreshTokenFamily", reflect.TypeOf((*MockRepositoryInterface)(nil).RevokeRefreshTokenFamily), ctx, familyID)
+}
+
+// RevokeUserRefreshTokens mocks base method.
+func (m *MockRepositoryInterface) RevokeUserRefreshTokens(ctx context.Context, userID int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RevokeUserRefreshTokens", ctx, userID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RevokeUserRefreshTokens indicates an expected call of RevokeUserRefreshTokens.
+func (mr *MockRepositoryInterfaceMockRecorder) RevokeUserRefreshTokens(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RevokeUserRefreshTokens", reflect.TypeOf((*MockRepositoryInterface)(nil).RevokeUserRefreshTokens), ctx, userID)
+}
+
+// RotateRefreshToken mocks base method.
+func (m *MockRepositoryInterface) RotateRefreshToken(ctx context.Context, oldID int64, newToken *entity.RefreshToken) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RotateRefreshToken", ctx, oldID, newToken)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RotateRefreshToken indicates an expected call of RotateRefreshToken.
+func (mr *MockRepositoryInterfaceMockRecorder) RotateRefreshToken(ctx, oldID, newToken interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RotateRefreshToken", reflect.TypeOf((*MockRepositoryInterface)(nil).RotateRefreshToken), ctx, oldID, newToken)
+}
+
+// SetPhoneVerified mocks base method.
+func (m *MockRepositoryInterface) SetPhoneVerified(ctx context.Context, userID int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetPhoneVerified", ctx, userID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetPhoneVerified indicates an expected call of SetPhoneVerified.
+func (mr *MockRepositoryInterfaceMockRecorder) SetPhoneVerified(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetPhoneVerified", reflect.TypeOf((*MockRepositoryInterface)(nil).SetPhoneVerified), ctx, userID)
+}
+
+// SetTOTPSecret mocks base method.
+func (m *MockRepositoryInterface) SetTOTPSecret(ctx context.Context, userID int64, secret string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetTOTPSecret", ctx, userID, secret)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetTOTPSecret indicates an expected call of SetTOTPSecret.
+func (mr *MockRepositoryInterfaceMockRecorder) SetTOTPSecret(ctx, userID, secret interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTOTPSecret", reflect.TypeOf((*MockRepositoryInterface)(nil).SetTOTPSecret), ctx, userID, secret)
+}
+
+// SetUserDisabled mocks base method.
+func (m *MockRepositoryInterface) SetUserDisabled(ctx context.Context, userID int64, disabled bool) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetUserDisabled", ctx, userID, disabled)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetUserDisabled indicates an expected call of SetUserDisabled.
+func (mr *MockRepositoryInterfaceMockRecorder) SetUserDisabled(ctx, userID, disabled interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetUserDisabled", reflect.TypeOf((*MockRepositoryInterface)(nil).SetUserDisabled), ctx, userID, disabled)
+}
+
+// TouchSession mocks base method.
+func (m *MockRepositoryInterface) TouchSession(ctx context.Context, id string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TouchSession", ctx, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// TouchSession indicates an expected call of TouchSession.
+func (mr *MockRepositoryInterfaceMockRecorder) TouchSession(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TouchSession", reflect.TypeOf((*MockRepositoryInterface)(nil).TouchSession), ctx, id)
+}
+
+// UpdatePassword mocks base method.
+func (m *MockRepositoryInterface) UpdatePassword(ctx context.Context, userID int64, hashedPassword string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdatePassword", ctx, userID, hashedPassword)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdatePassword indicates an expected call of UpdatePassword.
+func (mr *MockRepositoryInterfaceMockRecorder) UpdatePassword(ctx, userID, hashedPassword interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdatePassword", reflect.TypeOf((*MockRepositoryInterface)(nil).UpdatePassword), ctx, userID, hashedPassword)
+}
+
 // UpdateProfile mocks base method.
 func (m *MockRepositoryInterface) UpdateProfile(ctx context.Context, userID int64, req *models.UpdateUserProfileRequest) error {
 	m.ctrl.T.Helper()
@@ -93,3 +615,137 @@ func (mr *MockRepositoryInterfaceMockRecorder) UpdateProfile(ctx, userID, req in
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateProfile", reflect.TypeOf((*MockRepositoryInterface)(nil).UpdateProfile), ctx, userID, req)
 }
+
+// UpdateWebAuthnCredentialSignCount mocks base method.
+func (m *MockRepositoryInterface) UpdateWebAuthnCredentialSignCount(ctx context.Context, credentialID []byte, signCount uint32) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateWebAuthnCredentialSignCount", ctx, credentialID, signCount)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateWebAuthnCredentialSignCount indicates an expected call of UpdateWebAuthnCredentialSignCount.
+func (mr *MockRepositoryInterfaceMockRecorder) UpdateWebAuthnCredentialSignCount(ctx, credentialID, signCount interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateWebAuthnCredentialSignCount", reflect.TypeOf((*MockRepositoryInterface)(nil).UpdateWebAuthnCredentialSignCount), ctx, credentialID, signCount)
+}
+
+// UseOTPAttempt mocks base method.
+func (m *MockRepositoryInterface) UseOTPAttempt(ctx context.Context, otpID int64, maxAttempts int) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UseOTPAttempt", ctx, otpID, maxAttempts)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UseOTPAttempt indicates an expected call of UseOTPAttempt.
+func (mr *MockRepositoryInterfaceMockRecorder) UseOTPAttempt(ctx, otpID, maxAttempts interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UseOTPAttempt", reflect.TypeOf((*MockRepositoryInterface)(nil).UseOTPAttempt), ctx, otpID, maxAttempts)
+}
+
+// UseTOTPStep mocks base method.
+func (m *MockRepositoryInterface) UseTOTPStep(ctx context.Context, userID, step int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UseTOTPStep", ctx, userID, step)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UseTOTPStep indicates an expected call of UseTOTPStep.
+func (mr *MockRepositoryInterfaceMockRecorder) UseTOTPStep(ctx, userID, step interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UseTOTPStep", reflect.TypeOf((*MockRepositoryInterface)(nil).UseTOTPStep), ctx, userID, step)
+}
+
+// MockRevocationStoreInterface is a mock of RevocationStoreInterface interface.
+type MockRevocationStoreInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockRevocationStoreInterfaceMockRecorder
+}
+
+// MockRevocationStoreInterfaceMockRecorder is the mock recorder for MockRevocationStoreInterface.
+type MockRevocationStoreInterfaceMockRecorder struct {
+	mock *MockRevocationStoreInterface
+}
+
+// NewMockRevocationStoreInterface creates a new mock instance.
+func NewMockRevocationStoreInterface(ctrl *gomock.Controller) *MockRevocationStoreInterface {
+	mock := &MockRevocationStoreInterface{ctrl: ctrl}
+	mock.recorder = &MockRevocationStoreInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockRevocationStoreInterface) EXPECT() *MockRevocationStoreInterfaceMockRecorder {
+	return m.recorder
+}
+
+// IsRevoked mocks base method.
+func (m *MockRevocationStoreInterface) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "IsRevoked", ctx, jti)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// IsRevoked indicates an expected call of IsRevoked.
+func (mr *MockRevocationStoreInterfaceMockRecorder) IsRevoked(ctx, jti interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsRevoked", reflect.TypeOf((*MockRevocationStoreInterface)(nil).IsRevoked), ctx, jti)
+}
+
+// Revoke mocks base method.
+func (m *MockRevocationStoreInterface) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Revoke", ctx, jti, expiresAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Revoke indicates an expected call of Revoke.
+func (mr *MockRevocationStoreInterfaceMockRecorder) Revoke(ctx, jti, expiresAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Revoke", reflect.TypeOf((*MockRevocationStoreInterface)(nil).Revoke), ctx, jti, expiresAt)
+}
+
+// MockRateLimitStoreInterface is a mock of RateLimitStoreInterface interface.
+type MockRateLimitStoreInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockRateLimitStoreInterfaceMockRecorder
+}
+
+// MockRateLimitStoreInterfaceMockRecorder is the mock recorder for MockRateLimitStoreInterface.
+type MockRateLimitStoreInterfaceMockRecorder struct {
+	mock *MockRateLimitStoreInterface
+}
+
+// NewMockRateLimitStoreInterface creates a new mock instance.
+func NewMockRateLimitStoreInterface(ctrl *gomock.Controller) *MockRateLimitStoreInterface {
+	mock := &MockRateLimitStoreInterface{ctrl: ctrl}
+	mock.recorder = &MockRateLimitStoreInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockRateLimitStoreInterface) EXPECT() *MockRateLimitStoreInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Take mocks base method.
+func (m *MockRateLimitStoreInterface) Take(ctx context.Context, key string, capacity int, refillEvery time.Duration) (bool, float64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Take", ctx, key, capacity, refillEvery)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(float64)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// Take indicates an expected call of Take.
+func (mr *MockRateLimitStoreInterfaceMockRecorder) Take(ctx, key, capacity, refillEvery interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Take", reflect.TypeOf((*MockRateLimitStoreInterface)(nil).Take), ctx, key, capacity, refillEvery)
+}
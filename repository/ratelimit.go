@@ -0,0 +1,151 @@
+// This file contains the stores for rate limits.
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"sync"
+	"time"
+)
+
+// takeToken refills a token bucket holding tokens since it was updated and
+// takes a token from it if there is one. A bucket holds at most capacity
+// tokens and gains one every refillEvery.
+func takeToken(tokens float64, updatedAt, now time.Time, capacity int, refillEvery time.Duration) (allowed bool, remaining float64) {
+	elapsed := now.Sub(updatedAt)
+	if elapsed > 0 {
+		tokens += float64(elapsed) / float64(refillEvery)
+	}
+	tokens = math.Min(tokens, float64(capacity))
+
+	if tokens < 1 {
+		return false, tokens
+	}
+
+	return true, tokens - 1
+}
+
+// fullAt returns when a bucket with the remaining tokens is full again, after
+// which it can be forgotten since a missing bucket counts as full.
+func fullAt(remaining float64, now time.Time, capacity int, refillEvery time.Duration) time.Time {
+	return now.Add(time.Duration((float64(capacity) - remaining) * float64(refillEvery)))
+}
+
+// RateLimitStore keeps token buckets in Postgres so every instance of the
+// service shares the same limits.
+type RateLimitStore struct {
+	Db *sql.DB
+}
+
+func NewRateLimitStore(db *sql.DB) *RateLimitStore {
+	return &RateLimitStore{
+		Db: db,
+	}
+}
+
+func (s *RateLimitStore) Take(ctx context.Context, key string, capacity int, refillEvery time.Duration) (allowed bool, remaining float64, err error) {
+	tx, err := s.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback()
+
+	// A new bucket starts full, the row is locked so concurrent requests
+	// take turns
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO rate_limits (key, tokens, updated_at, full_at) VALUES ($1, $2, NOW(), NOW()) ON CONFLICT (key) DO NOTHING",
+		key, float64(capacity))
+	if err != nil {
+		return false, 0, err
+	}
+
+	var tokens float64
+	var updatedAt, now time.Time
+
+	err = tx.QueryRowContext(ctx,
+		"SELECT tokens, updated_at, NOW() FROM rate_limits WHERE key = $1 FOR UPDATE",
+		key).
+		Scan(&tokens, &updatedAt, &now)
+	if err != nil {
+		return false, 0, err
+	}
+
+	allowed, remaining = takeToken(tokens, updatedAt, now, capacity, refillEvery)
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE rate_limits SET tokens = $2, updated_at = $3, full_at = $4 WHERE key = $1",
+		key, remaining, now, fullAt(remaining, now, capacity, refillEvery))
+	if err != nil {
+		return false, 0, err
+	}
+
+	return allowed, remaining, tx.Commit()
+}
+
+// Prune deletes the buckets that are full again, which are the same as
+// missing ones. It is meant to run periodically, so requests do not contend
+// on the whole table.
+func (s *RateLimitStore) Prune(ctx context.Context) error {
+	_, err := s.Db.ExecContext(ctx, "DELETE FROM rate_limits WHERE full_at < NOW()")
+	return err
+}
+
+type memoryBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	fullAt    time.Time
+}
+
+// MemoryRateLimitStore keeps token buckets in memory. It is meant for a
+// single instance and for tests. Full buckets are kept until Prune runs.
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]memoryBucket
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets: make(map[string]memoryBucket),
+	}
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, capacity int, refillEvery time.Duration) (allowed bool, remaining float64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = memoryBucket{
+			tokens:    float64(capacity),
+			updatedAt: now,
+		}
+	}
+
+	allowed, remaining = takeToken(bucket.tokens, bucket.updatedAt, now, capacity, refillEvery)
+
+	s.buckets[key] = memoryBucket{
+		tokens:    remaining,
+		updatedAt: now,
+		fullAt:    fullAt(remaining, now, capacity, refillEvery),
+	}
+
+	return allowed, remaining, nil
+}
+
+// Prune forgets the buckets that are full again, like RateLimitStore.Prune.
+func (s *MemoryRateLimitStore) Prune(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, bucket := range s.buckets {
+		if bucket.fullAt.Before(now) {
+			delete(s.buckets, key)
+		}
+	}
+
+	return nil
+}
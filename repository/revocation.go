@@ -0,0 +1,98 @@
+// This file contains the stores for revoked access tokens.
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// RevocationStore keeps revoked token IDs in Postgres so every instance of
+// the service sees the same revocations.
+type RevocationStore struct {
+	Db *sql.DB
+}
+
+func NewRevocationStore(db *sql.DB) *RevocationStore {
+	return &RevocationStore{
+		Db: db,
+	}
+}
+
+func (s *RevocationStore) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	_, err := s.Db.ExecContext(ctx,
+		"INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING",
+		jti, expiresAt)
+	return err
+}
+
+// Prune deletes the revocations of tokens past their expiry, which are
+// rejected anyway. It is meant to run periodically instead of on every
+// revocation.
+func (s *RevocationStore) Prune(ctx context.Context) error {
+	_, err := s.Db.ExecContext(ctx, "DELETE FROM revoked_tokens WHERE expires_at < NOW()")
+	return err
+}
+
+func (s *RevocationStore) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	var revoked bool
+
+	err := s.Db.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1 AND expires_at > NOW())",
+		jti).
+		Scan(&revoked)
+	if err != nil {
+		return false, err
+	}
+
+	return revoked, nil
+}
+
+// MemoryRevocationStore keeps revoked token IDs in memory. It is meant for a
+// single instance and for tests. Expired revocations are kept until Prune
+// runs.
+type MemoryRevocationStore struct {
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{
+		revoked: make(map[string]time.Time),
+	}
+}
+
+func (s *MemoryRevocationStore) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revoked[jti] = expiresAt
+
+	return nil
+}
+
+// Prune forgets the revocations of tokens past their expiry, like
+// RevocationStore.Prune.
+func (s *MemoryRevocationStore) Prune(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for jti, expiresAt := range s.revoked {
+		if expiresAt.Before(now) {
+			delete(s.revoked, jti)
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryRevocationStore) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exp, ok := s.revoked[jti]
+
+	return ok && exp.After(time.Now()), nil
+}
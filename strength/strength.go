@@ -0,0 +1,353 @@
+// Package strength rejects weak passwords: ones found in a list of breached
+// passwords and ones that are too easy to guess.
+package strength
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"unicode"
+)
+
+const (
+	// PrefixLength is how many bytes of the SHA-1 of every breached password
+	// the index keeps. Eight bytes make false positives practically
+	// impossible for lists of any realistic size.
+	PrefixLength = 8
+	// DefaultMinEntropy is the entropy in bits a password needs by default
+	DefaultMinEntropy = 40
+)
+
+// indexMagic starts every index file, followed by the number of prefixes
+var indexMagic = []byte("PWIDX1\x00\x00")
+
+// indexHeaderLength is the length of the magic and the prefix count
+var indexHeaderLength = len(indexMagic) + 8
+
+// Index looks up breached passwords in the sorted SHA-1 prefixes of an index
+// file. The prefixes are read as needed, so the index is never loaded into
+// memory as a whole.
+type Index struct {
+	r     io.ReaderAt
+	count int64
+	file  *os.File
+}
+
+// LoadIndex opens an index file written by WriteIndex or IndexWriter. The
+// file stays open until the index is closed.
+func LoadIndex(path string) (*Index, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	index, err := NewIndex(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	index.file = f
+
+	return index, nil
+}
+
+// NewIndex reads an index of the given size from r. The prefix count in the
+// header must match the size, so a corrupt or truncated index is rejected.
+func NewIndex(r io.ReaderAt, size int64) (*Index, error) {
+	if size < int64(indexHeaderLength) {
+		return nil, errors.New("index is too short for its header")
+	}
+
+	header := make([]byte, indexHeaderLength)
+
+	_, err := r.ReadAt(header, 0)
+	if err != nil {
+		return nil, fmt.Errorf("read index header: %w", err)
+	}
+	if !bytes.Equal(header[:len(indexMagic)], indexMagic) {
+		return nil, errors.New("not a breached password index")
+	}
+
+	// Compared by division so a huge count cannot overflow
+	count := binary.BigEndian.Uint64(header[len(indexMagic):])
+	prefixesSize := uint64(size - int64(indexHeaderLength))
+	if prefixesSize%PrefixLength != 0 || count != prefixesSize/PrefixLength {
+		return nil, fmt.Errorf("index header lists %d prefixes but the file holds %d bytes of them", count, prefixesSize)
+	}
+
+	return &Index{
+		r:     r,
+		count: int64(count),
+	}, nil
+}
+
+// WriteIndex writes the SHA-1 hashes of breached passwords as an index. The
+// hashes are sorted in memory, use IndexWriter for lists that are too big.
+func WriteIndex(w io.Writer, hashes [][sha1.Size]byte) error {
+	prefixes := make([][]byte, 0, len(hashes))
+	for i := range hashes {
+		prefixes = append(prefixes, hashes[i][:PrefixLength])
+	}
+
+	sort.Slice(prefixes, func(i, j int) bool {
+		return bytes.Compare(prefixes[i], prefixes[j]) < 0
+	})
+
+	// Duplicates would only make the file bigger
+	unique := prefixes[:0]
+	for _, prefix := range prefixes {
+		if len(unique) == 0 || !bytes.Equal(unique[len(unique)-1], prefix) {
+			unique = append(unique, prefix)
+		}
+	}
+
+	_, err := w.Write(indexHeader(uint64(len(unique))))
+	if err != nil {
+		return err
+	}
+
+	for _, prefix := range unique {
+		_, err = w.Write(prefix)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func indexHeader(count uint64) []byte {
+	header := make([]byte, indexHeaderLength)
+	copy(header, indexMagic)
+	binary.BigEndian.PutUint64(header[len(indexMagic):], count)
+
+	return header
+}
+
+// IndexWriter writes an index from hashes that are already sorted, like the
+// Have I Been Pwned download ordered by hash, without holding them in memory.
+type IndexWriter struct {
+	w     io.WriteSeeker
+	buf   *bufio.Writer
+	last  []byte
+	count uint64
+}
+
+// NewIndexWriter starts an index in w. The prefix count is filled in by
+// Close, which is why w has to be seekable.
+func NewIndexWriter(w io.WriteSeeker) (*IndexWriter, error) {
+	buf := bufio.NewWriter(w)
+
+	// Replaced by the real header on Close
+	_, err := buf.Write(indexHeader(0))
+	if err != nil {
+		return nil, err
+	}
+
+	return &IndexWriter{
+		w:   w,
+		buf: buf,
+	}, nil
+}
+
+// Add writes the hash of a breached password. Hashes have to be added in
+// ascending order, duplicates are skipped.
+func (writer *IndexWriter) Add(hash [sha1.Size]byte) error {
+	prefix := hash[:PrefixLength]
+
+	if writer.last != nil {
+		switch bytes.Compare(prefix, writer.last) {
+		case 0:
+			return nil
+		case -1:
+			return fmt.Errorf("hash %X is not sorted, the input has to be in ascending order", hash)
+		}
+	}
+
+	_, err := writer.buf.Write(prefix)
+	if err != nil {
+		return err
+	}
+
+	writer.last = prefix
+	writer.count++
+
+	return nil
+}
+
+// Len returns the number of prefixes written so far.
+func (writer *IndexWriter) Len() int64 {
+	return int64(writer.count)
+}
+
+// Close flushes the prefixes and writes the header with their count.
+func (writer *IndexWriter) Close() error {
+	err := writer.buf.Flush()
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.w.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.w.Write(indexHeader(writer.count))
+	return err
+}
+
+// Contains tells whether the password is in the index.
+func (index *Index) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	prefix := sum[:PrefixLength]
+	entry := make([]byte, PrefixLength)
+
+	// Binary search for the first prefix not below the one looked up
+	low, high := int64(0), index.count
+	for low < high {
+		middle := low + (high-low)/2
+
+		_, err := index.r.ReadAt(entry, int64(indexHeaderLength)+middle*PrefixLength)
+		if err != nil {
+			return false, fmt.Errorf("read index: %w", err)
+		}
+
+		switch bytes.Compare(entry, prefix) {
+		case 0:
+			return true, nil
+		case -1:
+			low = middle + 1
+		default:
+			high = middle
+		}
+	}
+
+	return false, nil
+}
+
+// Len returns the number of breached passwords in the index.
+func (index *Index) Len() int64 {
+	return index.count
+}
+
+// Close closes the index file opened by LoadIndex.
+func (index *Index) Close() error {
+	if index.file == nil {
+		return nil
+	}
+
+	return index.file.Close()
+}
+
+// Entropy estimates how many bits of entropy the password has, from the
+// kinds of characters it uses and its length. Characters repeating the
+// previous one or continuing a sequence like "abc" or "321" do not count.
+func Entropy(password string) float64 {
+	var lower, upper, digit, other bool
+	length := 0
+
+	var previous, step rune
+	inRun := false
+	for i, r := range []rune(password) {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+
+		diff := r - previous
+		previous = r
+		if i > 0 && (diff == 0 || diff == 1 || diff == -1) && (!inRun || diff == step) {
+			step = diff
+			inRun = true
+			continue
+		}
+
+		inRun = false
+		length++
+	}
+
+	pool := 0
+	if lower {
+		pool += 26
+	}
+	if upper {
+		pool += 26
+	}
+	if digit {
+		pool += 10
+	}
+	if other {
+		pool += 33
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	return float64(length) * math.Log2(float64(pool))
+}
+
+// Checker rejects breached and easily guessed passwords.
+type Checker struct {
+	index      *Index
+	minEntropy float64
+}
+
+type NewCheckerOptions struct {
+	// Index of breached passwords, none are checked when nil
+	Index *Index
+	// MinEntropy defaults to DefaultMinEntropy when zero
+	MinEntropy float64
+}
+
+func NewChecker(opts NewCheckerOptions) *Checker {
+	minEntropy := opts.MinEntropy
+	if minEntropy == 0 {
+		minEntropy = DefaultMinEntropy
+	}
+
+	return &Checker{
+		index:      opts.Index,
+		minEntropy: minEntropy,
+	}
+}
+
+// Check returns why the password is too weak, or nothing when it is strong
+// enough. An error means the breached password index could not be read.
+func (checker *Checker) Check(password string) ([]string, error) {
+	var errs []string
+
+	if checker.index != nil {
+		breached, err := checker.index.Contains(password)
+		if err != nil {
+			return nil, err
+		}
+		if breached {
+			errs = append(errs, "Password has appeared in a data breach, choose another one")
+		}
+	}
+
+	if Entropy(password) < checker.minEntropy {
+		errs = append(errs, "Password is too easy to guess, make it longer or less predictable")
+	}
+
+	return errs, nil
+}
@@ -0,0 +1,185 @@
+package strength_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/SawitProRecruitment/UserService/strength"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestIndex(t *testing.T, passwords ...string) *strength.Index {
+	t.Helper()
+
+	hashes := make([][sha1.Size]byte, 0, len(passwords))
+	for _, password := range passwords {
+		hashes = append(hashes, sha1.Sum([]byte(password)))
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, strength.WriteIndex(&buf, hashes))
+
+	index, err := strength.NewIndex(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+
+	return index
+}
+
+func contains(t *testing.T, index *strength.Index, password string) bool {
+	t.Helper()
+
+	found, err := index.Contains(password)
+	require.NoError(t, err)
+
+	return found
+}
+
+func TestIndex(t *testing.T) {
+	index := newTestIndex(t, "Password1!", "P@ssw0rd", "qwerty", "qwerty", "letmein")
+
+	assert.Equal(t, int64(4), index.Len())
+	assert.True(t, contains(t, index, "Password1!"))
+	assert.True(t, contains(t, index, "P@ssw0rd"))
+	assert.True(t, contains(t, index, "qwerty"))
+	assert.True(t, contains(t, index, "letmein"))
+	assert.False(t, contains(t, index, "password1!"))
+	assert.False(t, contains(t, index, "N3w-P@ssword"))
+
+	empty := newTestIndex(t)
+	assert.False(t, contains(t, empty, "qwerty"))
+}
+
+func TestLoadIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.idx")
+
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, strength.WriteIndex(f, [][sha1.Size]byte{sha1.Sum([]byte("Password1!"))}))
+	require.NoError(t, f.Close())
+
+	index, err := strength.LoadIndex(path)
+	require.NoError(t, err)
+	assert.True(t, contains(t, index, "Password1!"))
+	require.NoError(t, index.Close())
+}
+
+func TestNewIndexCorrupt(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, strength.WriteIndex(&buf, [][sha1.Size]byte{
+		sha1.Sum([]byte("Password1!")),
+		sha1.Sum([]byte("qwerty")),
+	}))
+	valid := buf.Bytes()
+
+	hugeCount := bytes.Clone(valid)
+	binary.BigEndian.PutUint64(hugeCount[8:16], math.MaxUint64)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "Not An Index", data: []byte("Password1!\nqwerty\n")},
+		{name: "Truncated Header", data: valid[:10]},
+		{name: "Truncated Prefixes", data: valid[:len(valid)-3]},
+		{name: "Missing Prefix", data: valid[:len(valid)-strength.PrefixLength]},
+		{name: "Huge Count", data: hugeCount},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := strength.NewIndex(bytes.NewReader(tt.data), int64(len(tt.data)))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestIndexWriter(t *testing.T) {
+	passwords := []string{"Password1!", "P@ssw0rd", "qwerty", "letmein"}
+
+	hashes := make([][sha1.Size]byte, 0, len(passwords)+1)
+	for _, password := range passwords {
+		hashes = append(hashes, sha1.Sum([]byte(password)))
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+	hashes = append(hashes, hashes[len(hashes)-1])
+
+	path := filepath.Join(t.TempDir(), "breached.idx")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+
+	writer, err := strength.NewIndexWriter(f)
+	require.NoError(t, err)
+	for _, hash := range hashes {
+		require.NoError(t, writer.Add(hash))
+	}
+	assert.Equal(t, int64(4), writer.Len())
+	assert.Error(t, writer.Add(hashes[0]))
+	require.NoError(t, writer.Close())
+	require.NoError(t, f.Close())
+
+	index, err := strength.LoadIndex(path)
+	require.NoError(t, err)
+	defer index.Close()
+
+	assert.Equal(t, int64(4), index.Len())
+	for _, password := range passwords {
+		assert.True(t, contains(t, index, password))
+	}
+	assert.False(t, contains(t, index, "N3w-P@ssword"))
+}
+
+func TestEntropy(t *testing.T) {
+	tests := []struct {
+		password string
+		minimum  float64
+		maximum  float64
+	}{
+		{password: "", minimum: 0, maximum: 0},
+		{password: "aaaaaaaa", minimum: 4, maximum: 5},
+		{password: "abcdefgh", minimum: 4, maximum: 5},
+		{password: "87654321", minimum: 3, maximum: 4},
+		{password: "Abc123!", minimum: 20, maximum: 30},
+		{password: "P@ssword1", minimum: 50, maximum: 55},
+		{password: "x7#Qm2!vL9", minimum: 65, maximum: 66},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			entropy := strength.Entropy(tt.password)
+			assert.GreaterOrEqual(t, entropy, tt.minimum)
+			assert.LessOrEqual(t, entropy, tt.maximum)
+		})
+	}
+}
+
+func TestChecker(t *testing.T) {
+	checker := strength.NewChecker(strength.NewCheckerOptions{
+		Index: newTestIndex(t, "Password1!"),
+	})
+
+	tests := []struct {
+		checker  *strength.Checker
+		password string
+		expected int
+	}{
+		{checker: checker, password: "N3w-P@ssword", expected: 0},
+		{checker: checker, password: "Password1!", expected: 1},
+		{checker: checker, password: "Aaaaaa1!", expected: 1},
+		{checker: strength.NewChecker(strength.NewCheckerOptions{}), password: "Password1!", expected: 0},
+	}
+
+	for _, tt := range tests {
+		errs, err := tt.checker.Check(tt.password)
+		require.NoError(t, err)
+		assert.Len(t, errs, tt.expected, tt.password)
+	}
+}
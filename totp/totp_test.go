@@ -0,0 +1,82 @@
+package totp_test
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/SawitProRecruitment/UserService/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rfcSecret is the SHA1 key of the RFC 6238 test vectors
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	// RFC 6238 appendix B, truncated to 6 digits
+	tests := []struct {
+		unix     int64
+		expected string
+	}{
+		{unix: 59, expected: "287082"},
+		{unix: 1111111109, expected: "081804"},
+		{unix: 1111111111, expected: "050471"},
+		{unix: 1234567890, expected: "005924"},
+		{unix: 2000000000, expected: "279037"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expected, func(t *testing.T) {
+			code, err := totp.Code(rfcSecret, totp.Step(time.Unix(tt.unix, 0)))
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, code)
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	secret, err := totp.GenerateSecret()
+	require.NoError(t, err)
+
+	now := time.Now()
+	step := totp.Step(now)
+
+	current, err := totp.Code(secret, step)
+	require.NoError(t, err)
+	previous, err := totp.Code(secret, step-1)
+	require.NoError(t, err)
+	expired, err := totp.Code(secret, step-2)
+	require.NoError(t, err)
+
+	matched, ok := totp.Verify(secret, current, now)
+	assert.True(t, ok)
+	assert.Equal(t, step, matched)
+
+	matched, ok = totp.Verify(secret, previous, now)
+	assert.True(t, ok)
+	assert.Equal(t, step-1, matched)
+
+	if expired != current && expired != previous {
+		_, ok = totp.Verify(secret, expired, now)
+		assert.False(t, ok)
+	}
+
+	_, ok = totp.Verify(secret, "12345", now)
+	assert.False(t, ok)
+
+	_, ok = totp.Verify("not base32!", current, now)
+	assert.False(t, ok)
+}
+
+func TestURI(t *testing.T) {
+	uri, err := url.Parse(totp.URI("UserService", "+621234567890", "SECRET"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/UserService:+621234567890", uri.Path)
+	assert.Equal(t, "SECRET", uri.Query().Get("secret"))
+	assert.Equal(t, "UserService", uri.Query().Get("issuer"))
+}